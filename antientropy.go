@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/pavanmanikanta98/dfs-with-go/p2p"
+)
+
+// antiEntropyInterval is how often we compare our manifests with every peer.
+// It catches the writes we missed while we were offline, reads repair the
+// files that are read long before that.
+const antiEntropyInterval = time.Minute
+
+// MessageMerkleHashes asks for the hashes of the subtrees of the prefixes.
+type MessageMerkleHashes struct {
+	ReqID    uint64
+	Prefixes []string
+}
+
+type MessageMerkleHashesResponse struct {
+	ReqID  uint64
+	Hashes [][]byte
+}
+
+// MessageMerkleEntries asks for the entries of the leaves.
+type MessageMerkleEntries struct {
+	ReqID  uint64
+	Leaves []string
+}
+
+type MessageMerkleEntriesResponse struct {
+	ReqID   uint64
+	Entries []MerkleEntry
+}
+
+func (s *FileServer) handleMessageMerkleHashes(from string, msg MessageMerkleHashes) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not found in the peer list", from)
+	}
+
+	hashes := make([][]byte, len(msg.Prefixes))
+	for i, prefix := range msg.Prefixes {
+		if len(prefix) > merkleDepth {
+			return fmt.Errorf("prefix %s from %s is below the leaves", prefix, from)
+		}
+		hashes[i] = s.store.tree.hash(prefix)
+	}
+
+	res := Message{
+		Payload: MessageMerkleHashesResponse{
+			ReqID:  msg.ReqID,
+			Hashes: hashes,
+		},
+	}
+	return s.send(peer, &res)
+}
+
+func (s *FileServer) handleMessageMerkleEntries(from string, msg MessageMerkleEntries) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not found in the peer list", from)
+	}
+
+	entries := []MerkleEntry{}
+	for _, leaf := range msg.Leaves {
+		entries = append(entries, s.store.tree.entries(leaf)...)
+	}
+
+	res := Message{
+		Payload: MessageMerkleEntriesResponse{
+			ReqID:   msg.ReqID,
+			Entries: entries,
+		},
+	}
+	return s.send(peer, &res)
+}
+
+// ask sends the request to the peer and returns its answer.
+func (s *FileServer) ask(peer p2p.Peer, req *pendingRequest, payload any) (any, error) {
+	if err := s.send(peer, &Message{Payload: payload}); err != nil {
+		return nil, err
+	}
+
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
+
+	rep := req.wait(timeout)
+	if rep == nil {
+		return nil, fmt.Errorf("peer %s did not answer in time", peer.RemoteAddr())
+	}
+	rep.Close()
+	return rep.payload, nil
+}
+
+// syncWith compares our tree with the one of the peer, level by level and
+// only below the prefixes that differ, and pulls the manifests the peer has
+// a newer version of. The peer does the same with us, so each side only
+// ever pulls. It returns how many files it pulled.
+//
+// Expired files leave a tombstone behind, which wins over the file. A file
+// whose tombstone is gone already comes back from a peer that still has it.
+func (s *FileServer) syncWith(peer p2p.Peer) (int, error) {
+	var (
+		prefixes = []string{""}
+		leaves   []string
+	)
+
+	for len(prefixes) > 0 {
+		req := s.newRequest()
+		payload, err := s.ask(peer, req, MessageMerkleHashes{ReqID: req.id, Prefixes: prefixes})
+		s.finishRequest(req)
+		if err != nil {
+			return 0, err
+		}
+
+		theirs := payload.(MessageMerkleHashesResponse).Hashes
+		if len(theirs) != len(prefixes) {
+			return 0, fmt.Errorf("peer %s answered %d hashes for %d prefixes", peer.RemoteAddr(), len(theirs), len(prefixes))
+		}
+
+		differ := []string{}
+		for i, prefix := range prefixes {
+			if !bytes.Equal(theirs[i], s.store.tree.hash(prefix)) {
+				differ = append(differ, prefix)
+			}
+		}
+
+		if len(differ) > 0 && len(differ[0]) == merkleDepth {
+			leaves = differ
+			break
+		}
+		prefixes = childPrefixes(differ)
+	}
+
+	if len(leaves) == 0 {
+		return 0, nil
+	}
+
+	req := s.newRequest()
+	payload, err := s.ask(peer, req, MessageMerkleEntries{ReqID: req.id, Leaves: leaves})
+	s.finishRequest(req)
+	if err != nil {
+		return 0, err
+	}
+
+	pulled := 0
+	for _, e := range payload.(MessageMerkleEntriesResponse).Entries {
+		var mine *Manifest
+		if s.store.Has(e.ID, e.Key) {
+			mine, _ = s.store.ReadManifest(e.ID, e.Key)
+		}
+		if !e.newerThan(mine) {
+			continue
+		}
+
+		if err := s.pullFile(peer, e); err != nil {
+			log.Printf("[%s] failed to pull %s of %s from %s: %v", s.Transport.Addr(), e.Key, e.ID, peer.RemoteAddr(), err)
+			continue
+		}
+		pulled++
+	}
+
+	return pulled, nil
+}
+
+// pullFile copies the file of the entry from the peer, with the chunks we
+// are supposed to hold. The manifest goes last, as always.
+func (s *FileServer) pullFile(peer p2p.Peer, e MerkleEntry) error {
+	m, err := s.fetchManifestFrom(peer, e.ID, e.Key)
+	if err != nil {
+		return err
+	}
+
+	if err := s.fetchHeld(peer.RemoteAddr().String(), e.ID, m); err != nil {
+		return err
+	}
+
+	return s.store.WriteManifest(e.ID, m)
+}
+
+// fetchManifestFrom asks a single peer for the manifest of the key of the
+// owner.
+func (s *FileServer) fetchManifestFrom(peer p2p.Peer, id string, hkey string) (*Manifest, error) {
+	req := s.newRequest()
+	defer s.finishRequest(req)
+
+	msg := Message{
+		Payload: MessageGetFile{
+			ReqID: req.id,
+			ID:    id,
+			Key:   hkey,
+		},
+	}
+	if err := s.send(peer, &msg); err != nil {
+		return nil, err
+	}
+
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
+
+	rep := req.wait(timeout)
+	if rep == nil {
+		return nil, fmt.Errorf("peer %s did not answer in time", peer.RemoteAddr())
+	}
+	defer rep.Close()
+
+	if !rep.payload.(MessageManifestResponse).Found {
+		return nil, fmt.Errorf("peer %s does not have %s anymore", peer.RemoteAddr(), hkey)
+	}
+
+	m, err := decodeManifest(rep.r)
+	if err != nil {
+		return nil, err
+	}
+	if m.Key != hkey {
+		return nil, fmt.Errorf("peer %s answered with the manifest of %s", peer.RemoteAddr(), m.Key)
+	}
+	return m, nil
+}
+
+// fetchHeld gets the chunks of the manifest of the owner we are supposed to
+// hold, none of a replicated file we are not a replica of. Our shards of an erasure coded file are cut again from the chunks, which are
+// put back together from the shards of the other nodes.
+func (s *FileServer) fetchHeld(holder string, id string, m *Manifest) error {
+	replicas := s.placement(id, m)
+	if !m.Durability.erasureCoded() {
+		if !slices.Contains(replicas, s.ID) {
+			return nil
+		}
+		return s.fetchChunks([]string{holder}, m.Chunks)
+	}
+
+	var (
+		missing = s.store.missingHeld(m, s.ID, replicas)
+		wanted  = make(map[string]bool, len(missing))
+		chunks  = []ChunkRef{}
+	)
+	if len(missing) == 0 {
+		return nil
+	}
+	for _, hash := range missing {
+		wanted[hash] = true
+	}
+	for _, c := range m.Chunks {
+		for _, hash := range c.Shards {
+			if wanted[hash] {
+				chunks = append(chunks, c)
+				break
+			}
+		}
+	}
+
+	if err := s.reconstructChunks(m.Durability, s.store.missingChunks(chunks)); err != nil {
+		return err
+	}
+
+	for _, hash := range missing {
+		b, ok := s.readPiece(m, hash)
+		if !ok {
+			return fmt.Errorf("failed to cut shard %s", hash)
+		}
+		if _, err := s.store.WriteChunk(hash, bytes.NewReader(b)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// antiEntropy periodically syncs with every peer.
+func (s *FileServer) antiEntropy() {
+	ticker := time.NewTicker(antiEntropyInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, peer := range s.peerList() {
+				n, err := s.syncWith(peer)
+				if err != nil {
+					log.Printf("[%s] anti-entropy with %s failed: %v", s.Transport.Addr(), peer.RemoteAddr(), err)
+					continue
+				}
+				if n > 0 {
+					log.Printf("[%s] pulled %d files from %s", s.Transport.Addr(), n, peer.RemoteAddr())
+				}
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
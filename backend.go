@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// Backend keeps the objects of a store, every one under a namespace and a
+// name. The store names its keys with its PathTransformFunc, a name may have
+// slashes in it.
+//
+// Objects that are not there are reported with errors that are
+// fs.ErrNotExist.
+type Backend interface {
+	// Put stores what r yields under the name. It only replaces what was
+	// under the name once r is read to its end, a write that fails halfway
+	// leaves nothing behind.
+	Put(ns string, name string, r io.Reader) (int64, error)
+	// Get returns the size of the object and a reader of its bytes, the
+	// caller closes it. The reader need not seek, a remote backend streams
+	// the object. Only store.ReadAt makes use of Seek when it is there.
+	Get(ns string, name string) (int64, io.ReadCloser, error)
+	Has(ns string, name string) bool
+	// Delete removes the object, one that is not there is no error.
+	Delete(ns string, name string) error
+	// List calls fn for every object of the namespace. The objects fn
+	// deletes or writes don't throw List off.
+	List(ns string, fn func(ObjectInfo) error) error
+	Stat(ns string, name string) (ObjectInfo, error)
+	// Namespaces returns the namespaces that have objects.
+	Namespaces() ([]string, error)
+	// Close lets the writes that are still running fail and cleans up
+	// after them.
+	Close() error
+}
+
+// ObjectInfo describes an object of a backend.
+type ObjectInfo struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// appender is a backend that adds to the end of an object in place, with
+// the others the store rewrites the object.
+type appender interface {
+	Append(ns string, name string, r io.Reader) (int64, error)
+}
+
+// toucher is a backend that can move the time an object was written to now
+// without rewriting it.
+type toucher interface {
+	Touch(ns string, name string) error
+}
+
+// clearer is a backend that can throw everything away at once.
+type clearer interface {
+	Clear() error
+}
+
+func notExist(op string, ns string, name string) error {
+	return &fs.PathError{Op: op, Path: ns + "/" + name, Err: fs.ErrNotExist}
+}
+
+// readSeekCloser is the reader Get of the backends that keep objects in
+// memory, or in one file, return. Seek lets ReadAt skip ahead.
+type readSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (readSeekCloser) Close() error {
+	return nil
+}
+
+// errBackendClosed is returned by the backends once they are closed.
+var errBackendClosed = fmt.Errorf("backend is closed")
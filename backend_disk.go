@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DiskBackend keeps every object in a file of its own, under a folder per
+// namespace in the root. It is what a store uses unless told otherwise.
+type DiskBackend struct {
+	root   string
+	closed atomic.Bool
+}
+
+// NewDiskBackend keeps the objects in the root folder. What writes that were
+// cut off by a crash left behind is removed.
+func NewDiskBackend(root string) *DiskBackend {
+	b := &DiskBackend{root: root}
+	if err := b.removeTempFiles(); err != nil {
+		log.Printf("failed to remove the temporary files in %s: %v", root, err)
+	}
+	return b
+}
+
+func (b *DiskBackend) path(ns string, name string) string {
+	return b.root + "/" + ns + "/" + name
+}
+
+// Put writes the object through a temporary file that only replaces the
+// object once the write succeeded, so a transfer that dies halfway never
+// leaves a truncated file behind.
+func (b *DiskBackend) Put(ns string, name string, r io.Reader) (int64, error) {
+	if b.closed.Load() {
+		return 0, errBackendClosed
+	}
+
+	path := b.path(ns, name)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return 0, err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return n, err
+	}
+	if b.closed.Load() {
+		return n, errBackendClosed
+	}
+
+	return n, os.Rename(f.Name(), path)
+}
+
+// Append adds what r yields to the end of the object in place, what arrived
+// before r failed stays.
+func (b *DiskBackend) Append(ns string, name string, r io.Reader) (int64, error) {
+	if b.closed.Load() {
+		return 0, errBackendClosed
+	}
+
+	path := b.path(ns, name)
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return 0, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	return io.Copy(f, r)
+}
+
+func (b *DiskBackend) Get(ns string, name string) (int64, io.ReadCloser, error) {
+	f, err := os.Open(b.path(ns, name))
+	if err != nil {
+		return 0, nil, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return 0, nil, err
+	}
+	return fi.Size(), f, nil
+}
+
+func (b *DiskBackend) Has(ns string, name string) bool {
+	_, err := os.Stat(b.path(ns, name))
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// Delete removes the file of the object. Other objects can share the first
+// folders of its path, the folders that are left empty are cleaned up on the
+// way back up.
+func (b *DiskBackend) Delete(ns string, name string) error {
+	nsRoot := b.root + "/" + ns
+	path := b.path(ns, name)
+
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	for dir := filepath.Dir(path); strings.HasPrefix(dir, nsRoot+"/"); dir = filepath.Dir(dir) {
+		if err := os.Remove(dir); err != nil {
+			break
+		}
+	}
+	return nil
+}
+
+func (b *DiskBackend) Stat(ns string, name string) (ObjectInfo, error) {
+	fi, err := os.Stat(b.path(ns, name))
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	return ObjectInfo{Name: name, Size: fi.Size(), ModTime: fi.ModTime()}, nil
+}
+
+// Touch sets the time the object was written to now.
+func (b *DiskBackend) Touch(ns string, name string) error {
+	now := time.Now()
+	return os.Chtimes(b.path(ns, name), now, now)
+}
+
+// List walks the folder of the namespace, the writes that are still running
+// are left out.
+func (b *DiskBackend) List(ns string, fn func(ObjectInfo) error) error {
+	nsRoot := b.root + "/" + ns
+	return b.walk(nsRoot, func(path string, d fs.DirEntry) error {
+		if tempFile.MatchString(d.Name()) {
+			return nil
+		}
+		fi, err := d.Info()
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(nsRoot, path)
+		if err != nil {
+			return err
+		}
+		return fn(ObjectInfo{Name: filepath.ToSlash(name), Size: fi.Size(), ModTime: fi.ModTime()})
+	})
+}
+
+// walk calls fn with every file under the folder.
+func (b *DiskBackend) walk(root string, fn func(path string, d fs.DirEntry) error) error {
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		return fn(path, d)
+	})
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (b *DiskBackend) Namespaces() ([]string, error) {
+	entries, err := os.ReadDir(b.root)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	namespaces := []string{}
+	for _, e := range entries {
+		if e.IsDir() {
+			namespaces = append(namespaces, e.Name())
+		}
+	}
+	return namespaces, nil
+}
+
+// Close stops the writes and removes the temporary files of the ones that
+// were cut off.
+func (b *DiskBackend) Close() error {
+	b.closed.Store(true)
+
+	return b.removeTempFiles()
+}
+
+// Clear removes the root folder with everything in it.
+func (b *DiskBackend) Clear() error {
+	return os.RemoveAll(b.root)
+}
+
+// tempFile matches the names os.CreateTemp gives the files of Put.
+var tempFile = regexp.MustCompile(`\.tmp\d+$`)
+
+// removeTempFiles deletes what Put left behind.
+func (b *DiskBackend) removeTempFiles() error {
+	return b.walk(b.root, func(path string, d fs.DirEntry) error {
+		if tempFile.MatchString(d.Name()) {
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
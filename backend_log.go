@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	logPut    = 1
+	logDelete = 2
+
+	// logHeaderSize is the size of the header of a record: checksum, op,
+	// length of the namespace and the name, size of the object and when it
+	// was written.
+	logHeaderSize = 4 + 1 + 2 + 2 + 8 + 8
+)
+
+// LogBackend keeps all objects in one file that is only ever appended to,
+// every Put and Delete adds a record. The index of where the objects are is
+// rebuilt from the records when the file is opened. It suits many small
+// objects, like manifests, that would each take a block of their own on
+// disk. Space of overwritten and deleted objects is not reclaimed.
+type LogBackend struct {
+	mu     sync.RWMutex
+	f      *os.File
+	size   int64
+	index  map[string]map[string]logSlot
+	closed bool
+	// readers is how many readers Get handed out are not closed yet.
+	readers int
+}
+
+// logSlot is where the bytes of an object are in the file.
+type logSlot struct {
+	offset  int64
+	size    int64
+	modTime time.Time
+}
+
+// OpenLogBackend opens the log at path, or creates it. A record a crash cut
+// off at the end is dropped, a log that is corrupt before its end is not
+// opened.
+func OpenLogBackend(path string) (*LogBackend, error) {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &LogBackend{f: f, index: make(map[string]map[string]logSlot)}
+	if err := b.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+// load replays the records into the index.
+func (b *LogBackend) load() error {
+	size, err := replayLog(b.f, func(rec logRecord, offset int64) {
+		switch rec.op {
+		case logPut:
+			b.put(rec.ns, rec.name, logSlot{offset: offset + rec.dataOffset(), size: rec.size, modTime: rec.modTime})
+		case logDelete:
+			b.remove(rec.ns, rec.name)
+		}
+	})
+	b.size = size
+	return err
+}
+
+func (b *LogBackend) put(ns string, name string, e logSlot) {
+	if b.index[ns] == nil {
+		b.index[ns] = make(map[string]logSlot)
+	}
+	b.index[ns][name] = e
+}
+
+func (b *LogBackend) remove(ns string, name string) {
+	delete(b.index[ns], name)
+	if len(b.index[ns]) == 0 {
+		delete(b.index, ns)
+	}
+}
+
+// appendRecord adds the record to the end of the file and returns where its
+// data starts.
+func (b *LogBackend) appendRecord(op byte, ns string, name string, data []byte, modTime time.Time) (int64, error) {
+	if b.closed {
+		return 0, errBackendClosed
+	}
+	rec, err := encodeLogRecord(op, ns, name, data, modTime)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := b.f.WriteAt(rec, b.size); err != nil {
+		// a torn record is cut off when the log is opened next
+		return 0, err
+	}
+	offset := b.size + int64(len(rec)-len(data))
+	b.size += int64(len(rec))
+	return offset, nil
+}
+
+// Put reads r to its end before the record is written.
+func (b *LogBackend) Put(ns string, name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	offset, err := b.appendRecord(logPut, ns, name, data, now)
+	if err != nil {
+		return 0, err
+	}
+	b.put(ns, name, logSlot{offset: offset, size: int64(len(data)), modTime: now})
+	return int64(len(data)), nil
+}
+
+// logReader reads an object out of the log, the backend counts it until it
+// is closed.
+type logReader struct {
+	*io.SectionReader
+	b    *LogBackend
+	once sync.Once
+}
+
+func (r *logReader) Close() error {
+	r.once.Do(func() {
+		r.b.mu.Lock()
+		defer r.b.mu.Unlock()
+
+		r.b.readers--
+	})
+	return nil
+}
+
+func (b *LogBackend) Get(ns string, name string) (int64, io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, nil, errBackendClosed
+	}
+	e, ok := b.index[ns][name]
+	if !ok {
+		return 0, nil, notExist("open", ns, name)
+	}
+	b.readers++
+	return e.size, &logReader{SectionReader: io.NewSectionReader(b.f, e.offset, e.size), b: b}, nil
+}
+
+func (b *LogBackend) Has(ns string, name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	_, ok := b.index[ns][name]
+	return ok
+}
+
+func (b *LogBackend) Delete(ns string, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.index[ns][name]; !ok {
+		return nil
+	}
+	if _, err := b.appendRecord(logDelete, ns, name, nil, time.Now()); err != nil {
+		return err
+	}
+	b.remove(ns, name)
+	return nil
+}
+
+func (b *LogBackend) Stat(ns string, name string) (ObjectInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	e, ok := b.index[ns][name]
+	if !ok {
+		return ObjectInfo{}, notExist("stat", ns, name)
+	}
+	return ObjectInfo{Name: name, Size: e.size, ModTime: e.modTime}, nil
+}
+
+// Touch only moves the time in the index, after the log is opened again
+// the object has the time it was written at.
+func (b *LogBackend) Touch(ns string, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e, ok := b.index[ns][name]
+	if !ok {
+		return notExist("touch", ns, name)
+	}
+	e.modTime = time.Now()
+	b.index[ns][name] = e
+	return nil
+}
+
+// List calls fn in the order of the names, with the objects as they were
+// when List was called.
+func (b *LogBackend) List(ns string, fn func(ObjectInfo) error) error {
+	b.mu.RLock()
+	infos := []ObjectInfo{}
+	for name, e := range b.index[ns] {
+		infos = append(infos, ObjectInfo{Name: name, Size: e.size, ModTime: e.modTime})
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *LogBackend) Namespaces() ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	namespaces := []string{}
+	for ns := range b.index {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+func (b *LogBackend) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return nil
+	}
+	b.closed = true
+	return b.f.Close()
+}
+
+// Clear empties the log. It fails while readers are open, they would read
+// what comes after the truncation.
+func (b *LogBackend) Clear() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.readers > 0 {
+		return fmt.Errorf("can't clear %s, (%d) readers are still open", b.f.Name(), b.readers)
+	}
+	if err := b.f.Truncate(0); err != nil {
+		return err
+	}
+	b.size = 0
+	b.index = make(map[string]map[string]logSlot)
+	return nil
+}
+
+// logRecord is the header of a record of a log file, the data follows it.
+type logRecord struct {
+	op      byte
+	ns      string
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// dataOffset is where the data starts in the record.
+func (rec logRecord) dataOffset() int64 {
+	return logHeaderSize + int64(len(rec.ns)+len(rec.name))
+}
+
+// length is the size of the whole record.
+func (rec logRecord) length() int64 {
+	return rec.dataOffset() + rec.size
+}
+
+func encodeLogRecord(op byte, ns string, name string, data []byte, modTime time.Time) ([]byte, error) {
+	if len(ns) > 1<<16-1 || len(name) > 1<<16-1 {
+		return nil, fmt.Errorf("name %s/%s is too long for the log", ns, name)
+	}
+
+	rec := make([]byte, logHeaderSize, logHeaderSize+len(ns)+len(name)+len(data))
+	rec[4] = op
+	binary.BigEndian.PutUint16(rec[5:], uint16(len(ns)))
+	binary.BigEndian.PutUint16(rec[7:], uint16(len(name)))
+	binary.BigEndian.PutUint64(rec[9:], uint64(len(data)))
+	binary.BigEndian.PutUint64(rec[17:], uint64(modTime.UnixNano()))
+	rec = append(rec, ns...)
+	rec = append(rec, name...)
+	rec = append(rec, data...)
+	binary.BigEndian.PutUint32(rec[0:], crc32.ChecksumIEEE(rec[4:]))
+	return rec, nil
+}
+
+// readLogRecord reads the next record, its data is checked and skipped.
+func readLogRecord(r io.Reader) (logRecord, error) {
+	header := make([]byte, logHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF {
+			return logRecord{}, io.EOF
+		}
+		return logRecord{}, fmt.Errorf("short header: %w", err)
+	}
+
+	var (
+		sum     = binary.BigEndian.Uint32(header[0:])
+		nsLen   = int(binary.BigEndian.Uint16(header[5:]))
+		nameLen = int(binary.BigEndian.Uint16(header[7:]))
+		rec     = logRecord{
+			op:      header[4],
+			size:    int64(binary.BigEndian.Uint64(header[9:])),
+			modTime: time.Unix(0, int64(binary.BigEndian.Uint64(header[17:]))),
+		}
+	)
+	if rec.size < 0 {
+		return logRecord{}, fmt.Errorf("bad size %d", rec.size)
+	}
+	if rec.op != logPut && rec.op != logDelete {
+		return logRecord{}, fmt.Errorf("unknown op %d", rec.op)
+	}
+
+	h := crc32.NewIEEE()
+	h.Write(header[4:])
+	names := make([]byte, nsLen+nameLen)
+	if _, err := io.ReadFull(r, names); err != nil {
+		return logRecord{}, fmt.Errorf("short names: %w", err)
+	}
+	h.Write(names)
+	if _, err := io.CopyN(h, r, rec.size); err != nil {
+		return logRecord{}, fmt.Errorf("short data: %w", err)
+	}
+	rec.ns, rec.name = string(names[:nsLen]), string(names[nsLen:])
+	if h.Sum32() != sum {
+		// the record tells how long it is, the caller may check where it ends
+		return rec, errLogChecksum
+	}
+	return rec, nil
+}
+
+var errLogChecksum = errors.New("checksum mismatch")
+
+// replayLog calls fn with every record of the file and where it starts, and
+// returns where the records end. A bad last record was torn by a crash, the
+// file is cut before it. A bad record anywhere else is an error, cutting
+// there would lose every record after it.
+func replayLog(f *os.File, fn func(rec logRecord, offset int64)) (int64, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, 0, fi.Size()))
+	var offset int64
+	for {
+		rec, err := readLogRecord(r)
+		if err == io.EOF {
+			return offset, nil
+		}
+		if err != nil {
+			torn, terr := tornTail(f, offset, fi.Size(), rec, err)
+			if terr != nil {
+				return offset, terr
+			}
+			if !torn {
+				return offset, fmt.Errorf("record of %s at %d is corrupt: %w", f.Name(), offset, err)
+			}
+			log.Printf("dropping the end of %s from %d on: %v", f.Name(), offset, err)
+			return offset, f.Truncate(offset)
+		}
+		fn(rec, offset)
+		offset += rec.length()
+	}
+}
+
+// tornTail tells if the bad record at offset is the torn end of the file:
+// it runs past the end, ends right at it, or only zeros follow, which is
+// what a file that grew before its bytes were written has.
+func tornTail(f *os.File, offset int64, size int64, rec logRecord, err error) (bool, error) {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true, nil
+	}
+	if errors.Is(err, errLogChecksum) && offset+rec.length() == size {
+		return true, nil
+	}
+
+	r := bufio.NewReader(io.NewSectionReader(f, offset, size-offset))
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if c != 0 {
+			return false, nil
+		}
+	}
+}
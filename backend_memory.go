@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryBackend keeps the objects in memory, they are gone with the process.
+// It is meant for tests and for nodes that only cache.
+type MemoryBackend struct {
+	mu      sync.Mutex
+	objects map[string]map[string]memoryObject
+}
+
+type memoryObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{objects: make(map[string]map[string]memoryObject)}
+}
+
+// Put reads r to its end before the object shows up under the name.
+func (b *MemoryBackend) Put(ns string, name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.objects[ns] == nil {
+		b.objects[ns] = make(map[string]memoryObject)
+	}
+	b.objects[ns][name] = memoryObject{data: data, modTime: time.Now()}
+	return int64(len(data)), nil
+}
+
+// Append adds what r yields to the object, what arrived before r failed
+// stays. The bytes readers of the object got before don't change.
+func (b *MemoryBackend) Append(ns string, name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.objects[ns] == nil {
+		b.objects[ns] = make(map[string]memoryObject)
+	}
+	old := b.objects[ns][name].data
+	b.objects[ns][name] = memoryObject{
+		data:    append(old[:len(old):len(old)], data...),
+		modTime: time.Now(),
+	}
+	return int64(len(data)), err
+}
+
+func (b *MemoryBackend) Get(ns string, name string) (int64, io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.objects[ns][name]
+	if !ok {
+		return 0, nil, notExist("open", ns, name)
+	}
+	return int64(len(o.data)), readSeekCloser{bytes.NewReader(o.data)}, nil
+}
+
+func (b *MemoryBackend) Has(ns string, name string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, ok := b.objects[ns][name]
+	return ok
+}
+
+func (b *MemoryBackend) Delete(ns string, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.objects[ns], name)
+	if len(b.objects[ns]) == 0 {
+		delete(b.objects, ns)
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Stat(ns string, name string) (ObjectInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.objects[ns][name]
+	if !ok {
+		return ObjectInfo{}, notExist("stat", ns, name)
+	}
+	return ObjectInfo{Name: name, Size: int64(len(o.data)), ModTime: o.modTime}, nil
+}
+
+func (b *MemoryBackend) Touch(ns string, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	o, ok := b.objects[ns][name]
+	if !ok {
+		return notExist("touch", ns, name)
+	}
+	o.modTime = time.Now()
+	b.objects[ns][name] = o
+	return nil
+}
+
+// List calls fn in the order of the names, with the objects as they were
+// when List was called.
+func (b *MemoryBackend) List(ns string, fn func(ObjectInfo) error) error {
+	b.mu.Lock()
+	infos := []ObjectInfo{}
+	for name, o := range b.objects[ns] {
+		infos = append(infos, ObjectInfo{Name: name, Size: int64(len(o.data)), ModTime: o.modTime})
+	}
+	b.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBackend) Namespaces() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	namespaces := []string{}
+	for ns := range b.objects {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// Close keeps the objects, a store opened on the backend again finds them.
+func (b *MemoryBackend) Close() error {
+	return nil
+}
+
+func (b *MemoryBackend) Clear() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.objects = make(map[string]map[string]memoryObject)
+	return nil
+}
@@ -0,0 +1,442 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultS3Region = "us-east-1"
+
+	// emptyPayloadHash is the SHA-256 of no bytes, what the requests
+	// without a body sign.
+	emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+	// defaultS3Timeout is how long a request, and reading its answer, may
+	// take before it is given up.
+	defaultS3Timeout = time.Minute
+)
+
+// S3Opts say which bucket of which S3 endpoint an S3Backend keeps its
+// objects in.
+type S3Opts struct {
+	// Endpoint is where the S3 API is, like https://s3.us-east-1.amazonaws.com
+	// or http://localhost:9000. The bucket is put in the path.
+	Endpoint string
+	// Region is what the requests are signed for, us-east-1 by default.
+	Region string
+	Bucket string
+	// Prefix goes in front of every key, so that many nodes can share a
+	// bucket.
+	Prefix    string
+	AccessKey string
+	SecretKey string
+	// Client sends the requests. By default the backend has a client of
+	// its own, which gives up on a request after a minute.
+	Client *http.Client
+}
+
+// S3Backend keeps the objects in a bucket of an S3 compatible object store,
+// under Prefix/namespace/name. It only uses PutObject, GetObject,
+// HeadObject, DeleteObject and ListObjectsV2, signed with Signature
+// Version 4.
+type S3Backend struct {
+	S3Opts
+
+	endpoint *url.URL
+	signer   s3Signer
+	closed   atomic.Bool
+	// ownClient is set if the client is ours to close.
+	ownClient bool
+}
+
+func NewS3Backend(opts S3Opts) (*S3Backend, error) {
+	if opts.Bucket == "" {
+		return nil, fmt.Errorf("s3 backend needs a bucket")
+	}
+	endpoint, err := url.Parse(opts.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("bad s3 endpoint %q: %w", opts.Endpoint, err)
+	}
+	if endpoint.Scheme == "" || endpoint.Host == "" {
+		return nil, fmt.Errorf("bad s3 endpoint %q", opts.Endpoint)
+	}
+	if opts.Region == "" {
+		opts.Region = defaultS3Region
+	}
+	ownClient := opts.Client == nil
+	if ownClient {
+		opts.Client = &http.Client{Timeout: defaultS3Timeout}
+	}
+
+	return &S3Backend{
+		S3Opts:    opts,
+		endpoint:  endpoint,
+		signer:    s3Signer{accessKey: opts.AccessKey, secretKey: opts.SecretKey, region: opts.Region},
+		ownClient: ownClient,
+	}, nil
+}
+
+func (b *S3Backend) key(ns string, name string) string {
+	return b.Prefix + ns + "/" + name
+}
+
+// S3Error is what the object store answered a request that failed with.
+type S3Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *S3Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("s3: %s", http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+// do signs and sends a request for the key, with the query and the body. An
+// answer that is not a success is turned into an S3Error, the caller closes
+// the body of the others.
+func (b *S3Backend) do(method string, key string, query url.Values, body []byte) (*http.Response, error) {
+	if b.closed.Load() {
+		return nil, errBackendClosed
+	}
+
+	u := *b.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + b.Bucket + "/" + key
+	u.RawPath = s3Escape(u.Path, false)
+	u.RawQuery = s3Query(query)
+
+	req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+
+	payloadHash := emptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	b.signer.sign(req, payloadHash, time.Now())
+
+	resp, err := b.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	// a HEAD has no body to say more with
+	var answer struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&answer)
+	return nil, &S3Error{StatusCode: resp.StatusCode, Code: answer.Code, Message: answer.Message}
+}
+
+// objectError turns the answer to a request for an object that is not there
+// into an error that is fs.ErrNotExist.
+func objectError(op string, ns string, name string, err error) error {
+	if e, ok := err.(*S3Error); ok && e.StatusCode == http.StatusNotFound {
+		return notExist(op, ns, name)
+	}
+	return err
+}
+
+// Put reads r to its end before the object is sent, the request is signed
+// with the hash of the whole object.
+func (b *S3Backend) Put(ns string, name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	resp, err := b.do(http.MethodPut, b.key(ns, name), nil, data)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	return int64(len(data)), nil
+}
+
+// Get asks for the size with a HEAD request if the object comes without a
+// Content-Length, the store needs to know it up front.
+func (b *S3Backend) Get(ns string, name string) (int64, io.ReadCloser, error) {
+	resp, err := b.do(http.MethodGet, b.key(ns, name), nil, nil)
+	if err != nil {
+		return 0, nil, objectError("open", ns, name, err)
+	}
+	size, err := s3Size(resp)
+	if err != nil {
+		info, serr := b.Stat(ns, name)
+		if serr != nil {
+			resp.Body.Close()
+			return 0, nil, serr
+		}
+		size = info.Size
+	}
+	return size, resp.Body, nil
+}
+
+// s3Size returns the size of the object the response is about, from its
+// Content-Length or the total of its Content-Range.
+func s3Size(resp *http.Response) (int64, error) {
+	if resp.ContentLength >= 0 {
+		return resp.ContentLength, nil
+	}
+	if _, total, ok := strings.Cut(resp.Header.Get("Content-Range"), "/"); ok {
+		if size, err := strconv.ParseInt(total, 10, 64); err == nil {
+			return size, nil
+		}
+	}
+	return 0, fmt.Errorf("s3: %s answered without the size of the object", resp.Request.URL.Path)
+}
+
+func (b *S3Backend) Has(ns string, name string) bool {
+	_, err := b.Stat(ns, name)
+	return err == nil
+}
+
+// Delete removes the object, S3 answers the same for one that is not there.
+func (b *S3Backend) Delete(ns string, name string) error {
+	resp, err := b.do(http.MethodDelete, b.key(ns, name), nil, nil)
+	if err != nil {
+		return objectError("remove", ns, name, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *S3Backend) Stat(ns string, name string) (ObjectInfo, error) {
+	resp, err := b.do(http.MethodHead, b.key(ns, name), nil, nil)
+	if err != nil {
+		return ObjectInfo{}, objectError("stat", ns, name, err)
+	}
+	resp.Body.Close()
+
+	size, err := s3Size(resp)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	modTime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return ObjectInfo{Name: name, Size: size, ModTime: modTime}, nil
+}
+
+// listResult is the answer to ListObjectsV2.
+type listResult struct {
+	Contents []struct {
+		Key          string    `xml:"Key"`
+		Size         int64     `xml:"Size"`
+		LastModified time.Time `xml:"LastModified"`
+	} `xml:"Contents"`
+	CommonPrefixes []struct {
+		Prefix string `xml:"Prefix"`
+	} `xml:"CommonPrefixes"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// list calls fn with every page of the keys under the prefix.
+func (b *S3Backend) list(prefix string, delimiter string, fn func(*listResult) error) error {
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if delimiter != "" {
+			query.Set("delimiter", delimiter)
+		}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		resp, err := b.do(http.MethodGet, "", query, nil)
+		if err != nil {
+			return err
+		}
+		page := &listResult{}
+		err = xml.NewDecoder(resp.Body).Decode(page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("bad list of %s: %w", prefix, err)
+		}
+
+		if err := fn(page); err != nil {
+			return err
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// List goes through the keys a page at a time, fn sees every page as it was
+// when it was fetched.
+func (b *S3Backend) List(ns string, fn func(ObjectInfo) error) error {
+	prefix := b.key(ns, "")
+	return b.list(prefix, "", func(page *listResult) error {
+		for _, o := range page.Contents {
+			info := ObjectInfo{Name: strings.TrimPrefix(o.Key, prefix), Size: o.Size, ModTime: o.LastModified}
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *S3Backend) Namespaces() ([]string, error) {
+	namespaces := []string{}
+	err := b.list(b.Prefix, "/", func(page *listResult) error {
+		for _, p := range page.CommonPrefixes {
+			ns := strings.TrimSuffix(strings.TrimPrefix(p.Prefix, b.Prefix), "/")
+			namespaces = append(namespaces, ns)
+		}
+		return nil
+	})
+	return namespaces, err
+}
+
+// Close lets the requests that are still to be sent fail, the objects stay
+// in the bucket. A client that was passed in is left alone, others may
+// share it.
+func (b *S3Backend) Close() error {
+	b.closed.Store(true)
+	if b.ownClient {
+		b.Client.CloseIdleConnections()
+	}
+	return nil
+}
+
+// s3Signer signs requests with AWS Signature Version 4.
+type s3Signer struct {
+	accessKey string
+	secretKey string
+	region    string
+}
+
+const (
+	s3Algorithm  = "AWS4-HMAC-SHA256"
+	s3DateFormat = "20060102T150405Z"
+)
+
+// sign sets the date, the hash of the payload and the signature of the
+// request. Every header the request has by then is signed, and the host.
+func (sg s3Signer) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format(s3DateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := []string{"host"}
+	for name := range req.Header {
+		signedHeaders = append(signedHeaders, strings.ToLower(name))
+	}
+	sort.Strings(signedHeaders)
+
+	scope := sg.scope(amzDate)
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s3Algorithm, sg.accessKey, scope, strings.Join(signedHeaders, ";"),
+		sg.signature(req, signedHeaders, amzDate, payloadHash)))
+}
+
+func (sg s3Signer) scope(amzDate string) string {
+	return amzDate[:8] + "/" + sg.region + "/s3/aws4_request"
+}
+
+// signature signs the canonical form of the request, with the headers that
+// are named.
+func (sg s3Signer) signature(req *http.Request, signedHeaders []string, amzDate string, payloadHash string) string {
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := ""
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = host
+		}
+		headers += name + ":" + strings.Join(strings.Fields(value), " ") + "\n"
+	}
+
+	canonical := strings.Join([]string{
+		req.Method,
+		s3Escape(req.URL.Path, false),
+		s3Query(req.URL.Query()),
+		headers,
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonical))
+
+	toSign := strings.Join([]string{
+		s3Algorithm,
+		amzDate,
+		sg.scope(amzDate),
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+sg.secretKey), amzDate[:8])
+	key = hmacSHA256(key, sg.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape percent-encodes everything but the unreserved characters, and
+// the slashes unless they are part of a query.
+func s3Escape(s string, query bool) string {
+	var sb strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/' && !query:
+			sb.WriteByte(c)
+		default:
+			sb.WriteString("%" + strings.ToUpper(strconv.FormatInt(int64(c)|0x100, 16)[1:]))
+		}
+	}
+	return sb.String()
+}
+
+// s3Query is the canonical query string, sorted by name and then value.
+func s3Query(query url.Values) string {
+	names := []string{}
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	params := []string{}
+	for _, name := range names {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		for _, value := range values {
+			params = append(params, s3Escape(name, true)+"="+s3Escape(value, true))
+		}
+	}
+	return strings.Join(params, "&")
+}
@@ -0,0 +1,674 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSegmentSize is how big a segment gets before the next one is
+	// started.
+	defaultSegmentSize = 64 << 20
+
+	// defaultMinLiveRatio is the share of a segment that has to be live, a
+	// segment with less is compacted.
+	defaultMinLiveRatio = 0.5
+
+	// defaultCompactionInterval is how often the segments are looked at.
+	defaultCompactionInterval = time.Minute
+)
+
+// SegmentOpts tune a SegmentBackend, the zero value is fine.
+type SegmentOpts struct {
+	// SegmentSize is how big a segment gets before the next one is
+	// started, 64 MB by default.
+	SegmentSize int64
+	// MinLiveRatio is the share of the bytes of a segment that have to be
+	// live, a segment with less is rewritten, 0.5 by default.
+	MinLiveRatio float64
+	// CompactionInterval is how often compaction runs, every minute by
+	// default. A negative one only compacts when Compact is called.
+	CompactionInterval time.Duration
+}
+
+// SegmentBackend is a log-structured backend. Objects are appended to the
+// active segment file, a delete appends a tombstone, and once the segment is
+// big enough the next one is started. The index of where the objects are is
+// kept in memory and rebuilt from the segments when they are opened. A
+// background compaction rewrites the segments that are mostly overwritten or
+// deleted with only their live objects.
+//
+// It packs many small objects, like the manifests and small chunks, into a
+// few big files instead of a file and five folders each.
+type SegmentBackend struct {
+	SegmentOpts
+
+	mu       sync.RWMutex
+	dir      string
+	segments map[int]*segment
+	active   int
+	index    map[string]map[string]segmentSlot
+	closed   bool
+
+	// compacted is how many segments compaction rewrote or dropped.
+	compacted int
+	// compactMu lets one compaction run at a time.
+	compactMu sync.Mutex
+
+	quitch chan struct{}
+	wg     sync.WaitGroup
+}
+
+// segment is a segment file. live is how many bytes of it are records the
+// index points to, names the objects it has a put of, live or not. A
+// compacted segment is dropped, its file is closed once the last reader is
+// done with it.
+type segment struct {
+	id      int
+	f       *os.File
+	size    int64
+	live    int64
+	names   map[segmentObject]bool
+	readers int
+	dropped bool
+}
+
+// segmentObject is an object in a segment.
+type segmentObject struct {
+	ns   string
+	name string
+}
+
+func (seg *segment) liveRatio() float64 {
+	if seg.size == 0 {
+		return 1
+	}
+	return float64(seg.live) / float64(seg.size)
+}
+
+// segmentSlot is where the record of an object is.
+type segmentSlot struct {
+	segment int
+	offset  int64
+	rec     logRecord
+}
+
+// SegmentStats describes the segments of a SegmentBackend.
+type SegmentStats struct {
+	Segments  int
+	Bytes     int64
+	LiveBytes int64
+	// Compacted is how many segments compaction rewrote or dropped since
+	// the backend was opened.
+	Compacted int
+}
+
+func segmentName(id int) string {
+	return fmt.Sprintf("segment-%08d.log", id)
+}
+
+// OpenSegmentBackend opens the segments in dir, or starts the first one, and
+// starts compacting them in the background.
+func OpenSegmentBackend(dir string, opts SegmentOpts) (*SegmentBackend, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.MinLiveRatio <= 0 {
+		opts.MinLiveRatio = defaultMinLiveRatio
+	}
+	if opts.CompactionInterval == 0 {
+		opts.CompactionInterval = defaultCompactionInterval
+	}
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	b := &SegmentBackend{
+		SegmentOpts: opts,
+		dir:         dir,
+		segments:    make(map[int]*segment),
+		index:       make(map[string]map[string]segmentSlot),
+		quitch:      make(chan struct{}),
+	}
+	if err := b.load(); err != nil {
+		b.closeFiles()
+		return nil, err
+	}
+
+	if opts.CompactionInterval > 0 {
+		b.wg.Add(1)
+		go b.compactLoop()
+	}
+	return b, nil
+}
+
+// load replays the segments in the order they were written.
+func (b *SegmentBackend) load() error {
+	// a compaction that did not finish leaves its copy behind
+	leftovers, err := filepath.Glob(filepath.Join(b.dir, "compact-*.tmp"))
+	if err != nil {
+		return err
+	}
+	for _, path := range leftovers {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+
+	paths, err := filepath.Glob(filepath.Join(b.dir, "segment-*.log"))
+	if err != nil {
+		return err
+	}
+	ids := []int{}
+	for _, path := range paths {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(path), "segment-%08d.log", &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		f, err := os.OpenFile(filepath.Join(b.dir, segmentName(id)), os.O_RDWR, 0644)
+		if err != nil {
+			return err
+		}
+		seg := &segment{id: id, f: f, names: make(map[segmentObject]bool)}
+		b.segments[id] = seg
+
+		seg.size, err = replayLog(f, func(rec logRecord, offset int64) {
+			b.apply(segmentSlot{segment: id, offset: offset, rec: rec})
+		})
+		if err != nil {
+			return err
+		}
+		b.active = id
+	}
+
+	if len(ids) == 0 {
+		return b.startSegment()
+	}
+	return nil
+}
+
+// apply puts the record into the index and moves the live bytes.
+func (b *SegmentBackend) apply(slot segmentSlot) {
+	rec := slot.rec
+	if rec.op == logPut {
+		b.segments[slot.segment].names[segmentObject{rec.ns, rec.name}] = true
+	}
+	if old, ok := b.index[rec.ns][rec.name]; ok {
+		b.segments[old.segment].live -= old.rec.length()
+	}
+
+	if rec.op == logDelete {
+		delete(b.index[rec.ns], rec.name)
+		if len(b.index[rec.ns]) == 0 {
+			delete(b.index, rec.ns)
+		}
+		return
+	}
+	if b.index[rec.ns] == nil {
+		b.index[rec.ns] = make(map[string]segmentSlot)
+	}
+	b.index[rec.ns][rec.name] = slot
+	b.segments[slot.segment].live += rec.length()
+}
+
+// startSegment starts the next segment and makes it the active one.
+func (b *SegmentBackend) startSegment() error {
+	id := b.active + 1
+	f, err := os.OpenFile(filepath.Join(b.dir, segmentName(id)), os.O_CREATE|os.O_RDWR|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	b.segments[id] = &segment{id: id, f: f, names: make(map[segmentObject]bool)}
+	b.active = id
+	return nil
+}
+
+// appendRecord writes the record to the active segment and puts it into the
+// index. The next segment is started once the active one is full.
+func (b *SegmentBackend) appendRecord(op byte, ns string, name string, data []byte, modTime time.Time) error {
+	if b.closed {
+		return errBackendClosed
+	}
+	rec, err := encodeLogRecord(op, ns, name, data, modTime)
+	if err != nil {
+		return err
+	}
+
+	seg := b.segments[b.active]
+	if seg.size > 0 && seg.size+int64(len(rec)) > b.SegmentSize {
+		if err := b.startSegment(); err != nil {
+			return err
+		}
+		seg = b.segments[b.active]
+	}
+	if _, err := seg.f.WriteAt(rec, seg.size); err != nil {
+		// a torn record is cut off when the segment is opened next
+		return err
+	}
+
+	slot := segmentSlot{
+		segment: seg.id,
+		offset:  seg.size,
+		rec:     logRecord{op: op, ns: ns, name: name, size: int64(len(data)), modTime: modTime},
+	}
+	seg.size += int64(len(rec))
+	b.apply(slot)
+	return nil
+}
+
+// Put reads r to its end before the record is written.
+func (b *SegmentBackend) Put(ns string, name string, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(data)), err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.appendRecord(logPut, ns, name, data, time.Now()); err != nil {
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// segmentReader reads an object out of its segment, the segment file stays
+// open until it is closed.
+type segmentReader struct {
+	*io.SectionReader
+	b    *SegmentBackend
+	seg  *segment
+	once sync.Once
+}
+
+func (r *segmentReader) Close() error {
+	r.once.Do(func() {
+		r.b.mu.Lock()
+		defer r.b.mu.Unlock()
+
+		r.b.release(r.seg)
+	})
+	return nil
+}
+
+// release lets go of a reader of the segment, a dropped segment is closed
+// with its last reader. The caller holds b.mu.
+func (b *SegmentBackend) release(seg *segment) {
+	seg.readers--
+	if seg.dropped && seg.readers == 0 {
+		seg.f.Close()
+	}
+}
+
+func (b *SegmentBackend) Get(ns string, name string) (int64, io.ReadCloser, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return 0, nil, errBackendClosed
+	}
+	slot, ok := b.index[ns][name]
+	if !ok {
+		return 0, nil, notExist("open", ns, name)
+	}
+
+	seg := b.segments[slot.segment]
+	seg.readers++
+	r := &segmentReader{
+		SectionReader: io.NewSectionReader(seg.f, slot.offset+slot.rec.dataOffset(), slot.rec.size),
+		b:             b,
+		seg:           seg,
+	}
+	return slot.rec.size, r, nil
+}
+
+func (b *SegmentBackend) Has(ns string, name string) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	_, ok := b.index[ns][name]
+	return ok
+}
+
+// Delete appends a tombstone, the object's bytes go with the compaction of
+// its segment.
+func (b *SegmentBackend) Delete(ns string, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.index[ns][name]; !ok {
+		return nil
+	}
+	return b.appendRecord(logDelete, ns, name, nil, time.Now())
+}
+
+func (b *SegmentBackend) Stat(ns string, name string) (ObjectInfo, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	slot, ok := b.index[ns][name]
+	if !ok {
+		return ObjectInfo{}, notExist("stat", ns, name)
+	}
+	return ObjectInfo{Name: name, Size: slot.rec.size, ModTime: slot.rec.modTime}, nil
+}
+
+// Touch only moves the time in the index, after the segments are opened
+// again the object has the time it was written at.
+func (b *SegmentBackend) Touch(ns string, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	slot, ok := b.index[ns][name]
+	if !ok {
+		return notExist("touch", ns, name)
+	}
+	slot.rec.modTime = time.Now()
+	b.index[ns][name] = slot
+	return nil
+}
+
+// List calls fn in the order of the names, with the objects as they were
+// when List was called.
+func (b *SegmentBackend) List(ns string, fn func(ObjectInfo) error) error {
+	b.mu.RLock()
+	infos := []ObjectInfo{}
+	for name, slot := range b.index[ns] {
+		infos = append(infos, ObjectInfo{Name: name, Size: slot.rec.size, ModTime: slot.rec.modTime})
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *SegmentBackend) Namespaces() ([]string, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	namespaces := []string{}
+	for ns := range b.index {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// Stats returns how big the segments are and how much of them is live.
+func (b *SegmentBackend) Stats() SegmentStats {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	stats := SegmentStats{Segments: len(b.segments), Compacted: b.compacted}
+	for _, seg := range b.segments {
+		stats.Bytes += seg.size
+		stats.LiveBytes += seg.live
+	}
+	return stats
+}
+
+func (b *SegmentBackend) compactLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.CompactionInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := b.Compact(); err != nil {
+				log.Printf("failed to compact the segments in %s: %v", b.dir, err)
+			}
+		case <-b.quitch:
+			return
+		}
+	}
+}
+
+// Compact rewrites the segments whose live ratio is under the minimum and
+// returns how many it compacted. The active segment is left alone. Only one
+// compaction runs at a time, reads and writes go on while it copies.
+func (b *SegmentBackend) Compact() (int, error) {
+	b.compactMu.Lock()
+	defer b.compactMu.Unlock()
+
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return 0, errBackendClosed
+	}
+	ids := []int{}
+	for id, seg := range b.segments {
+		if id != b.active && seg.liveRatio() < b.MinLiveRatio {
+			ids = append(ids, id)
+		}
+	}
+	b.mu.RUnlock()
+	sort.Ints(ids)
+
+	compacted := 0
+	for _, id := range ids {
+		ok, err := b.compactSegment(id)
+		if err != nil {
+			return compacted, err
+		}
+		if ok {
+			compacted++
+		}
+	}
+	return compacted, nil
+}
+
+// compactSegment rewrites the segment with only its live objects, and the
+// tombstones of objects an older segment still has a record of. The copy is
+// made without holding b.mu and takes the place of the segment under the
+// same id, so the segments replay in the same order. An object written again
+// while we copied keeps its newer record, the copy is dead from the start. A
+// segment with nothing left is dropped. A crash before the rename leaves the
+// old segment behind, and a temporary file that is removed on the next open.
+func (b *SegmentBackend) compactSegment(id int) (bool, error) {
+	b.mu.Lock()
+	seg, ok := b.segments[id]
+	if !ok || b.closed {
+		b.mu.Unlock()
+		return false, nil
+	}
+	// our own reader keeps the file open if the segment goes meanwhile
+	seg.readers++
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		b.release(seg)
+		b.mu.Unlock()
+	}()
+
+	records := []segmentSlot{}
+	_, err := replayLog(seg.f, func(rec logRecord, offset int64) {
+		records = append(records, segmentSlot{segment: id, offset: offset, rec: rec})
+	})
+	if err != nil {
+		return false, err
+	}
+
+	b.mu.RLock()
+	keep := []segmentSlot{}
+	for _, slot := range records {
+		rec := slot.rec
+		cur, ok := b.index[rec.ns][rec.name]
+		switch {
+		case rec.op == logPut && ok && cur.segment == id && cur.offset == slot.offset:
+			keep = append(keep, slot)
+		case rec.op == logDelete && !ok && b.olderHas(id, rec.ns, rec.name):
+			keep = append(keep, slot)
+		}
+	}
+	b.mu.RUnlock()
+	if len(keep) == len(records) {
+		return false, nil
+	}
+
+	var (
+		path    = seg.f.Name()
+		tmp     = filepath.Join(b.dir, fmt.Sprintf("compact-%08d.tmp", id))
+		next    = &segment{id: id, names: make(map[segmentObject]bool)}
+		offsets = make([]int64, len(keep))
+	)
+	if len(keep) > 0 {
+		if next.f, err = b.copyRecords(seg, keep, tmp, next, offsets); err != nil {
+			return false, err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.segments[id] != seg || b.closed {
+		// cleared or closed while we copied
+		if next.f != nil {
+			next.f.Close()
+			os.Remove(tmp)
+		}
+		return false, nil
+	}
+
+	if next.f == nil {
+		if err := os.Remove(path); err != nil {
+			return false, err
+		}
+		delete(b.segments, id)
+	} else {
+		if err := os.Rename(tmp, path); err != nil {
+			next.f.Close()
+			os.Remove(tmp)
+			return false, err
+		}
+		// the same objects are live, only where they are changes
+		next.live = seg.live
+		b.segments[id] = next
+		for i, slot := range keep {
+			rec := slot.rec
+			cur, ok := b.index[rec.ns][rec.name]
+			if rec.op == logPut && ok && cur.segment == id && cur.offset == slot.offset {
+				cur.offset = offsets[i]
+				b.index[rec.ns][rec.name] = cur
+			}
+		}
+	}
+	seg.dropped = true
+	b.compacted++
+	return true, nil
+}
+
+// copyRecords writes the records of the segment to the file at path and
+// returns it, synced. next gets the size and names of what was written, the
+// offsets where every record went.
+func (b *SegmentBackend) copyRecords(seg *segment, records []segmentSlot, path string, next *segment, offsets []int64) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (*os.File, error) {
+		f.Close()
+		os.Remove(path)
+		return nil, err
+	}
+
+	for i, slot := range records {
+		rec := slot.rec
+		data := []byte(nil)
+		if rec.op == logPut {
+			data = make([]byte, rec.size)
+			if _, err := seg.f.ReadAt(data, slot.offset+rec.dataOffset()); err != nil {
+				return fail(err)
+			}
+			next.names[segmentObject{rec.ns, rec.name}] = true
+		}
+		encoded, err := encodeLogRecord(rec.op, rec.ns, rec.name, data, rec.modTime)
+		if err != nil {
+			return fail(err)
+		}
+		if _, err := f.WriteAt(encoded, next.size); err != nil {
+			return fail(err)
+		}
+		offsets[i] = next.size
+		next.size += int64(len(encoded))
+	}
+	if err := f.Sync(); err != nil {
+		return fail(err)
+	}
+	return f, nil
+}
+
+// olderHas tells if a segment older than id has a put of the object, a
+// tombstone of it has to stay as long as one has. The caller holds b.mu.
+func (b *SegmentBackend) olderHas(id int, ns string, name string) bool {
+	for other, seg := range b.segments {
+		if other < id && seg.names[segmentObject{ns, name}] {
+			return true
+		}
+	}
+	return false
+}
+
+// Close stops the compaction and closes the segments.
+func (b *SegmentBackend) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	close(b.quitch)
+	b.mu.Unlock()
+
+	b.wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closeFiles()
+}
+
+func (b *SegmentBackend) closeFiles() error {
+	var err error
+	for _, seg := range b.segments {
+		if cerr := seg.f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Clear drops all segments and starts over with an empty one.
+func (b *SegmentBackend) Clear() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for id, seg := range b.segments {
+		seg.dropped = true
+		if err := os.Remove(seg.f.Name()); err != nil {
+			return err
+		}
+		if seg.readers == 0 {
+			seg.f.Close()
+		}
+		delete(b.segments, id)
+	}
+	b.index = make(map[string]map[string]segmentSlot)
+	return b.startSegment()
+}
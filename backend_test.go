@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// failingReader yields some bytes and then fails, like a connection that
+// breaks off.
+type failingReader struct {
+	r io.Reader
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, errors.New("connection reset")
+	}
+	return n, err
+}
+
+// testBackends returns a func that opens an empty backend of every kind.
+func testBackends(t *testing.T) map[string]func() Backend {
+	return map[string]func() Backend{
+		"disk":   func() Backend { return NewDiskBackend(t.TempDir()) },
+		"memory": func() Backend { return NewMemoryBackend() },
+		"log": func() Backend {
+			b, err := OpenLogBackend(filepath.Join(t.TempDir(), "objects.log"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		},
+		"segment": func() Backend {
+			// tiny segments, so that the objects are spread over a few
+			b, err := OpenSegmentBackend(t.TempDir(), SegmentOpts{SegmentSize: 128, CompactionInterval: -1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		},
+		"tiered": func() Backend {
+			// everything goes cold as soon as Migrate runs
+			b, err := OpenTieredBackend(TieredOpts{
+				Hot:               NewMemoryBackend(),
+				Cold:              NewDiskBackend(t.TempDir()),
+				Policy:            TierPolicy{HotBytes: 1},
+				MigrationInterval: time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return b
+		},
+		"s3": func() Backend {
+			_, b := newS3Emulator(t)
+			return b
+		},
+	}
+}
+
+func TestBackends(t *testing.T) {
+	for kind, open := range testBackends(t) {
+		t.Run(kind, func(t *testing.T) {
+			b := open()
+			defer b.Close()
+
+			if _, err := b.Put("ns", "a/b/c", bytes.NewReader([]byte("hello"))); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.Put("ns", "d", bytes.NewReader([]byte("world!"))); err != nil {
+				t.Fatal(err)
+			}
+			size, r, err := b.Get("ns", "a/b/c")
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(r)
+			r.Close()
+			if size != 5 || string(data) != "hello" {
+				t.Fatalf("read back %d bytes %q", size, data)
+			}
+			if info, err := b.Stat("ns", "d"); err != nil || info.Size != 6 {
+				t.Fatalf("stat of d is %+v, %v", info, err)
+			}
+
+			// a write that breaks off leaves the old object alone
+			if _, err := b.Put("ns", "d", &failingReader{bytes.NewReader([]byte("half"))}); err == nil {
+				t.Fatal("broken write succeeded")
+			}
+			if _, r, err := b.Get("ns", "d"); err != nil {
+				t.Fatal(err)
+			} else if data, _ := io.ReadAll(r); string(data) != "world!" {
+				t.Fatalf("broken write left %q behind", data)
+			}
+
+			names := []string{}
+			err = b.List("ns", func(info ObjectInfo) error {
+				names = append(names, info.Name)
+				return nil
+			})
+			if err != nil || len(names) != 2 {
+				t.Fatalf("listed %v, %v", names, err)
+			}
+			if namespaces, _ := b.Namespaces(); len(namespaces) != 1 || namespaces[0] != "ns" {
+				t.Fatalf("namespaces are %v", namespaces)
+			}
+
+			if err := b.Delete("ns", "a/b/c"); err != nil {
+				t.Fatal(err)
+			}
+			if err := b.Delete("ns", "a/b/c"); err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := b.Get("ns", "a/b/c"); !errors.Is(err, fs.ErrNotExist) || b.Has("ns", "a/b/c") {
+				t.Fatalf("deleted object is still there: %v", err)
+			}
+		})
+	}
+}
+
+func TestStoreOnBackends(t *testing.T) {
+	for kind, open := range testBackends(t) {
+		t.Run(kind, func(t *testing.T) {
+			s := NewStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, Backend: open()})
+			defer s.Close()
+
+			chunk := bytes.Repeat([]byte("resumable "), 100)
+			hash := hashChunk(chunk)
+			size := int64(len(chunk))
+			if _, err := s.WriteChunkAt(hash, 0, size, bytes.NewReader(chunk[:300])); err != io.ErrUnexpectedEOF {
+				t.Fatalf("want io.ErrUnexpectedEOF for a short chunk, have %v", err)
+			}
+			if _, err := s.WriteChunkAt(hash, 300, size, bytes.NewReader(chunk[300:])); err != nil {
+				t.Fatal(err)
+			}
+			r, err := s.ReadChunkAt(hash, 990, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if data, _ := io.ReadAll(r); string(data) != "resumable " {
+				t.Fatalf("read %q from the end of the chunk", data)
+			}
+			r.Close()
+
+			id := generateID()
+			m := &Manifest{Key: hashKey("file"), Version: 1, Size: size, Chunks: []ChunkRef{{Hash: hash, Size: size}}}
+			if err := s.WriteManifest(id, m); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.rebuildRefs(); err != nil {
+				t.Fatal(err)
+			}
+			if s.refCount(hash) != 1 || len(s.tree.all()) != 1 {
+				t.Fatal("the manifest was not found again")
+			}
+
+			if err := s.DeleteManifest(id, m.Key); err != nil {
+				t.Fatal(err)
+			}
+			if n, _ := s.sweepChunks(0); n != 1 || s.HasChunk(hash) {
+				t.Fatal("unreferenced chunk was not collected")
+			}
+		})
+	}
+}
+
+func TestLogBackendDropsTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "objects.log")
+	b, err := OpenLogBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Put("ns", "kept", bytes.NewReader([]byte("kept")))
+	b.Put("ns", "gone", bytes.NewReader([]byte("gone")))
+	b.Put("ns", "torn", bytes.NewReader([]byte("torn")))
+	b.Delete("ns", "gone")
+	b.Close()
+
+	// the crash cut the last record in half
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, fi.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = OpenLogBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if !b.Has("ns", "kept") || !b.Has("ns", "gone") || !b.Has("ns", "torn") {
+		t.Fatal("lost a record that was whole")
+	}
+
+	// the log goes on after the last whole record
+	if err := b.Delete("ns", "torn"); err != nil {
+		t.Fatal(err)
+	}
+	b.Close()
+	if b, err = OpenLogBackend(path); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if !b.Has("ns", "gone") || b.Has("ns", "torn") {
+		t.Fatal("records after the torn one were not read back")
+	}
+}
+
+func TestLogBackendKeepsRecordsAfterCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "objects.log")
+	b, err := OpenLogBackend(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Put("ns", "first", bytes.NewReader([]byte("first")))
+	b.Put("ns", "second", bytes.NewReader([]byte("second")))
+
+	// Clear waits for the readers
+	_, r, err := b.Get("ns", "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Clear(); err == nil {
+		t.Fatal("cleared the log under an open reader")
+	}
+	r.Close()
+	b.Close()
+
+	// a byte in the data of the first record flips
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[logHeaderSize+len("ns")+len("first")] ^= 0xff
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if b, err := OpenLogBackend(path); err == nil {
+		b.Close()
+		t.Fatal("opened a log that is corrupt before its end")
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != int64(len(data)) {
+		t.Fatalf("the corrupt log was cut: %v", err)
+	}
+}
+
+func TestSegmentBackendCompacts(t *testing.T) {
+	dir := t.TempDir()
+	opts := SegmentOpts{SegmentSize: 256, CompactionInterval: -1}
+	b, err := OpenSegmentBackend(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("x"), 50)
+	for i := 0; i < 20; i++ {
+		if _, err := b.Put("ns", fmt.Sprintf("object-%02d", i), bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// most of the early segments is dead after this
+	for i := 0; i < 15; i++ {
+		if err := b.Delete("ns", fmt.Sprintf("object-%02d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	b.Put("ns", "object-19", bytes.NewReader([]byte("newer")))
+
+	// a reader keeps its segment readable while it is compacted away
+	_, r, err := b.Get("ns", "object-15")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	before := b.Stats()
+	n, err := b.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	after := b.Stats()
+	if n == 0 || after.Bytes >= before.Bytes || after.LiveBytes != before.LiveBytes {
+		t.Fatalf("compacted %d segments from %+v to %+v", n, before, after)
+	}
+	if data, err := io.ReadAll(r); err != nil || len(data) != 50 {
+		t.Fatalf("read %d bytes from a compacted segment: %v", len(data), err)
+	}
+	r.Close()
+	b.Close()
+
+	// the deletes and overwrites hold after the segments are opened again
+	if b, err = OpenSegmentBackend(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	for i := 0; i < 20; i++ {
+		if want := i >= 15; b.Has("ns", fmt.Sprintf("object-%02d", i)) != want {
+			t.Fatalf("object-%02d is there: %v, want %v", i, !want, want)
+		}
+	}
+	if _, r, err := b.Get("ns", "object-19"); err != nil {
+		t.Fatal(err)
+	} else if data, _ := io.ReadAll(r); string(data) != "newer" {
+		t.Fatalf("object-19 is %q after compaction", data)
+	}
+	if stats := b.Stats(); stats.LiveBytes != after.LiveBytes {
+		t.Fatalf("live bytes went from %d to %d on reopen", after.LiveBytes, stats.LiveBytes)
+	}
+}
+
+// TestSegmentCompactionKeepsNeededTombstones only keeps a tombstone while an
+// older segment has the object it deletes.
+func TestSegmentCompactionKeepsNeededTombstones(t *testing.T) {
+	dir := t.TempDir()
+	opts := SegmentOpts{SegmentSize: 1 << 20, CompactionInterval: -1}
+	b, err := OpenSegmentBackend(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roll := func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if err := b.startSegment(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	b.Put("ns", "pinned", bytes.NewReader(bytes.Repeat([]byte("x"), 500)))
+	b.Put("ns", "old", bytes.NewReader([]byte("old")))
+	roll()
+	b.Delete("ns", "old")
+	b.Put("ns", "short", bytes.NewReader([]byte("short")))
+	b.Delete("ns", "short")
+	roll()
+
+	if n, err := b.Compact(); err != nil || n != 1 {
+		t.Fatalf("compacted %d segments: %v", n, err)
+	}
+	names := []string{}
+	replayLog(b.segments[2].f, func(rec logRecord, offset int64) {
+		names = append(names, fmt.Sprintf("%d:%s", rec.op, rec.name))
+	})
+	if want := fmt.Sprintf("%d:old", logDelete); len(names) != 1 || names[0] != want {
+		t.Fatalf("compacted segment has %v, want only %s", names, want)
+	}
+	b.Close()
+
+	if b, err = OpenSegmentBackend(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if !b.Has("ns", "pinned") || b.Has("ns", "old") || b.Has("ns", "short") {
+		t.Fatal("compaction brought back a deleted object or lost a live one")
+	}
+}
+
+// TestSegmentCompactionRunsAlongsideWrites compacts while the objects are
+// overwritten, the last write of every object has to win.
+func TestSegmentCompactionRunsAlongsideWrites(t *testing.T) {
+	dir := t.TempDir()
+	opts := SegmentOpts{SegmentSize: 256, CompactionInterval: -1}
+	b, err := OpenSegmentBackend(dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const rounds = 200
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < rounds; i++ {
+			name := fmt.Sprintf("object-%d", i%10)
+			if _, err := b.Put("ns", name, strings.NewReader(strconv.Itoa(i))); err != nil {
+				t.Error(err)
+				return
+			}
+			if _, r, err := b.Get("ns", name); err == nil {
+				io.ReadAll(r)
+				r.Close()
+			}
+		}
+	}()
+	for compacting := true; compacting; {
+		select {
+		case <-done:
+			compacting = false
+		default:
+		}
+		if _, err := b.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func() {
+		for i := rounds - 10; i < rounds; i++ {
+			_, r, err := b.Get("ns", fmt.Sprintf("object-%d", i%10))
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := io.ReadAll(r)
+			r.Close()
+			if string(data) != strconv.Itoa(i) {
+				t.Fatalf("object-%d is %q, want %d", i%10, data, i)
+			}
+		}
+	}
+	check()
+	b.Close()
+
+	if b, err = OpenSegmentBackend(dir, opts); err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	check()
+}
+
+func TestTieredBackendMovesColdObjects(t *testing.T) {
+	hot, cold := NewMemoryBackend(), NewMemoryBackend()
+	opts := TieredOpts{
+		Hot:               hot,
+		Cold:              cold,
+		Policy:            TierPolicy{ColdAfter: time.Hour, HotBytes: 10, RecallReads: 2},
+		MigrationInterval: -1,
+	}
+	b, err := OpenTieredBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, Backend: b})
+	defer s.Close()
+
+	id := generateID()
+	for _, key := range []string{"first", "second", "third"} {
+		if _, err := s.Write(id, key, bytes.NewReader([]byte("12345"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ten bytes fit on the hot tier, the one used the longest ago goes
+	if n, err := b.Migrate(); err != nil || n != 1 {
+		t.Fatalf("moved %d objects, %v", n, err)
+	}
+	name := s.name("first")
+	if hot.Has(id, name) || !cold.Has(id, name) {
+		t.Fatal("the least recently used object was not moved to the cold tier")
+	}
+
+	// cold objects read like hot ones, the second read recalls it
+	for i := 0; i < 2; i++ {
+		_, r, err := s.Read(id, "first")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data, _ := io.ReadAll(r); string(data) != "12345" {
+			t.Fatalf("read %q from a cold object", data)
+		}
+		r.(io.Closer).Close()
+		if hot.Has(id, name) != (i == 1) {
+			t.Fatalf("object is hot after %d reads: %v", i+1, hot.Has(id, name))
+		}
+	}
+	if stats := b.Stats(); stats.Demoted != 1 || stats.Recalled != 1 || stats.HotBytes != 15 || stats.ColdObjects != 0 {
+		t.Fatalf("stats are %+v", stats)
+	}
+
+	// after a restart the objects are found on whichever tier they are
+	b.Migrate()
+	b, err = OpenTieredBackend(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+	if stats := b.Stats(); stats.HotObjects != 2 || stats.ColdObjects != 1 {
+		t.Fatalf("stats after reopening are %+v", stats)
+	}
+	if _, err := b.Stat(id, s.name("second")); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"hash/fnv"
+	"io"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultMigrationInterval is how often the tiers are looked at.
+	defaultMigrationInterval = time.Minute
+
+	// tierStripes is how many locks the objects are spread over, an object
+	// is only moved, written or opened by one at a time.
+	tierStripes = 256
+)
+
+// TierPolicy says when objects move between the tiers.
+type TierPolicy struct {
+	// ColdAfter is how long an object can go unread and unwritten before it
+	// moves to the cold tier, zero keeps objects hot whatever their age.
+	ColdAfter time.Duration
+	// HotBytes is how much the hot tier keeps, the objects that were used
+	// the longest ago move to the cold tier when there is more. Zero is no
+	// limit.
+	HotBytes int64
+	// RecallReads is how many times a cold object is read before it moves
+	// back to the hot tier, 1 by default. A negative one leaves cold
+	// objects cold, they are read from the cold tier.
+	RecallReads int
+}
+
+type TieredOpts struct {
+	// Hot is the fast tier, new objects are written to it.
+	Hot Backend
+	// Cold is where objects go once they are cold, like a bigger disk or an
+	// S3 bucket.
+	Cold   Backend
+	Policy TierPolicy
+	// MigrationInterval is how often the policy is applied, every minute by
+	// default. A negative one only migrates when Migrate is called.
+	MigrationInterval time.Duration
+}
+
+// TieredBackend keeps the objects that are used on a fast backend and moves
+// the others to a slow one. When the objects were last read or written is
+// tracked in memory, after a restart it starts out as the time they were
+// written. Reading a cold object recalls it to the hot tier.
+type TieredBackend struct {
+	TieredOpts
+
+	stripes [tierStripes]sync.Mutex
+
+	mu       sync.Mutex
+	objects  map[string]map[string]*tierEntry
+	hotBytes int64
+	stats    TierStats
+
+	quitch    chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// tierEntry is an object of a TieredBackend and the tier it is on.
+type tierEntry struct {
+	cold    bool
+	size    int64
+	modTime time.Time
+	// used is when the object was last read or written.
+	used time.Time
+	// reads is how many times it was read since it went cold.
+	reads int
+}
+
+// TierStats describes the tiers of a TieredBackend and what moved between
+// them since it was opened.
+type TierStats struct {
+	HotObjects  int
+	HotBytes    int64
+	ColdObjects int
+	ColdBytes   int64
+
+	Demoted       int
+	DemotedBytes  int64
+	Recalled      int
+	RecalledBytes int64
+}
+
+// OpenTieredBackend finds the objects of both tiers and starts to apply the
+// policy in the background.
+func OpenTieredBackend(opts TieredOpts) (*TieredBackend, error) {
+	if opts.Policy.RecallReads == 0 {
+		opts.Policy.RecallReads = 1
+	}
+	if opts.MigrationInterval == 0 {
+		opts.MigrationInterval = defaultMigrationInterval
+	}
+
+	b := &TieredBackend{
+		TieredOpts: opts,
+		objects:    make(map[string]map[string]*tierEntry),
+		quitch:     make(chan struct{}),
+	}
+	if err := b.load(); err != nil {
+		return nil, err
+	}
+
+	if opts.MigrationInterval > 0 {
+		b.wg.Add(1)
+		go b.migrateLoop()
+	}
+	return b, nil
+}
+
+// load indexes the objects of the tiers. An object that is on both was
+// being moved when the node went down, the hot copy is kept.
+func (b *TieredBackend) load() error {
+	for _, cold := range []bool{false, true} {
+		tier := b.tier(cold)
+		namespaces, err := tier.Namespaces()
+		if err != nil {
+			return err
+		}
+		for _, ns := range namespaces {
+			err := tier.List(ns, func(info ObjectInfo) error {
+				if cold && b.objects[ns][info.Name] != nil {
+					return b.Cold.Delete(ns, info.Name)
+				}
+				b.set(ns, info.Name, &tierEntry{cold: cold, size: info.Size, modTime: info.ModTime, used: info.ModTime})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (b *TieredBackend) tier(cold bool) Backend {
+	if cold {
+		return b.Cold
+	}
+	return b.Hot
+}
+
+// lock locks the stripe of the object.
+func (b *TieredBackend) lock(ns string, name string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(ns + "/" + name))
+	mu := &b.stripes[h.Sum32()%tierStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+func (b *TieredBackend) entry(ns string, name string) *tierEntry {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.objects[ns][name]
+}
+
+// set puts the entry into the index, a nil one takes the object out. The
+// caller holds b.mu.
+func (b *TieredBackend) set(ns string, name string, e *tierEntry) {
+	if old := b.objects[ns][name]; old != nil && !old.cold {
+		b.hotBytes -= old.size
+	}
+	if e == nil {
+		delete(b.objects[ns], name)
+		if len(b.objects[ns]) == 0 {
+			delete(b.objects, ns)
+		}
+		return
+	}
+
+	if b.objects[ns] == nil {
+		b.objects[ns] = make(map[string]*tierEntry)
+	}
+	b.objects[ns][name] = e
+	if !e.cold {
+		b.hotBytes += e.size
+	}
+}
+
+// Put writes the object to the hot tier, a copy that was cold is dropped.
+func (b *TieredBackend) Put(ns string, name string, r io.Reader) (int64, error) {
+	defer b.lock(ns, name)()
+
+	n, err := b.Hot.Put(ns, name, r)
+	if err != nil {
+		return n, err
+	}
+	if old := b.entry(ns, name); old != nil && old.cold {
+		if err := b.Cold.Delete(ns, name); err != nil {
+			log.Printf("failed to drop the cold copy of %s/%s: %v", ns, name, err)
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.set(ns, name, &tierEntry{size: n, modTime: now, used: now})
+	return n, nil
+}
+
+// Get reads the object from the tier it is on. A cold object that was read
+// often enough is recalled to the hot tier first.
+func (b *TieredBackend) Get(ns string, name string) (int64, io.ReadCloser, error) {
+	defer b.lock(ns, name)()
+
+	b.mu.Lock()
+	e := b.objects[ns][name]
+	if e == nil {
+		b.mu.Unlock()
+		return 0, nil, notExist("open", ns, name)
+	}
+	e.used = time.Now()
+	if e.cold {
+		e.reads++
+	}
+	recall := e.cold && b.Policy.RecallReads > 0 && e.reads >= b.Policy.RecallReads
+	b.mu.Unlock()
+
+	if recall {
+		if err := b.move(ns, name, e, false); err != nil {
+			// the cold copy is still there to be read
+			log.Printf("failed to recall %s/%s: %v", ns, name, err)
+		}
+	}
+	return b.tier(e.cold).Get(ns, name)
+}
+
+// move copies the object to the other tier and drops it from the one it
+// was on. The caller holds the lock of the object.
+func (b *TieredBackend) move(ns string, name string, e *tierEntry, cold bool) error {
+	from, to := b.tier(e.cold), b.tier(cold)
+
+	_, r, err := from.Get(ns, name)
+	if err != nil {
+		return err
+	}
+	n, err := to.Put(ns, name, r)
+	r.Close()
+	if err != nil {
+		return err
+	}
+	if err := from.Delete(ns, name); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e.cold = cold
+	e.reads = 0
+	if cold {
+		b.hotBytes -= e.size
+		b.stats.Demoted++
+		b.stats.DemotedBytes += n
+	} else {
+		b.hotBytes += e.size
+		b.stats.Recalled++
+		b.stats.RecalledBytes += n
+	}
+	return nil
+}
+
+func (b *TieredBackend) Has(ns string, name string) bool {
+	return b.entry(ns, name) != nil
+}
+
+func (b *TieredBackend) Delete(ns string, name string) error {
+	defer b.lock(ns, name)()
+
+	e := b.entry(ns, name)
+	if e == nil {
+		return nil
+	}
+	if err := b.tier(e.cold).Delete(ns, name); err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.set(ns, name, nil)
+	return nil
+}
+
+func (b *TieredBackend) Stat(ns string, name string) (ObjectInfo, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e := b.objects[ns][name]
+	if e == nil {
+		return ObjectInfo{}, notExist("stat", ns, name)
+	}
+	return ObjectInfo{Name: name, Size: e.size, ModTime: e.modTime}, nil
+}
+
+// Touch moves the time the object was written to now, on the tier too if
+// it can.
+func (b *TieredBackend) Touch(ns string, name string) error {
+	defer b.lock(ns, name)()
+
+	e := b.entry(ns, name)
+	if e == nil {
+		return notExist("touch", ns, name)
+	}
+	if t, ok := b.tier(e.cold).(toucher); ok {
+		if err := t.Touch(ns, name); err != nil {
+			return err
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	e.modTime = time.Now()
+	e.used = e.modTime
+	return nil
+}
+
+// List calls fn in the order of the names, with the objects as they were
+// when List was called.
+func (b *TieredBackend) List(ns string, fn func(ObjectInfo) error) error {
+	b.mu.Lock()
+	infos := []ObjectInfo{}
+	for name, e := range b.objects[ns] {
+		infos = append(infos, ObjectInfo{Name: name, Size: e.size, ModTime: e.modTime})
+	}
+	b.mu.Unlock()
+
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	for _, info := range infos {
+		if err := fn(info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *TieredBackend) Namespaces() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	namespaces := []string{}
+	for ns := range b.objects {
+		namespaces = append(namespaces, ns)
+	}
+	sort.Strings(namespaces)
+	return namespaces, nil
+}
+
+// Stats returns how much is on each tier and how much moved.
+func (b *TieredBackend) Stats() TierStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	stats := b.stats
+	for _, objects := range b.objects {
+		for _, e := range objects {
+			if e.cold {
+				stats.ColdObjects++
+				stats.ColdBytes += e.size
+			} else {
+				stats.HotObjects++
+				stats.HotBytes += e.size
+			}
+		}
+	}
+	return stats
+}
+
+func (b *TieredBackend) migrateLoop() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.MigrationInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if _, err := b.Migrate(); err != nil {
+				log.Printf("failed to move cold objects off the hot tier: %v", err)
+			}
+		case <-b.quitch:
+			return
+		}
+	}
+}
+
+// tierObject names an object of the index.
+type tierObject struct {
+	ns   string
+	name string
+	used time.Time
+	size int64
+}
+
+// Migrate moves the objects the policy says are cold to the cold tier and
+// returns how many it moved. The ones that were used the longest ago go
+// first.
+func (b *TieredBackend) Migrate() (int, error) {
+	b.mu.Lock()
+	hot := []tierObject{}
+	for ns, objects := range b.objects {
+		for name, e := range objects {
+			if !e.cold {
+				hot = append(hot, tierObject{ns: ns, name: name, used: e.used, size: e.size})
+			}
+		}
+	}
+	hotBytes := b.hotBytes
+	b.mu.Unlock()
+
+	sort.Slice(hot, func(i, j int) bool { return hot[i].used.Before(hot[j].used) })
+	cold := []tierObject{}
+	for _, o := range hot {
+		tooOld := b.Policy.ColdAfter > 0 && time.Since(o.used) > b.Policy.ColdAfter
+		tooMuch := b.Policy.HotBytes > 0 && hotBytes > b.Policy.HotBytes
+		if !tooOld && !tooMuch {
+			break
+		}
+		cold = append(cold, o)
+		hotBytes -= o.size
+	}
+
+	moved := 0
+	for _, o := range cold {
+		select {
+		case <-b.quitch:
+			return moved, errBackendClosed
+		default:
+		}
+
+		ok, err := b.demote(o)
+		if err != nil {
+			return moved, err
+		}
+		if ok {
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// demote moves the object to the cold tier, unless it was used or is gone
+// since Migrate looked at it.
+func (b *TieredBackend) demote(o tierObject) (bool, error) {
+	defer b.lock(o.ns, o.name)()
+
+	e := b.entry(o.ns, o.name)
+	if e == nil || e.cold || e.used.After(o.used) {
+		return false, nil
+	}
+	return true, b.move(o.ns, o.name, e, true)
+}
+
+// Close stops the migration and closes both tiers.
+func (b *TieredBackend) Close() error {
+	b.closeOnce.Do(func() { close(b.quitch) })
+	b.wg.Wait()
+
+	err := b.Hot.Close()
+	if cerr := b.Cold.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
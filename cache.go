@@ -0,0 +1,228 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// defaultCacheBytes is how much of the files we are no replica of a node
+// keeps for the next read.
+const defaultCacheBytes = 256 << 20
+
+// CachePolicy picks the cached file that goes when the cache is full.
+type CachePolicy int
+
+const (
+	// CacheLRU evicts the file that was read the longest ago.
+	CacheLRU CachePolicy = iota
+	// CacheLFU evicts the file that was read the fewest times, of those
+	// the one read the longest ago.
+	CacheLFU
+)
+
+func (p CachePolicy) String() string {
+	switch p {
+	case CacheLRU:
+		return "LRU"
+	case CacheLFU:
+		return "LFU"
+	default:
+		return fmt.Sprintf("CachePolicy(%d)", int(p))
+	}
+}
+
+// CacheStats describes the read cache of a node.
+type CacheStats struct {
+	Files    int
+	Bytes    int64
+	Capacity int64
+	// Hits are the reads of a file that was cached, Misses the files that
+	// were fetched into the cache.
+	Hits          int
+	Misses        int
+	Evictions     int
+	Invalidations int
+}
+
+// readCache keeps the files we read but are no replica of. Their chunks sit
+// in the pool with everything else, the cache holds a reference to them so
+// that neither the sweep nor the rebalancer takes them away. Only the
+// manifests are in memory, the cache starts out empty after a restart and
+// the chunks it had are swept.
+type readCache struct {
+	mu       sync.Mutex
+	store    *store
+	capacity int64
+	policy   CachePolicy
+	files    map[string]*cachedFile
+	size     int64
+	stats    CacheStats
+}
+
+// cachedFile is a file of the cache and the whole chunks of it we hold.
+type cachedFile struct {
+	m      *Manifest
+	chunks []string
+	size   int64
+	used   time.Time
+	hits   int
+}
+
+func newReadCache(store *store, capacity int64, policy CachePolicy) *readCache {
+	return &readCache{
+		store:    store,
+		capacity: capacity,
+		policy:   policy,
+		files:    make(map[string]*cachedFile),
+	}
+}
+
+// get returns the manifest of the cached file and counts the read, nil if
+// the file is not cached. Only a read served from the cache calls it.
+func (c *readCache) get(hkey string) *Manifest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	f, ok := c.files[hkey]
+	if !ok {
+		return nil
+	}
+	f.used = time.Now()
+	f.hits++
+	c.stats.Hits++
+	return f.m
+}
+
+// peek returns the manifest of the cached file without counting a read, nil
+// if the file is not cached.
+func (c *readCache) peek(hkey string) *Manifest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if f, ok := c.files[hkey]; ok {
+		return f.m
+	}
+	return nil
+}
+
+// put caches the file whose chunks we just fetched, and evicts others until
+// the cache fits. A file bigger than the whole cache is not kept. It returns
+// how many files were evicted.
+func (c *readCache) put(m *Manifest) int {
+	if c.capacity <= 0 {
+		return 0
+	}
+
+	f := &cachedFile{m: m, used: time.Now()}
+	seen := make(map[string]bool, len(m.Chunks))
+	for _, ch := range m.Chunks {
+		if !seen[ch.Hash] {
+			seen[ch.Hash] = true
+			f.chunks = append(f.chunks, ch.Hash)
+			f.size += ch.Size
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if old, ok := c.files[m.Key]; ok {
+		if old.m.Version == m.Version && old.m.Clock.equal(m.Clock) {
+			old.used = f.used
+			return 0
+		}
+		c.drop(m.Key)
+	}
+	if f.size > c.capacity {
+		return 0
+	}
+
+	c.store.acquirePieces(f.chunks)
+	c.files[m.Key] = f
+	c.size += f.size
+	c.stats.Misses++
+
+	evicted := 0
+	for c.size > c.capacity {
+		c.drop(c.victim(m.Key))
+		c.stats.Evictions++
+		evicted++
+	}
+	return evicted
+}
+
+// victim returns the file the policy evicts next, never the one that is
+// kept.
+func (c *readCache) victim(keep string) string {
+	var (
+		key  string
+		best *cachedFile
+	)
+	for k, f := range c.files {
+		if k == keep {
+			continue
+		}
+		if best == nil || c.before(f, best) {
+			key, best = k, f
+		}
+	}
+	return key
+}
+
+func (c *readCache) before(a *cachedFile, b *cachedFile) bool {
+	if c.policy == CacheLFU && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.used.Before(b.used)
+}
+
+// drop takes the file out of the cache and lets go of its chunks. The
+// caller holds c.mu.
+func (c *readCache) drop(hkey string) {
+	f, ok := c.files[hkey]
+	if !ok {
+		return
+	}
+	delete(c.files, hkey)
+	c.size -= f.size
+	c.store.releasePieces(f.chunks)
+}
+
+// invalidate drops the cached copy of the file, a newer version of it or
+// its deletion reached us.
+func (c *readCache) invalidate(hkey string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.files[hkey]; ok {
+		c.drop(hkey)
+		c.stats.Invalidations++
+	}
+}
+
+// pinned returns the chunks of the cached files.
+func (c *readCache) pinned() map[string]bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	hashes := make(map[string]bool)
+	for _, f := range c.files {
+		for _, hash := range f.chunks {
+			hashes[hash] = true
+		}
+	}
+	return hashes
+}
+
+// CacheStats returns how full the read cache is and how it did so far.
+func (s *FileServer) CacheStats() CacheStats {
+	s.cache.mu.Lock()
+	defer s.cache.mu.Unlock()
+
+	stats := s.cache.stats
+	stats.Files = len(s.cache.files)
+	stats.Bytes = s.cache.size
+	stats.Capacity = s.cache.capacity
+	return stats
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadCacheEvictsByPolicy(t *testing.T) {
+	for _, policy := range []CachePolicy{CacheLRU, CacheLFU} {
+		t.Run(policy.String(), func(t *testing.T) {
+			s := NewStore(StoreOpts{PathTransformFunc: CASPathTransformFunc, Backend: NewMemoryBackend()})
+			c := newReadCache(s, 200, policy)
+
+			files := []*Manifest{}
+			for _, name := range []string{"often", "once", "new"} {
+				chunk := bytes.Repeat([]byte(name), 25)
+				hash := hashChunk(chunk)
+				if _, err := s.WriteChunk(hash, bytes.NewReader(chunk)); err != nil {
+					t.Fatal(err)
+				}
+				files = append(files, &Manifest{Key: hashKey(name), Version: 1, Chunks: []ChunkRef{{Hash: hash, Size: 100}}})
+			}
+
+			c.put(files[0])
+			c.get(files[0].Key)
+			c.get(files[0].Key)
+			c.put(files[1])
+			if s.refCount(files[0].Chunks[0].Hash) != 1 {
+				t.Fatal("the cache does not reference its chunks")
+			}
+
+			// LRU lets the file read most often go, it was read first
+			c.put(files[2])
+			gone := files[1]
+			if policy == CacheLRU {
+				gone = files[0]
+			}
+			if c.get(gone.Key) != nil || s.refCount(gone.Chunks[0].Hash) != 0 {
+				t.Fatalf("%s kept the wrong file", policy)
+			}
+
+			c.invalidate(files[2].Key)
+			if c.get(files[2].Key) != nil || c.size != 100 {
+				t.Fatalf("invalidated file is still cached, %d bytes left", c.size)
+			}
+		})
+	}
+}
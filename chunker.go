@@ -0,0 +1,151 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"math/bits"
+)
+
+const defaultChunkSize = 1 << 20
+
+// gear is the table of the rolling hash. It has to be the same on every node,
+// otherwise equal files would be cut differently and could not be
+// deduplicated, so it is generated from a fixed seed (splitmix64).
+var gear = func() [256]uint64 {
+	var (
+		table [256]uint64
+		seed  uint64 = 0x9e3779b97f4a7c15
+	)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// chunker cuts a stream into content defined chunks (FastCDC). Boundaries
+// are picked by a rolling hash over the content, so an edit in the middle of
+// a file only changes the chunks around it and the rest of the chunks are
+// shared with the previous version. We never keep more than one maximum
+// sized chunk of a file in memory.
+type chunker struct {
+	r io.Reader
+
+	min, avg, max int
+	// maskS is used before the average size is reached and is harder to
+	// match than maskL which is used after, this keeps the chunk sizes
+	// close to the average (normalized chunking).
+	maskS, maskL uint64
+
+	buf   []byte
+	start int
+	end   int
+	eof   bool
+}
+
+// newChunker returns a chunker producing chunks of avg bytes on average,
+// never smaller than avg/4 (except the last one) and never bigger than
+// avg*4.
+func newChunker(r io.Reader, avg int) *chunker {
+	if avg <= 0 {
+		avg = defaultChunkSize
+	}
+	if avg < 64 {
+		avg = 64
+	}
+
+	b := bits.Len(uint(avg)) - 1
+
+	return &chunker{
+		r:     r,
+		min:   avg / 4,
+		avg:   avg,
+		max:   avg * 4,
+		maskS: cutMask(b + 1),
+		maskL: cutMask(b - 1),
+		buf:   make([]byte, avg*4),
+	}
+}
+
+// cutMask selects the top bits of the hash, they depend on the last 64
+// bytes, the low bits only on the last few ones.
+func cutMask(n int) uint64 {
+	return ^uint64(0) << (64 - n)
+}
+
+// Next returns the next chunk of the stream and io.EOF once the stream is
+// drained. The returned slice is only valid until the next call.
+func (c *chunker) Next() ([]byte, error) {
+	if err := c.fill(); err != nil {
+		return nil, err
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	data := c.buf[c.start:c.end]
+	n := c.cut(data)
+	c.start += n
+
+	return data[:n], nil
+}
+
+// fill moves the leftover of the previous call to the front of the buffer
+// and reads until we have a maximum sized chunk or the stream ends.
+func (c *chunker) fill() error {
+	if c.start > 0 {
+		c.end = copy(c.buf, c.buf[c.start:c.end])
+		c.start = 0
+	}
+	if c.eof || c.end == len(c.buf) {
+		return nil
+	}
+
+	n, err := io.ReadFull(c.r, c.buf[c.end:])
+	c.end += n
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		c.eof = true
+		return nil
+	}
+	return err
+}
+
+// cut returns the length of the first chunk of data.
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.min {
+		return n
+	}
+
+	normal := c.avg
+	if n < normal {
+		normal = n
+	}
+
+	var (
+		fp uint64
+		i  = c.min
+	)
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+func hashChunk(b []byte) string {
+	hash := sha256.Sum256(b)
+	return hex.EncodeToString(hash[:])
+}
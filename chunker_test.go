@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func chunkAll(t *testing.T, data []byte, avg int) []string {
+	c := newChunker(bytes.NewReader(data), avg)
+
+	var (
+		hashes []string
+		total  int
+	)
+	for {
+		chunk, err := c.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(chunk) > avg*4 {
+			t.Fatalf("chunk of %d bytes is bigger than the maximum of %d", len(chunk), avg*4)
+		}
+		total += len(chunk)
+		hashes = append(hashes, hashChunk(chunk))
+	}
+
+	if total != len(data) {
+		t.Fatalf("chunks add up to %d bytes, want %d", total, len(data))
+	}
+	return hashes
+}
+
+func TestChunkerSharesChunksAfterEdit(t *testing.T) {
+	data := make([]byte, 256*1024)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// insert a few bytes in the middle of the file
+	edited := append([]byte{}, data[:100000]...)
+	edited = append(edited, []byte("an edit")...)
+	edited = append(edited, data[100000:]...)
+
+	before := chunkAll(t, data, 4096)
+	after := chunkAll(t, edited, 4096)
+
+	seen := make(map[string]bool)
+	for _, h := range before {
+		seen[h] = true
+	}
+	shared := 0
+	for _, h := range after {
+		if seen[h] {
+			shared++
+		}
+	}
+
+	if shared < len(before)-3 {
+		t.Fatalf("only %d of %d chunks are shared after the edit", shared, len(before))
+	}
+}
+
+func TestChunkerEmptyStream(t *testing.T) {
+	if hashes := chunkAll(t, nil, 4096); len(hashes) != 0 {
+		t.Fatalf("want no chunks for an empty stream, have %d", len(hashes))
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"time"
+)
+
+// siblingNamespace holds the versions of a file that were written
+// concurrently with its current one, one list per file of an owner.
+const siblingNamespace = "siblings"
+
+// VersionVector counts the writes of a file per node that wrote it. A write
+// that saw another one has a vector that descends from the vector of that
+// write, two writes that did not see each other are concurrent.
+type VersionVector map[string]uint64
+
+// descends tells if v saw every write other saw.
+func (v VersionVector) descends(other VersionVector) bool {
+	for node, n := range other {
+		if v[node] < n {
+			return false
+		}
+	}
+	return true
+}
+
+func (v VersionVector) equal(other VersionVector) bool {
+	return v.descends(other) && other.descends(v)
+}
+
+// merge returns the vector that saw the writes of both.
+func (v VersionVector) merge(other VersionVector) VersionVector {
+	merged := maps.Clone(v)
+	if merged == nil {
+		merged = make(VersionVector)
+	}
+	for node, n := range other {
+		merged[node] = max(merged[node], n)
+	}
+	return merged
+}
+
+// next returns the vector of a new write by the node. The counters are
+// clock readings, so a node that lost the file still counts forward.
+func (v VersionVector) next(node string) VersionVector {
+	next := v.merge(nil)
+	next[node] = max(next[node]+1, uint64(time.Now().UnixNano()))
+	return next
+}
+
+// Resolution says what Resolve does with the concurrent versions of a file.
+type Resolution int
+
+const (
+	// ResolveLastWriterWins keeps the version GET reads, the one with the
+	// newest version, and drops the others.
+	ResolveLastWriterWins Resolution = iota
+	// ResolveKeepBoth keeps the version GET reads under the key and copies
+	// every other one to a key of its own, see conflictKey.
+	ResolveKeepBoth
+)
+
+// conflictKey is the key ResolveKeepBoth copies a concurrent version to.
+func conflictKey(key string, version string) string {
+	return key + ".conflict-" + version
+}
+
+// lastWriter splits the concurrent versions into the one that wins by
+// version, which is what every node reads, and the others.
+func lastWriter(versions []*Manifest) (*Manifest, []*Manifest) {
+	var winner *Manifest
+	for _, m := range versions {
+		if m.newerThan(winner) {
+			winner = m
+		}
+	}
+
+	rest := []*Manifest{}
+	for _, m := range versions {
+		if m != winner {
+			rest = append(rest, m)
+		}
+	}
+	return winner, rest
+}
+
+// readSiblings returns the versions written concurrently with the current
+// one of the file.
+func (s *store) readSiblings(id string, hkey string) ([]*Manifest, error) {
+	_, r, err := s.readStream(siblingNamespace, historyKey(id, hkey))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	siblings := []*Manifest{}
+	if err := gob.NewDecoder(r).Decode(&siblings); err != nil {
+		return nil, err
+	}
+	return siblings, nil
+}
+
+// writeSiblings stores the siblings of the file, none deletes them.
+func (s *store) writeSiblings(id string, hkey string, siblings []*Manifest) error {
+	if len(siblings) == 0 {
+		err := s.Delete(siblingNamespace, historyKey(id, hkey))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(siblings); err != nil {
+		return err
+	}
+	_, err := s.Write(siblingNamespace, historyKey(id, hkey), buf)
+	return err
+}
+
+// nextClock returns the vector of a new write of the file by the node. It
+// saw the current version and all its siblings, so it replaces them.
+func (s *store) nextClock(id string, hkey string, node string) VersionVector {
+	clock := VersionVector{}
+	if m, err := s.ReadManifest(id, hkey); err == nil {
+		clock = clock.merge(m.Clock)
+	}
+	siblings, _ := s.readSiblings(id, hkey)
+	for _, m := range siblings {
+		clock = clock.merge(m.Clock)
+	}
+	return clock.next(node)
+}
+
+// Siblings returns the concurrent versions of the file we know of, the one
+// GET reads is the current one. A file without conflicts has only that one.
+func (s *FileServer) Siblings(key string) ([]VersionInfo, error) {
+	hkey := hashKey(key)
+	m, err := s.store.ReadManifest(s.Owner, hkey)
+	if err != nil || m.Deleted {
+		return nil, fmt.Errorf("[%s] file (%s) not found", s.Transport.Addr(), key)
+	}
+	siblings, err := s.store.readSiblings(s.Owner, hkey)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []VersionInfo{m.versionInfo(true)}
+	for _, sibling := range siblings {
+		infos = append(infos, sibling.versionInfo(false))
+	}
+	return infos, nil
+}
+
+// Resolve settles the conflict between the concurrent versions of the file.
+// The outcome is written as a new version that saw all of them, so every
+// replica drops its siblings when it gets it.
+func (s *FileServer) Resolve(key string, how Resolution) error {
+	hkey := hashKey(key)
+	siblings, err := s.store.readSiblings(s.Owner, hkey)
+	if err != nil {
+		return err
+	}
+	if len(siblings) == 0 {
+		return nil
+	}
+
+	if how == ResolveKeepBoth {
+		for _, sibling := range siblings {
+			version := versionID(sibling.Version)
+			r, err := s.GETWith(key, ReadOpts{Version: version})
+			if err != nil {
+				return err
+			}
+			opts := WriteOpts{Durability: sibling.Durability, Consistency: ConsistencyQuorum}
+			if err := s.StoreWith(conflictKey(key, version), r, opts); err != nil {
+				return err
+			}
+		}
+	}
+
+	cur, err := s.store.ReadManifest(s.Owner, hkey)
+	if err != nil {
+		return err
+	}
+	m := *cur
+	m.Clock = s.store.nextClock(s.Owner, hkey, s.ID)
+	m.Version = s.store.nextVersion(s.Owner, hkey)
+	m.Created = time.Now()
+
+	if err := s.publish(&m, s.peerList(), s.placement(s.Owner, &m), ConsistencyQuorum); err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] resolved (%d) concurrent versions of (%s)\n", s.Transport.Addr(), len(siblings)+1, key)
+	return nil
+}
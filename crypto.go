@@ -1,10 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -46,7 +49,7 @@ func processStream(key []byte, src io.Reader, dst io.Writer, encrypt bool) (int,
 			return 0, err
 		}
 	} else {
-		if _, err := src.Read(iv); err != nil {
+		if _, err := io.ReadFull(src, iv); err != nil {
 			return 0, err
 		}
 	}
@@ -86,3 +89,70 @@ func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 func copyDecrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	return processStream(key, src, dst, false)
 }
+
+// convergentKey derives the key of a chunk from its content. Equal chunks end
+// up as equal encrypted bytes no matter which owner stores them, that's what
+// lets a node keep a single copy of them.
+func convergentKey(chunk []byte) []byte {
+	key := sha256.Sum256(chunk)
+	return key[:]
+}
+
+// chunkStream is the cipher of a chunk. Every key only ever encrypts the one
+// chunk it was derived from, so the IV can be fixed.
+func chunkStream(key []byte) (cipher.Stream, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewCTR(block, make([]byte, block.BlockSize())), nil
+}
+
+func encryptChunk(key []byte, chunk []byte) ([]byte, error) {
+	stream, err := chunkStream(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(chunk))
+	stream.XORKeyStream(out, chunk)
+	return out, nil
+}
+
+// newChunkDecrypterAt decrypts the bytes of a chunk from offset on. CTR
+// lets us start right at the block of the offset, nothing before it has to
+// be read.
+func newChunkDecrypterAt(key []byte, r io.Reader, offset int64) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// the counter of the block the offset is in
+	iv := make([]byte, block.BlockSize())
+	binary.BigEndian.PutUint64(iv[len(iv)-8:], uint64(offset/int64(block.BlockSize())))
+	stream := cipher.NewCTR(block, iv)
+
+	// throw away the key stream of the bytes of the block before the offset
+	skip := make([]byte, offset%int64(block.BlockSize()))
+	stream.XORKeyStream(skip, skip)
+
+	return &cipher.StreamReader{S: stream, R: r}, nil
+}
+
+// sealKey encrypts the key of a chunk with the key of the owner, the sealed
+// key is what we keep in the manifest.
+func sealKey(enckey []byte, key []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := copyEncrypt(enckey, bytes.NewReader(key), buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func openKey(enckey []byte, sealed []byte) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if _, err := copyDecrypt(enckey, bytes.NewReader(sealed), buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -38,3 +38,27 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 	// fmt.Println(out.String())
 
 }
+
+func TestChunkDecrypterAt(t *testing.T) {
+	chunk := []byte("every byte of this chunk can be decrypted on its own, no matter where we start")
+	key := convergentKey(chunk)
+
+	encrypted, err := encryptChunk(key, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, offset := range []int{0, 1, 15, 16, 17, 40, len(chunk) - 1} {
+		r, err := newChunkDecrypterAt(key, bytes.NewReader(encrypted[offset:]), int64(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := new(bytes.Buffer)
+		if _, err := out.ReadFrom(r); err != nil {
+			t.Fatal(err)
+		}
+		if out.String() != string(chunk[offset:]) {
+			t.Errorf("offset %d: have %q want %q", offset, out.String(), chunk[offset:])
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"slices"
+
+	"github.com/pavanmanikanta98/dfs-with-go/p2p"
+)
+
+// MessageLeaving tells the peers the node is being decommissioned. They stop
+// placing data on it and forget it as a member, it is not coming back.
+type MessageLeaving struct {
+	ID string
+}
+
+// DecommissionProgress is how far the hand off of a leaving node got.
+type DecommissionProgress struct {
+	// Files is how many files we have, Done how many of them are handed
+	// off and Failed how many could not be.
+	Files  int
+	Done   int
+	Failed int
+	// Bytes is how many bytes of chunks went to other nodes.
+	Bytes int64
+}
+
+func (s *FileServer) handleMessageLeaving(from string, msg MessageLeaving) error {
+	s.peerLock.Lock()
+	s.leavingNodes[msg.ID] = true
+	delete(s.members, msg.ID)
+	s.peerLock.Unlock()
+
+	log.Printf("[%s] node %s on %s is leaving", s.Transport.Addr(), msg.ID, from)
+
+	s.triggerRebalance()
+	return nil
+}
+
+// Decommission takes the node out of the cluster for good. It stops taking
+// writes, tells the peers it is leaving, hands every file it holds chunks or
+// shards of to the nodes that own them without it and only then stops. If
+// anything could not be handed off the node keeps running, still leaving,
+// and Decommission can be called again. The progress func, if any, is called
+// after every file.
+func (s *FileServer) Decommission(progress func(DecommissionProgress)) error {
+	if len(s.peerList()) == 0 {
+		return fmt.Errorf("[%s] no peers to hand the data off to", s.Transport.Addr())
+	}
+
+	s.leaving.Store(true)
+
+	if err := s.broadcast(&Message{Payload: MessageLeaving{ID: s.ID}}); err != nil {
+		return err
+	}
+
+	p := DecommissionProgress{}
+	entries := s.store.tree.all()
+	p.Files = len(entries)
+
+	for _, e := range entries {
+		n, err := s.handOffFile(e.ID, e.Key)
+		if err != nil {
+			log.Printf("[%s] failed to hand off %s of %s: %v", s.Transport.Addr(), e.Key, e.ID, err)
+			p.Failed++
+		} else {
+			p.Done++
+		}
+		p.Bytes += n
+
+		if progress != nil {
+			progress(p)
+		}
+	}
+
+	if err := s.handOffHints(); err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] handed off (%d/%d) files, (%d) bytes\n", s.Transport.Addr(), p.Done, p.Files, p.Bytes)
+
+	if p.Failed > 0 {
+		return fmt.Errorf("[%s] (%d) files could not be handed off", s.Transport.Addr(), p.Failed)
+	}
+
+	// the peers forget us once the connections are gone
+	_, err := s.Shutdown(shutdownTimeout)
+	return err
+}
+
+// handOffFile gives what we hold of the file of the owner to the nodes that
+// own it without us and returns how many bytes it sent.
+func (s *FileServer) handOffFile(id string, hkey string) (int64, error) {
+	m, err := s.store.ReadManifest(id, hkey)
+	if err != nil {
+		// deleted in the meantime
+		return 0, nil
+	}
+
+	if m.Durability.erasureCoded() {
+		return s.moveShards(id, m)
+	}
+
+	if len(s.store.missingChunks(m.Chunks)) > 0 {
+		// we were not a replica of it, the replicas hand it off
+		return 0, nil
+	}
+
+	var sent int64
+	for _, node := range s.placement(id, m) {
+		peer, ok := s.nodePeer(node)
+		if !ok {
+			return sent, fmt.Errorf("replica %s is not connected", node)
+		}
+		n, err := s.repairReplica(peer, id, m, true)
+		sent += n
+		if err != nil {
+			return sent, err
+		}
+	}
+	return sent, nil
+}
+
+// moveShards places the shards that were placed on us on other nodes. The
+// manifest says where every shard is, so it gets a new version listing the
+// new nodes and goes to every peer.
+func (s *FileServer) moveShards(id string, m *Manifest) (int64, error) {
+	var (
+		sent  int64
+		nodes = s.nodeList()
+	)
+
+	for i, c := range m.Chunks {
+		for j, hash := range c.Shards {
+			if j >= len(c.Nodes) || c.Nodes[j] != s.ID {
+				continue
+			}
+
+			b, ok := s.readPiece(m, hash)
+			if !ok {
+				return sent, fmt.Errorf("we lost shard %d of chunk %s", j, c.Hash)
+			}
+
+			node, ok := newShardNode(hash, nodes, c.Nodes)
+			if !ok {
+				return sent, fmt.Errorf("no node left for shard %d of chunk %s", j, c.Hash)
+			}
+			peer, ok := s.nodePeer(node)
+			if !ok {
+				return sent, fmt.Errorf("node %s is not connected", node)
+			}
+			if err := s.replicateChunk([]p2p.Peer{peer}, nil, id, m.Key, m.Size, hash, b); err != nil {
+				return sent, err
+			}
+			sent += int64(len(b))
+
+			m.Chunks[i].Nodes = slices.Clone(m.Chunks[i].Nodes)
+			m.Chunks[i].Nodes[j] = node
+		}
+	}
+
+	if sent == 0 {
+		return 0, nil
+	}
+
+	m.Version++
+	m.Clock = m.Clock.next(s.ID)
+	if err := s.store.WriteManifest(id, m); err != nil {
+		return sent, err
+	}
+	for _, peer := range s.peerList() {
+		if _, err := s.repairReplica(peer, id, m, false); err != nil {
+			return sent, err
+		}
+	}
+	s.recordMeta(id, m, nil)
+	return sent, nil
+}
+
+// newShardNode picks the node a shard moves to, one that holds no other shard
+// of the chunk if there is any.
+func newShardNode(hash string, nodes []string, taken []string) (string, bool) {
+	ranked := rankNodes(hash, nodes)
+	for _, node := range ranked {
+		if !slices.Contains(taken, node) {
+			return node, true
+		}
+	}
+	if len(ranked) == 0 {
+		return "", false
+	}
+	return ranked[0], true
+}
+
+// handOffHints gives the writes we hold for nodes that are down to another
+// stand-in, the ones for nodes that are back are replayed right away.
+func (s *FileServer) handOffHints() error {
+	hints, err := s.store.hints("")
+	if err != nil {
+		return err
+	}
+
+	var (
+		failed   int
+		replayed = make(map[string]bool)
+	)
+	for _, h := range hints {
+		if _, ok := s.nodePeer(h.Target); ok {
+			if replayed[h.Target] {
+				continue
+			}
+			replayed[h.Target] = true
+
+			s.replayHints(h.Target)
+			if left, err := s.store.hints(h.Target); err != nil || len(left) > 0 {
+				failed++
+			}
+			continue
+		}
+		if err := s.moveHint(h); err != nil {
+			log.Printf("[%s] failed to hand off the hint of %s for %s: %v", s.Transport.Addr(), h.Key, h.Target, err)
+			failed++
+			continue
+		}
+		if err := s.store.deleteHint(h); err != nil {
+			log.Printf("[%s] failed to drop the hint of %s: %v", s.Transport.Addr(), h.Key, err)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("[%s] (%d) hints could not be handed off", s.Transport.Addr(), failed)
+	}
+	return nil
+}
+
+// moveHint sends the pieces of the hint to the stand-in of its target and
+// leaves the hint there.
+func (s *FileServer) moveHint(h *hint) error {
+	standIn := s.standIn(h.Target, h.Key, s.nodeList())
+	peer, ok := s.nodePeer(standIn)
+	if !ok {
+		return fmt.Errorf("stand-in %s is not connected", standIn)
+	}
+
+	// the stand-in knows the file, it is charged for it already
+	size := h.Size
+	if m, err := s.store.ReadManifest(h.ID, h.Key); err == nil {
+		size = m.Size
+	}
+	for _, hash := range h.Pieces {
+		b, err := s.readShard(hash)
+		if err != nil {
+			return err
+		}
+		if err := s.replicateChunk([]p2p.Peer{peer}, nil, h.ID, h.Key, size, hash, b); err != nil {
+			return err
+		}
+	}
+
+	return s.hintFor(standIn, h)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pavanmanikanta98/dfs-with-go/p2p"
+)
+
+const (
+	// downloadBatch is how many chunks we ask a holder for at once. Small
+	// batches spread the file over the holders, big ones save round trips.
+	downloadBatch = 4
+
+	// stallTimeout is how long a holder may keep us waiting for the next
+	// bytes before we give its chunks to another holder.
+	stallTimeout = 5 * time.Second
+)
+
+// download hands out the missing chunks of a manifest to the holders that
+// fetch them in parallel. A chunk a holder failed to deliver goes back into
+// the queue for the other holders.
+type download struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	chunks   []ChunkRef
+	queue    []ChunkRef
+	inflight int
+	// failed remembers which holders could not deliver a chunk
+	failed map[string]map[string]bool
+}
+
+func newDownload(chunks []ChunkRef) *download {
+	d := &download{
+		chunks: chunks,
+		queue:  append([]ChunkRef{}, chunks...),
+		failed: make(map[string]map[string]bool),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	return d
+}
+
+// take returns the next batch of chunks for the holder. It waits while
+// other holders still have chunks in flight that could come back, and
+// returns nothing once there is nothing left the holder could do.
+func (d *download) take(holder string) []ChunkRef {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for {
+		batch := []ChunkRef{}
+		rest := d.queue[:0]
+		for _, c := range d.queue {
+			if len(batch) < downloadBatch && !d.failed[c.Hash][holder] {
+				batch = append(batch, c)
+			} else {
+				rest = append(rest, c)
+			}
+		}
+		d.queue = rest
+
+		if len(batch) > 0 {
+			d.inflight += len(batch)
+			return batch
+		}
+		if d.inflight == 0 {
+			return nil
+		}
+		d.cond.Wait()
+	}
+}
+
+// done reports the chunks of a batch the holder did not deliver.
+func (d *download) done(holder string, batch []ChunkRef, failed []ChunkRef) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.inflight -= len(batch)
+	for _, c := range failed {
+		if d.failed[c.Hash] == nil {
+			d.failed[c.Hash] = make(map[string]bool)
+		}
+		d.failed[c.Hash][holder] = true
+		d.queue = append(d.queue, c)
+	}
+	d.cond.Broadcast()
+}
+
+// remaining returns the chunks no holder was able to deliver.
+func (d *download) remaining() []ChunkRef {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return d.queue
+}
+
+// fetchChunks downloads the chunks we don't have locally from all holders at
+// once. Every chunk is verified before it is stored, a holder that stalls or
+// fails is left behind and its chunks are fetched from the others.
+func (s *FileServer) fetchChunks(holders []string, chunks []ChunkRef) error {
+	missing := s.store.missingChunks(chunks)
+	if len(missing) == 0 {
+		return nil
+	}
+
+	var (
+		d  = newDownload(missing)
+		wg sync.WaitGroup
+	)
+
+	for _, holder := range holders {
+		wg.Add(1)
+		go func(holder string) {
+			defer wg.Done()
+
+			for {
+				batch := d.take(holder)
+				if len(batch) == 0 {
+					return
+				}
+
+				failed, err := s.fetchBatch(holder, batch)
+				d.done(holder, batch, failed)
+				if err != nil {
+					log.Printf("[%s] leaving %s behind: %v", s.Transport.Addr(), holder, err)
+					d.leave(holder)
+					return
+				}
+			}
+		}(holder)
+	}
+
+	wg.Wait()
+
+	if left := d.remaining(); len(left) > 0 {
+		return fmt.Errorf("[%s] (%d) chunks are not available from any peer", s.Transport.Addr(), len(left))
+	}
+
+	return nil
+}
+
+// leave marks every chunk as failed for the holder, it won't take any
+// more of them.
+func (d *download) leave(holder string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, c := range d.chunks {
+		if d.failed[c.Hash] == nil {
+			d.failed[c.Hash] = make(map[string]bool)
+		}
+		d.failed[c.Hash][holder] = true
+	}
+	d.cond.Broadcast()
+}
+
+// fetchBatch asks the holder for the chunks and returns the ones it did not
+// deliver. An error means the holder is of no more use for this download.
+func (s *FileServer) fetchBatch(holder string, batch []ChunkRef) ([]ChunkRef, error) {
+	peer, ok := s.peer(holder)
+	if !ok {
+		return batch, fmt.Errorf("peer %s not found in the peer list", holder)
+	}
+
+	req := s.newRequest()
+	defer s.finishRequest(req)
+
+	chunks := make([]ChunkRequest, len(batch))
+	for i, c := range batch {
+		chunks[i] = ChunkRequest{
+			Hash:   c.Hash,
+			Offset: s.store.partialChunkSize(c.Hash),
+		}
+	}
+
+	msg := Message{
+		Payload: MessageGetChunks{
+			ReqID:  req.id,
+			Chunks: chunks,
+		},
+	}
+
+	if err := s.send(peer, &msg); err != nil {
+		return batch, err
+	}
+
+	timeout := time.NewTimer(stallTimeout)
+	defer timeout.Stop()
+
+	delivered := make(map[string]bool, len(batch))
+	for range batch {
+		rep := req.wait(timeout)
+		if rep == nil {
+			return undelivered(batch, delivered), fmt.Errorf("timed out waiting for chunks")
+		}
+
+		err := s.storeFetchedChunk(peer, rep)
+		rep.Close()
+		resetTimer(timeout, stallTimeout)
+
+		res := rep.payload.(MessageChunkResponse)
+		if err == nil {
+			delivered[res.Hash] = true
+			continue
+		}
+
+		log.Printf("[%s] %v", s.Transport.Addr(), err)
+		if isTimeout(err) {
+			return undelivered(batch, delivered), err
+		}
+	}
+
+	return undelivered(batch, delivered), nil
+}
+
+func undelivered(batch []ChunkRef, delivered map[string]bool) []ChunkRef {
+	left := []ChunkRef{}
+	for _, c := range batch {
+		if !delivered[c.Hash] {
+			left = append(left, c)
+		}
+	}
+	return left
+}
+
+func (s *FileServer) storeFetchedChunk(peer p2p.Peer, rep *reply) error {
+	res := rep.payload.(MessageChunkResponse)
+	if !res.Found {
+		return fmt.Errorf("peer %s does not have chunk %s", rep.from, res.Hash)
+	}
+
+	// A holder that stops sending in the middle of a chunk would block us
+	// forever, the deadline turns that into an error. What we got of the
+	// chunk is kept and the next holder continues from there.
+	r := &stallReader{conn: peer, r: rep.r}
+	defer peer.SetReadDeadline(time.Time{})
+
+	if _, err := s.store.WriteChunkAt(res.Hash, res.Offset, res.Offset+res.Size, r); err != nil {
+		if isTimeout(err) {
+			// the rest of the stream is stuck on the connection, it's
+			// of no use anymore.
+			s.dropPeer(peer)
+			return err
+		}
+		return fmt.Errorf("chunk %s from %s: %v", res.Hash, rep.from, err)
+	}
+	return nil
+}
+
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// stallReader fails a read that does not get any bytes within the stall
+// timeout.
+type stallReader struct {
+	conn net.Conn
+	r    io.Reader
+}
+
+func (r *stallReader) Read(p []byte) (int, error) {
+	r.conn.SetReadDeadline(time.Now().Add(stallTimeout))
+	return r.r.Read(p)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"fmt"
+)
+
+// GF(2^8) with the polynomial x^8 + x^4 + x^3 + x^2 + 1, the field
+// Reed-Solomon codes usually work in.
+var (
+	gfExp [512]byte
+	gfLog [256]int
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < len(gfExp); i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(a, b byte) byte {
+	if a == 0 || b == 0 {
+		return 0
+	}
+	return gfExp[gfLog[a]+gfLog[b]]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[a]*n)%255]
+}
+
+// erasureCoder splits data into data shards plus parity shards with a
+// Reed-Solomon code, any data shards of them are enough to get the data
+// back.
+type erasureCoder struct {
+	data, parity int
+	// matrix has a row per shard, the first rows are the identity so the
+	// data shards are the data itself.
+	matrix [][]byte
+}
+
+func newErasureCoder(data, parity int) (*erasureCoder, error) {
+	if data < 1 || parity < 1 || data+parity > 256 {
+		return nil, fmt.Errorf("invalid erasure coding of %d data and %d parity shards", data, parity)
+	}
+
+	// Any data rows of a Vandermonde matrix are invertible. Multiplying it
+	// with the inverse of its top turns the top into the identity and
+	// keeps that property.
+	vandermonde := make([][]byte, data+parity)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, data)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+
+	top, err := invertMatrix(vandermonde[:data])
+	if err != nil {
+		return nil, err
+	}
+
+	return &erasureCoder{
+		data:   data,
+		parity: parity,
+		matrix: multiplyMatrix(vandermonde, top),
+	}, nil
+}
+
+// shardSize is the size of every shard of size bytes of data.
+func (e *erasureCoder) shardSize(size int) int {
+	return (size + e.data - 1) / e.data
+}
+
+// Split returns the data shards followed by the parity shards of b.
+func (e *erasureCoder) Split(b []byte) [][]byte {
+	size := e.shardSize(len(b))
+
+	// the last data shard is padded with zeros
+	padded := make([]byte, size*e.data)
+	copy(padded, b)
+
+	shards := make([][]byte, e.data+e.parity)
+	for i := 0; i < e.data; i++ {
+		shards[i] = padded[i*size : (i+1)*size]
+	}
+
+	for p := 0; p < e.parity; p++ {
+		row := e.matrix[e.data+p]
+		shard := make([]byte, size)
+		for i := 0; i < e.data; i++ {
+			mulAdd(shard, shards[i], row[i])
+		}
+		shards[e.data+p] = shard
+	}
+
+	return shards
+}
+
+// Join puts the size bytes of data back together from the shards, missing
+// shards are nil. It needs any data shards of them.
+func (e *erasureCoder) Join(shards [][]byte, size int) ([]byte, error) {
+	if len(shards) != e.data+e.parity {
+		return nil, fmt.Errorf("want %d shards, have %d", e.data+e.parity, len(shards))
+	}
+
+	var (
+		rows    = [][]byte{}
+		present = [][]byte{}
+	)
+	for i, shard := range shards {
+		if shard == nil || len(present) == e.data {
+			continue
+		}
+		if len(shard) != e.shardSize(size) {
+			return nil, fmt.Errorf("shard %d has %d bytes, want %d", i, len(shard), e.shardSize(size))
+		}
+		rows = append(rows, e.matrix[i])
+		present = append(present, shard)
+	}
+	if len(present) < e.data {
+		return nil, fmt.Errorf("need %d shards to reconstruct, have %d", e.data, len(present))
+	}
+
+	decode, err := invertMatrix(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, e.shardSize(size)*e.data)
+	for i := 0; i < e.data; i++ {
+		shard := make([]byte, e.shardSize(size))
+		for j, p := range present {
+			mulAdd(shard, p, decode[i][j])
+		}
+		out = append(out, shard...)
+	}
+
+	return out[:size], nil
+}
+
+// mulAdd adds c*src to dst.
+func mulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	for i, b := range src {
+		dst[i] ^= gfMul(c, b)
+	}
+}
+
+func multiplyMatrix(a, b [][]byte) [][]byte {
+	out := make([][]byte, len(a))
+	for r := range a {
+		out[r] = make([]byte, len(b[0]))
+		for c := range out[r] {
+			var v byte
+			for i := range b {
+				v ^= gfMul(a[r][i], b[i][c])
+			}
+			out[r][c] = v
+		}
+	}
+	return out
+}
+
+// invertMatrix inverts a square matrix with Gauss-Jordan elimination.
+func invertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+
+	// work on [m | identity]
+	work := make([][]byte, n)
+	for r := range m {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+
+	for c := 0; c < n; c++ {
+		pivot := -1
+		for r := c; r < n; r++ {
+			if work[r][c] != 0 {
+				pivot = r
+				break
+			}
+		}
+		if pivot < 0 {
+			return nil, fmt.Errorf("matrix is singular")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+
+		inv := gfInv(work[c][c])
+		for i := range work[c] {
+			work[c][i] = gfMul(work[c][i], inv)
+		}
+
+		for r := 0; r < n; r++ {
+			if r != c && work[r][c] != 0 {
+				mulAdd(work[r], work[c], work[r][c])
+			}
+		}
+	}
+
+	out := make([][]byte, n)
+	for r := range work {
+		out[r] = work[r][n:]
+	}
+	return out, nil
+}
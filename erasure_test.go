@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestErasureCoderJoinsFromAnyShards(t *testing.T) {
+	coder, err := newErasureCoder(4, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1001)
+	rand.Read(data)
+
+	shards := coder.Split(data)
+	if len(shards) != 6 {
+		t.Fatalf("have %d shards, want 6", len(shards))
+	}
+
+	// losing any two shards still gets the data back
+	for i := range shards {
+		for j := i + 1; j < len(shards); j++ {
+			lost := make([][]byte, len(shards))
+			copy(lost, shards)
+			lost[i], lost[j] = nil, nil
+
+			b, err := coder.Join(lost, len(data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(b, data) {
+				t.Fatalf("wrong data without shards %d and %d", i, j)
+			}
+		}
+	}
+
+	shards[0], shards[1], shards[5] = nil, nil, nil
+	if _, err := coder.Join(shards, len(data)); err == nil {
+		t.Fatal("expected an error with only 3 of 4 data shards")
+	}
+}
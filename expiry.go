@@ -0,0 +1,124 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+const (
+	// expiryInterval is how often every node looks for expired files.
+	expiryInterval = time.Minute
+
+	// tombstoneRetention is how long the tombstone of an expired file is
+	// kept. A node that was down for longer than that may bring the file
+	// back.
+	tombstoneRetention = 7 * 24 * time.Hour
+)
+
+// expired tells if the file ran out its time to live.
+func (m *Manifest) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// tombstone returns the manifest that replaces the expired file and its
+// siblings. It has no chunks and every node derives the same one, so the
+// nodes that expire the file on their own agree on it and anti-entropy does
+// not bring the file back.
+func (m *Manifest) tombstone(siblings []*Manifest) *Manifest {
+	t := &Manifest{
+		Key:     m.Key,
+		Version: m.Version,
+		Clock:   m.Clock.merge(nil),
+		Fence:   m.Fence,
+		Created: m.Expires,
+		Expires: m.Expires,
+		Deleted: true,
+	}
+	for _, sibling := range siblings {
+		t.Version = max(t.Version, sibling.Version)
+		t.Clock = t.Clock.merge(sibling.Clock)
+		t.Fence = max(t.Fence, sibling.Fence)
+	}
+	t.Version++
+	return t
+}
+
+// expireFiles replaces the files that expired with their tombstones, their
+// chunks and old versions are dropped, and deletes the tombstones that are
+// older than the retention. It returns the entries of the files it expired
+// and how many tombstones it deleted.
+func (s *store) expireFiles(now time.Time) ([]MerkleEntry, int, error) {
+	var (
+		expired = []MerkleEntry{}
+		dropped = 0
+	)
+	for _, e := range s.tree.all() {
+		m, err := s.ReadManifest(e.ID, e.Key)
+		if err != nil {
+			continue
+		}
+
+		if m.Deleted {
+			if now.Sub(m.Created) < tombstoneRetention {
+				continue
+			}
+			if err := s.DeleteManifest(e.ID, e.Key); err != nil {
+				return expired, dropped, err
+			}
+			dropped++
+			continue
+		}
+		if !m.expired(now) {
+			continue
+		}
+
+		siblings, err := s.readSiblings(e.ID, e.Key)
+		if err != nil {
+			return expired, dropped, err
+		}
+		if err := s.WriteManifest(e.ID, m.tombstone(siblings)); err != nil {
+			return expired, dropped, err
+		}
+		s.manifestLock.Lock()
+		err = s.deleteHistory(e.ID, e.Key)
+		s.manifestLock.Unlock()
+		if err != nil {
+			return expired, dropped, err
+		}
+		expired = append(expired, e)
+	}
+	return expired, dropped, nil
+}
+
+// expireLoop periodically expires the files that ran out their time, the
+// chunks nobody uses anymore go with the next garbage collection.
+func (s *FileServer) expireLoop() {
+	ticker := time.NewTicker(expiryInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			s.expire()
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+func (s *FileServer) expire() {
+	expired, dropped, err := s.store.expireFiles(time.Now())
+	if err != nil {
+		log.Printf("[%s] failed to expire files: %v", s.Transport.Addr(), err)
+	}
+	if len(expired) > 0 || dropped > 0 {
+		log.Printf("[%s] expired (%d) files, dropped (%d) tombstones", s.Transport.Addr(), len(expired), dropped)
+	}
+
+	// the catalog forgets our files once they are gone
+	for _, e := range expired {
+		if e.ID == s.Owner {
+			s.forgetMeta(e.ID, e.Key)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/pavanmanikanta98/dfs-with-go/p2p"
+)
+
+// hintNamespace holds the writes we took for nodes that were down, until
+// they are back to get them.
+const hintNamespace = "hints"
+
+const (
+	// hintRetention is how long a hint waits for its node, a node that
+	// is gone for longer catches up through anti-entropy.
+	hintRetention = 3 * time.Hour
+
+	// maxHintBytes caps the chunks we keep for other nodes.
+	maxHintBytes = 1 << 30
+
+	// hintReplayInterval is how often we try to reach the nodes we hold
+	// hints for.
+	hintReplayInterval = 30 * time.Second
+)
+
+// hint is a write of the file of the owner the target node missed. Pieces
+// are the chunks or shards of it the target is supposed to hold, we keep
+// them referenced until the hint is replayed.
+type hint struct {
+	Target  string
+	ID      string
+	Key     string
+	Pieces  []string
+	Size    int64
+	Created time.Time
+}
+
+func hintKey(target string, id string, key string) string {
+	return target + "/" + id + "/" + key
+}
+
+// MessageHint asks the peer to hold a hint for the target node. The pieces
+// were sent to it before.
+type MessageHint struct {
+	Target string
+	ID     string
+	Key    string
+	Pieces []string
+	Size   int64
+}
+
+func (s *store) readHint(name string) (*hint, error) {
+	r, err := s.open(hintNamespace, name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	h := new(hint)
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// hints returns the hints we hold, for the target only if it's not empty.
+func (s *store) hints(target string) ([]*hint, error) {
+	hints := []*hint{}
+	err := s.walk(hintNamespace, func(info ObjectInfo) error {
+		h, err := s.readHint(info.Name)
+		if err != nil {
+			log.Printf("skipping %s, not a hint: %v", info.Name, err)
+			return nil
+		}
+		if target == "" || h.Target == target {
+			hints = append(hints, h)
+		}
+		return nil
+	})
+	return hints, err
+}
+
+func (s *store) hintBytes() (int64, error) {
+	hints, err := s.hints("")
+	if err != nil {
+		return 0, err
+	}
+	var n int64
+	for _, h := range hints {
+		n += h.Size
+	}
+	return n, nil
+}
+
+// writeHint stores the hint, unless that would take more than the cap. A
+// newer hint for the same file replaces the old one.
+func (s *store) writeHint(h *hint) error {
+	used, err := s.hintBytes()
+	if err != nil {
+		return err
+	}
+	if used+h.Size > maxHintBytes {
+		return fmt.Errorf("hints are full, %d of %d bytes used", used, maxHintBytes)
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(h); err != nil {
+		return err
+	}
+
+	key := hintKey(h.Target, h.ID, h.Key)
+	old, _ := s.readHint(s.name(key))
+
+	if _, err := s.Write(hintNamespace, key, buf); err != nil {
+		return err
+	}
+
+	s.acquirePieces(h.Pieces)
+	if old != nil {
+		s.releasePieces(old.Pieces)
+	}
+	return nil
+}
+
+func (s *store) deleteHint(h *hint) error {
+	if err := s.Delete(hintNamespace, hintKey(h.Target, h.ID, h.Key)); err != nil {
+		return err
+	}
+	s.releasePieces(h.Pieces)
+	return nil
+}
+
+// sweepHints drops the hints older than the retention.
+func (s *store) sweepHints(retention time.Duration) (int, error) {
+	hints, err := s.hints("")
+	if err != nil {
+		return 0, err
+	}
+
+	deleted := 0
+	for _, h := range hints {
+		if time.Since(h.Created) < retention {
+			continue
+		}
+		if err := s.deleteHint(h); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// hintFor hands the write the target node missed to a live node, we keep it
+// ourselves if we are the one.
+func (s *FileServer) hintFor(standIn string, h *hint) error {
+	if standIn == s.ID {
+		return s.store.writeHint(h)
+	}
+
+	peer, ok := s.nodePeer(standIn)
+	if !ok {
+		return fmt.Errorf("node %s is not connected", standIn)
+	}
+
+	msg := Message{
+		Payload: MessageHint{
+			Target: h.Target,
+			ID:     h.ID,
+			Key:    h.Key,
+			Pieces: h.Pieces,
+			Size:   h.Size,
+		},
+	}
+	return s.send(peer, &msg)
+}
+
+// standIn returns the one of the live nodes that takes the writes of the
+// target for the key, none if there are no nodes.
+func (s *FileServer) standIn(target string, hkey string, nodes []string) string {
+	ranked := rankNodes(target+"/"+hkey, nodes)
+	if len(ranked) == 0 {
+		return ""
+	}
+	return ranked[0]
+}
+
+func (s *FileServer) handleMessageHint(from string, msg MessageHint) error {
+	h := &hint{
+		Target:  msg.Target,
+		ID:      msg.ID,
+		Key:     msg.Key,
+		Pieces:  msg.Pieces,
+		Size:    msg.Size,
+		Created: time.Now(),
+	}
+	if err := s.store.writeHint(h); err != nil {
+		return fmt.Errorf("[%s] refused hint of %s for %s: %v", s.Transport.Addr(), msg.Key, msg.Target, err)
+	}
+
+	fmt.Printf("[%s] holding (%s) for node %s\n", s.Transport.Addr(), msg.Key, msg.Target)
+
+	return nil
+}
+
+// replayHints hands the node that is back the writes it missed.
+func (s *FileServer) replayHints(target string) {
+	peer, ok := s.nodePeer(target)
+	if !ok {
+		return
+	}
+
+	hints, err := s.store.hints(target)
+	if err != nil {
+		log.Printf("[%s] failed to read the hints for %s: %v", s.Transport.Addr(), target, err)
+		return
+	}
+
+	for _, h := range hints {
+		if err := s.replayHint(peer, h); err != nil {
+			log.Printf("[%s] failed to replay %s to %s: %v", s.Transport.Addr(), h.Key, target, err)
+			continue
+		}
+		if err := s.store.deleteHint(h); err != nil {
+			log.Printf("[%s] failed to drop the hint of %s: %v", s.Transport.Addr(), h.Key, err)
+		}
+	}
+}
+
+func (s *FileServer) replayHint(peer p2p.Peer, h *hint) error {
+	m, err := s.store.ReadManifest(h.ID, h.Key)
+	if err != nil {
+		// the file is gone, so is the write the node missed
+		return nil
+	}
+
+	if _, err := s.repairReplica(peer, h.ID, m, true); err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] replayed (%s) to %s\n", s.Transport.Addr(), h.Key, peer.RemoteAddr())
+	return nil
+}
+
+// handOff leaves hints for every known node that is down during the write
+// of the manifest. live are the replicas the chunks of a replicated file were
+// sent to, only they can stand in for the ones that are down.
+func (s *FileServer) handOff(m *Manifest, live []string) {
+	// the replicas as if the nodes that are down were still there
+	replicas := placeWeighted(s.Owner, m.Key, s.memberList(), s.ReplicationFactor, m.Weights)
+
+	// the shards of a node that is down went to its stand-in among all of
+	// them already
+	if m.Durability.erasureCoded() {
+		live = s.nodeList()
+	}
+
+	for _, target := range s.downNodes() {
+		hashes, size := m.heldBy(target, replicas)
+		if len(hashes) == 0 {
+			continue
+		}
+
+		h := &hint{
+			Target:  target,
+			ID:      s.Owner,
+			Key:     m.Key,
+			Pieces:  hashes,
+			Size:    size,
+			Created: time.Now(),
+		}
+
+		standIn := s.standIn(target, m.Key, live)
+		if err := s.hintFor(standIn, h); err != nil {
+			log.Printf("[%s] failed to leave a hint of %s for %s: %v", s.Transport.Addr(), m.Key, target, err)
+		}
+	}
+}
+
+// replayLoop dials the nodes we hold hints for, the hello of a node that is
+// back replays them.
+func (s *FileServer) replayLoop() {
+	ticker := time.NewTicker(hintReplayInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			hints, err := s.store.hints("")
+			if err != nil {
+				log.Printf("[%s] failed to read the hints: %v", s.Transport.Addr(), err)
+				continue
+			}
+
+			dialed := make(map[string]bool)
+			for _, h := range hints {
+				if dialed[h.Target] {
+					continue
+				}
+				dialed[h.Target] = true
+
+				if _, ok := s.nodePeer(h.Target); ok {
+					go s.replayHints(h.Target)
+					continue
+				}
+				if addr, ok := s.memberAddr(h.Target); ok {
+					if err := s.Transport.Dial(addr); err != nil {
+						log.Printf("[%s] node %s is still down: %v", s.Transport.Addr(), h.Target, err)
+					}
+				}
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
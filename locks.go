@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// errFenced is returned for a write whose fencing token is older than the
+// one the file was last written with, its lease was taken over.
+var errFenced = fmt.Errorf("write fenced off by a newer lease")
+
+// lockState is a lock as the metadata service keeps it. A lock whose lease
+// expired is free, it stays in the state until it is taken again.
+type lockState struct {
+	Holder  string
+	Token   uint64
+	Expires time.Time
+}
+
+// Lease is a lock held for a while. Token is its fencing token, every time
+// the lock is taken it gets a higher one. Writes made with the lease carry
+// the token, so the replicas turn them down once a newer lease wrote the
+// file.
+type Lease struct {
+	Key    string
+	Holder string
+	Token  uint64
+	// Expires is when the lease runs out as far as the holder can tell,
+	// the metadata service lets it run a little longer.
+	Expires time.Time
+}
+
+// applyLock takes, renews or releases the lock of the command. The fencing
+// token of a lock is the index of the entry that took it.
+func (st metaState) applyLock(cmd metaCommand, index uint64) (uint64, string) {
+	l, held := st.Locks[cmd.Key]
+	held = held && cmd.Now.Before(l.Expires)
+
+	switch cmd.Op {
+	case metaAcquire:
+		if held && l.Holder != cmd.Holder {
+			return 0, fmt.Sprintf("lock %s is held until %s", cmd.Key, l.Expires.Format(time.RFC3339Nano))
+		}
+		if !held || l.Holder != cmd.Holder {
+			l = lockState{Holder: cmd.Holder, Token: index}
+		}
+		l.Expires = cmd.Now.Add(cmd.TTL)
+		st.Locks[cmd.Key] = l
+		return l.Token, ""
+	case metaRenew:
+		if !held || l.Holder != cmd.Holder {
+			return 0, fmt.Sprintf("the lease of lock %s expired", cmd.Key)
+		}
+		l.Expires = cmd.Now.Add(cmd.TTL)
+		st.Locks[cmd.Key] = l
+		return l.Token, ""
+	case metaRelease:
+		if l.Holder == cmd.Holder {
+			delete(st.Locks, cmd.Key)
+		}
+	case metaFence:
+		if !held || l.Holder != cmd.Holder || l.Token != cmd.Token {
+			return 0, fmt.Sprintf("token %d no longer holds lock %s", cmd.Token, cmd.Key)
+		}
+		return l.Token, ""
+	}
+	return 0, ""
+}
+
+// lockCommand commits the lock command and returns the fencing token.
+func (s *FileServer) lockCommand(cmd metaCommand) (uint64, error) {
+	if len(s.MetadataNodes) == 0 {
+		return 0, fmt.Errorf("[%s] locks need the metadata service", s.Transport.Addr())
+	}
+
+	rep, err := s.askMeta(func(reqID uint64) any {
+		return MessageMetaPropose{ReqID: reqID, Command: cmd}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	res := rep.(MessageMetaProposeResponse)
+	if res.Refused != "" {
+		return 0, fmt.Errorf("[%s] %s", s.Transport.Addr(), res.Refused)
+	}
+	return res.Token, nil
+}
+
+// checkLease tells if the lease still holds the lock of the key the write
+// goes to. The lock state decides, not the files: a lease that ran out or was
+// taken over is fenced off even from a file the newer holder never wrote.
+func (s *FileServer) checkLease(l *Lease, key string) error {
+	if l.Key != key {
+		return fmt.Errorf("[%s] the lease is for lock %s, not for %s", s.Transport.Addr(), l.Key, key)
+	}
+	if len(s.MetadataNodes) == 0 {
+		return fmt.Errorf("[%s] locks need the metadata service", s.Transport.Addr())
+	}
+
+	cmd := metaCommand{Op: metaFence, Key: l.Key, Holder: l.Holder, Token: l.Token}
+	rep, err := s.askMeta(func(reqID uint64) any {
+		return MessageMetaPropose{ReqID: reqID, Command: cmd}
+	})
+	if err != nil {
+		return err
+	}
+	if res := rep.(MessageMetaProposeResponse); res.Refused != "" {
+		return fmt.Errorf("[%s] %w: %s", s.Transport.Addr(), errFenced, res.Refused)
+	}
+	return nil
+}
+
+// AcquireLock takes the lock for the ttl, unless somebody else holds it.
+func (s *FileServer) AcquireLock(key string, ttl time.Duration) (Lease, error) {
+	// the lease runs from before we asked, the service starts it later
+	start := time.Now()
+	holder := generateID()
+
+	token, err := s.lockCommand(metaCommand{Op: metaAcquire, Key: key, Holder: holder, TTL: ttl})
+	if err != nil {
+		return Lease{}, err
+	}
+	return Lease{Key: key, Holder: holder, Token: token, Expires: start.Add(ttl)}, nil
+}
+
+// RenewLock extends the lease for another ttl, if it did not expire yet.
+func (s *FileServer) RenewLock(l Lease, ttl time.Duration) (Lease, error) {
+	start := time.Now()
+
+	token, err := s.lockCommand(metaCommand{Op: metaRenew, Key: l.Key, Holder: l.Holder, TTL: ttl})
+	if err != nil {
+		return Lease{}, err
+	}
+	l.Token, l.Expires = token, start.Add(ttl)
+	return l, nil
+}
+
+// ReleaseLock gives the lock up, a lease that expired already is a no-op.
+func (s *FileServer) ReleaseLock(l Lease) error {
+	_, err := s.lockCommand(metaCommand{Op: metaRelease, Key: l.Key, Holder: l.Holder})
+	return err
+}
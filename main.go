@@ -42,6 +42,7 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 	// Create the file server
 	s := NewFileServer(fileServerOpts)
 	tcpTransport.OnPeer = s.OnPeer
+	tcpTransport.OnPeerLost = s.OnPeerLost
 	return s
 }
 func main() {
@@ -74,7 +75,7 @@ func main() {
 
 		s3.Store(key, data)
 
-		if err := s3.store.Delete(s3.ID, key); err != nil {
+		if err := s3.store.DeleteManifest(s3.ID, hashKey(key)); err != nil {
 			log.Fatal(err)
 		}
 
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"slices"
+	"time"
+)
+
+// Manifest is the object stored under the key of a file. The bytes of the
+// file itself live in the chunks it lists, every chunk is a CAS object of its
+// own in the chunk pool of the store.
+type Manifest struct {
+	Key    string
+	Size   int64
+	Chunks []ChunkRef
+	// Durability tells if the chunks are replicated or erasure coded.
+	Durability Durability
+	// Version orders the writes of the key, the newest one wins.
+	Version int64
+	// Clock tells which writes of the key this one saw, a write that did
+	// not see the current one is kept next to it as a sibling.
+	Clock VersionVector
+	// Fence is the highest fencing token the key was written with, a
+	// write with a lower one is turned down.
+	Fence uint64
+	// Expires is when the file runs out its time to live, if it has one.
+	// Deleted marks the tombstone of an expired file.
+	Expires time.Time
+	Deleted bool
+	// Created is when the version was written.
+	Created time.Time
+	// Versioned files keep the versions they replace for as long as
+	// Retention says.
+	Versioned bool
+	Retention Retention
+	// Weights are the weights of the nodes the replicas were placed with
+	// when the file was written, see FileServer.spaceWeights. The free
+	// space of the nodes changing later does not move the file.
+	Weights map[string]float64
+}
+
+type ChunkRef struct {
+	// Hash is the hash of the encrypted chunk, it's what the chunk is
+	// stored under on every node.
+	Hash string
+	Size int64
+	// Key is the convergent key of the chunk sealed with the key of the
+	// owner, only the owner can read the chunk.
+	Key []byte
+	// Shards are the hashes of the erasure coded shards of the encrypted
+	// chunk, Nodes the ids of the nodes they were placed on. Both are empty
+	// for replicated chunks.
+	Shards []string
+	Nodes  []string
+}
+
+// chunkKey is the store key of the chunk with the given hash.
+func chunkKey(hash string) string {
+	return "chunk:" + hash
+}
+
+// checksum is the hash of what the manifest says about the file, two
+// manifests with the same checksum describe the same bytes.
+func (m *Manifest) checksum() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s/%d/%d", m.Key, m.Size, m.Version)
+	for _, c := range m.Chunks {
+		fmt.Fprintf(h, "/%s", c.Hash)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newerThan tells if m wins over other, which may be nil. Two different
+// writes with the same version are ordered by checksum, so every node picks
+// the same one.
+func (m *Manifest) newerThan(other *Manifest) bool {
+	if m == nil {
+		return false
+	}
+	if other == nil || m.Version != other.Version {
+		return other == nil || m.Version > other.Version
+	}
+	return m.checksum() > other.checksum()
+}
+
+func (m *Manifest) sameVersion(other *Manifest) bool {
+	return other != nil && m.Version == other.Version && m.checksum() == other.checksum()
+}
+
+func (m *Manifest) Encode() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeManifest(r io.Reader) (*Manifest, error) {
+	m := new(Manifest)
+	if err := gob.NewDecoder(r).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WriteManifest stores the manifest under its key and moves the chunk
+// references from the manifests it replaces over to the new one. It replaces
+// the versions its clock descends from, the ones it is concurrent with stay
+// as its siblings and the newest of them all is the one under the key.
+func (s *store) WriteManifest(id string, m *Manifest) error {
+	s.manifestLock.Lock()
+	defer s.manifestLock.Unlock()
+
+	old, _ := s.ReadManifest(id, m.Key)
+	siblings, err := s.readSiblings(id, m.Key)
+	if err != nil {
+		return err
+	}
+	known := siblings
+	if old != nil {
+		known = append([]*Manifest{old}, siblings...)
+	}
+
+	var kept, replaced []*Manifest
+	for _, k := range known {
+		switch {
+		case k.Clock.equal(m.Clock):
+			// the same write, or writes from before the clocks
+			if !m.newerThan(k) {
+				return nil
+			}
+			replaced = append(replaced, k)
+		case k.Clock.descends(m.Clock):
+			// a newer write got here first
+			return nil
+		case m.Clock.descends(k.Clock):
+			replaced = append(replaced, k)
+		default:
+			kept = append(kept, k)
+		}
+	}
+	for _, k := range known {
+		if m.Fence < k.Fence {
+			return fmt.Errorf("%w: token %d of %s is older than %d", errFenced, m.Fence, m.Key, k.Fence)
+		}
+	}
+
+	cur, rest := lastWriter(append(kept, m))
+	if err := s.usage.admit(s.Quotas, id, old, cur); err != nil {
+		return err
+	}
+	if cur != old {
+		b, err := cur.Encode()
+		if err != nil {
+			return err
+		}
+		if _, err := s.Write(id, m.Key, bytes.NewReader(b)); err != nil {
+			return err
+		}
+	}
+	if len(rest) > 0 || len(siblings) > 0 {
+		if err := s.writeSiblings(id, m.Key, rest); err != nil {
+			return err
+		}
+	}
+	if len(kept) > 0 {
+		log.Printf("keeping (%d) concurrent versions of %s", len(rest)+1, m.Key)
+	}
+
+	s.acquireChunks(m)
+	for _, k := range replaced {
+		if !m.Versioned {
+			s.releaseChunks(k)
+			continue
+		}
+		// the old version keeps its references in the history
+		if err := s.archiveVersion(id, k, m); err != nil {
+			log.Printf("failed to keep version %s of %s: %v", versionID(k.Version), m.Key, err)
+			s.releaseChunks(k)
+		}
+	}
+	s.tree.put(newMerkleEntry(id, cur))
+	s.usage.change(id, old, cur)
+	s.manifestChanged(id, m.Key)
+
+	return nil
+}
+
+// nextVersion returns a version for a new write of the key that is newer
+// than the one we have. The clock keeps versions of different nodes roughly
+// in the order they were written.
+func (s *store) nextVersion(id string, key string) int64 {
+	version := time.Now().UnixNano()
+	if old, err := s.ReadManifest(id, key); err == nil && old.Version >= version {
+		version = old.Version + 1
+	}
+	return version
+}
+
+func (s *store) ReadManifest(id string, key string) (*Manifest, error) {
+	_, r, err := s.readStream(id, key)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return decodeManifest(r)
+}
+
+// DeleteManifest deletes the manifest and the chunks that were only used by
+// it.
+func (s *store) DeleteManifest(id string, key string) error {
+	s.manifestLock.Lock()
+	defer s.manifestLock.Unlock()
+
+	m, err := s.ReadManifest(id, key)
+	if err != nil {
+		return err
+	}
+
+	if err := s.Delete(id, key); err != nil {
+		return err
+	}
+
+	s.releaseChunks(m)
+	s.tree.remove(id, key)
+	s.usage.change(id, m, nil)
+	s.manifestChanged(id, key)
+
+	// the siblings and old versions go with the file
+	siblings, err := s.readSiblings(id, key)
+	if err != nil {
+		return err
+	}
+	if err := s.writeSiblings(id, key, nil); err != nil {
+		return err
+	}
+	for _, sibling := range siblings {
+		s.releaseChunks(sibling)
+	}
+	return s.deleteHistory(id, key)
+}
+
+// heldBy returns the chunks, or shards, of the manifest the node is supposed
+// to hold and how many bytes they are. Replicated chunks are held by the
+// replicas, shards by the node they were placed on.
+func (m *Manifest) heldBy(node string, replicas []string) ([]string, int64) {
+	var (
+		hashes  = []string{}
+		size    int64
+		replica = slices.Contains(replicas, node)
+	)
+	for _, c := range m.Chunks {
+		if len(c.Shards) == 0 {
+			if !replica {
+				continue
+			}
+			hashes = append(hashes, c.Hash)
+			size += c.Size
+			continue
+		}
+		shardSize := (c.Size + int64(m.Durability.DataShards) - 1) / int64(m.Durability.DataShards)
+		for i, hash := range c.Shards {
+			if i < len(c.Nodes) && c.Nodes[i] == node {
+				hashes = append(hashes, hash)
+				size += shardSize
+			}
+		}
+	}
+	return hashes, size
+}
+
+// missingHeld returns the chunks, or shards, of the manifest the node is
+// supposed to hold but we don't have on disk.
+func (s *store) missingHeld(m *Manifest, node string, replicas []string) []string {
+	hashes, _ := m.heldBy(node, replicas)
+
+	missing := []string{}
+	for _, hash := range hashes {
+		if !s.HasChunk(hash) {
+			missing = append(missing, hash)
+		}
+	}
+	return missing
+}
+
+// missingChunks returns the chunks we don't have on disk, every chunk only
+// once.
+func (s *store) missingChunks(chunks []ChunkRef) []ChunkRef {
+	var (
+		missing = []ChunkRef{}
+		seen    = make(map[string]bool)
+	)
+	for _, c := range chunks {
+		if !seen[c.Hash] && !s.HasChunk(c.Hash) {
+			missing = append(missing, c)
+		}
+		seen[c.Hash] = true
+	}
+	return missing
+}
+
+// chunkSpan is the part [from, to) of a chunk a read needs.
+type chunkSpan struct {
+	ref      ChunkRef
+	from, to int64
+}
+
+func (c chunkSpan) whole() bool {
+	return c.from == 0 && c.to == c.ref.Size
+}
+
+func spannedChunks(spans []chunkSpan) []ChunkRef {
+	chunks := make([]ChunkRef, len(spans))
+	for i, span := range spans {
+		chunks[i] = span.ref
+	}
+	return chunks
+}
+
+// spans returns the parts of the chunks that hold length bytes of the file
+// from offset on. A length of zero or less reads to the end of the file.
+func (m *Manifest) spans(offset int64, length int64) ([]chunkSpan, error) {
+	if offset < 0 || offset > m.Size {
+		return nil, fmt.Errorf("offset %d is out of the %d bytes of %s", offset, m.Size, m.Key)
+	}
+
+	end := m.Size
+	if length > 0 && offset+length < end {
+		end = offset + length
+	}
+
+	spans := []chunkSpan{}
+	var pos int64
+	for _, c := range m.Chunks {
+		from, to := max(offset, pos), min(end, pos+c.Size)
+		if from < to {
+			spans = append(spans, chunkSpan{ref: c, from: from - pos, to: to - pos})
+		}
+		pos += c.Size
+	}
+	return spans, nil
+}
+
+// manifestReader reads and decrypts the chunks of a manifest one after the
+// other, a chunk file is only opened once the previous one is drained. Every
+// chunk that is read as a whole is checked against the key it was encrypted
+// with, which is the hash of its content, so whatever comes out is what was
+// stored. Parts of a chunk are found by seeking, the chunks are the unit a
+// read can start at without decrypting what comes before.
+type manifestReader struct {
+	store  *store
+	enckey []byte
+	spans  []chunkSpan
+	cur    io.Reader
+	file   io.Closer
+	key    []byte
+	hash   hash.Hash
+}
+
+func (s *store) newManifestReader(enckey []byte, m *Manifest) *manifestReader {
+	spans, _ := m.spans(0, 0)
+	return s.newSpanReader(enckey, spans)
+}
+
+func (s *store) newSpanReader(enckey []byte, spans []chunkSpan) *manifestReader {
+	return &manifestReader{
+		store:  s,
+		enckey: enckey,
+		spans:  spans,
+	}
+}
+
+func (r *manifestReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.spans) == 0 {
+				return 0, io.EOF
+			}
+			if err := r.next(); err != nil {
+				return 0, err
+			}
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			r.file.Close()
+			r.cur = nil
+			if r.hash != nil && !bytes.Equal(r.hash.Sum(nil), r.key) {
+				return n, fmt.Errorf("content of a chunk does not match its key")
+			}
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *manifestReader) next() error {
+	span := r.spans[0]
+
+	key, err := openKey(r.enckey, span.ref.Key)
+	if err != nil {
+		return err
+	}
+
+	f, err := r.store.ReadChunkAt(span.ref.Hash, span.from, span.to-span.from)
+	if err != nil {
+		return err
+	}
+
+	cur, err := newChunkDecrypterAt(key, f, span.from)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.hash = nil
+	if span.whole() {
+		r.hash = sha256.New()
+		cur = io.TeeReader(cur, r.hash)
+	}
+	r.cur, r.file, r.key = cur, f, key
+	r.spans = r.spans[1:]
+	return nil
+}
+
+func (r *manifestReader) Close() error {
+	if r.cur != nil {
+		r.cur = nil
+		return r.file.Close()
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// merkleDepth is how many hex digits of the position of an entry select
+// its leaf, 16^3 leaves keep them small for any store we expect.
+const merkleDepth = 3
+
+const hexDigits = "0123456789abcdef"
+
+// MerkleEntry is what the tree knows about a manifest in the store.
+type MerkleEntry struct {
+	ID       string
+	Key      string
+	Version  int64
+	Checksum string
+}
+
+func newMerkleEntry(id string, m *Manifest) MerkleEntry {
+	return MerkleEntry{
+		ID:       id,
+		Key:      m.Key,
+		Version:  m.Version,
+		Checksum: m.checksum(),
+	}
+}
+
+// newerThan tells if the entry describes a newer write than the manifest,
+// the same way Manifest.newerThan does.
+func (e MerkleEntry) newerThan(m *Manifest) bool {
+	if m == nil || e.Version != m.Version {
+		return m == nil || e.Version > m.Version
+	}
+	return e.Checksum > m.checksum()
+}
+
+// merklePosition is where the manifest of the key of the owner sits in the
+// tree, the same on every node.
+func merklePosition(id string, key string) string {
+	h := sha256.Sum256([]byte(id + "/" + key))
+	return hex.EncodeToString(h[:])
+}
+
+// merkleTree hashes the (owner, key, version) of every manifest in the store
+// into a tree of hex prefixes. Two nodes with the same root have the same
+// manifests, if they differ only the subtrees with different hashes have
+// to be compared.
+type merkleTree struct {
+	mu     sync.Mutex
+	leaves map[string]map[string]MerkleEntry
+	// hashes caches the hash of every prefix, an update drops the hashes
+	// on the path to its leaf.
+	hashes map[string][]byte
+}
+
+func newMerkleTree() *merkleTree {
+	return &merkleTree{
+		leaves: make(map[string]map[string]MerkleEntry),
+		hashes: make(map[string][]byte),
+	}
+}
+
+func (t *merkleTree) put(e MerkleEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pos := merklePosition(e.ID, e.Key)
+	leaf := pos[:merkleDepth]
+	if t.leaves[leaf] == nil {
+		t.leaves[leaf] = make(map[string]MerkleEntry)
+	}
+	t.leaves[leaf][pos] = e
+	t.invalidate(leaf)
+}
+
+func (t *merkleTree) remove(id string, key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pos := merklePosition(id, key)
+	leaf := pos[:merkleDepth]
+	delete(t.leaves[leaf], pos)
+	if len(t.leaves[leaf]) == 0 {
+		delete(t.leaves, leaf)
+	}
+	t.invalidate(leaf)
+}
+
+func (t *merkleTree) get(id string, key string) (MerkleEntry, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	pos := merklePosition(id, key)
+	e, ok := t.leaves[pos[:merkleDepth]][pos]
+	return e, ok
+}
+
+func (t *merkleTree) invalidate(leaf string) {
+	for i := 0; i <= len(leaf); i++ {
+		delete(t.hashes, leaf[:i])
+	}
+}
+
+// hash returns the hash of the subtree of the prefix.
+func (t *merkleTree) hash(prefix string) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.hashLocked(prefix)
+}
+
+func (t *merkleTree) hashLocked(prefix string) []byte {
+	if h, ok := t.hashes[prefix]; ok {
+		return h
+	}
+
+	h := sha256.New()
+	if len(prefix) == merkleDepth {
+		for _, e := range t.entriesLocked(prefix) {
+			fmt.Fprintf(h, "%s/%s/%d/%s\n", e.ID, e.Key, e.Version, e.Checksum)
+		}
+	} else {
+		for _, c := range hexDigits {
+			h.Write(t.hashLocked(prefix + string(c)))
+		}
+	}
+
+	sum := h.Sum(nil)
+	t.hashes[prefix] = sum
+	return sum
+}
+
+// all returns every entry of the tree.
+func (t *merkleTree) all() []MerkleEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entries := []MerkleEntry{}
+	for _, leaf := range t.leaves {
+		for _, e := range leaf {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// entries returns the entries of the leaf in the order of their position.
+func (t *merkleTree) entries(leaf string) []MerkleEntry {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.entriesLocked(leaf)
+}
+
+func (t *merkleTree) entriesLocked(leaf string) []MerkleEntry {
+	positions := make([]string, 0, len(t.leaves[leaf]))
+	for pos := range t.leaves[leaf] {
+		positions = append(positions, pos)
+	}
+	sort.Strings(positions)
+
+	entries := make([]MerkleEntry, len(positions))
+	for i, pos := range positions {
+		entries[i] = t.leaves[leaf][pos]
+	}
+	return entries
+}
+
+// childPrefixes returns the prefixes one level below the given ones.
+func childPrefixes(prefixes []string) []string {
+	children := make([]string, 0, len(prefixes)*len(hexDigits))
+	for _, p := range prefixes {
+		for _, c := range hexDigits {
+			children = append(children, p+string(c))
+		}
+	}
+	return children
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMerkleTreeFindsDifferentLeaves(t *testing.T) {
+	a, b := newMerkleTree(), newMerkleTree()
+
+	for _, key := range []string{"one", "two", "three"} {
+		e := MerkleEntry{ID: "owner", Key: key, Version: 1, Checksum: key}
+		a.put(e)
+		b.put(e)
+	}
+	if !bytes.Equal(a.hash(""), b.hash("")) {
+		t.Fatal("same entries have different roots")
+	}
+
+	b.put(MerkleEntry{ID: "owner", Key: "two", Version: 2, Checksum: "two"})
+	if bytes.Equal(a.hash(""), b.hash("")) {
+		t.Fatal("a newer version did not change the root")
+	}
+
+	// walk down the differing prefixes like syncWith does
+	prefixes := []string{""}
+	for {
+		differ := []string{}
+		for _, p := range prefixes {
+			if !bytes.Equal(a.hash(p), b.hash(p)) {
+				differ = append(differ, p)
+			}
+		}
+		if len(differ) != 1 {
+			t.Fatalf("%d prefixes differ, want 1", len(differ))
+		}
+		if len(differ[0]) == merkleDepth {
+			if differ[0] != merklePosition("owner", "two")[:merkleDepth] {
+				t.Fatalf("leaf %s differs, want the one of two", differ[0])
+			}
+			break
+		}
+		prefixes = childPrefixes(differ)
+	}
+
+	b.remove("owner", "two")
+	a.remove("owner", "two")
+	if !bytes.Equal(a.hash(""), b.hash("")) {
+		t.Fatal("same entries have different roots after removing")
+	}
+}
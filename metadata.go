@@ -0,0 +1,423 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+	"slices"
+	"sort"
+	"time"
+)
+
+// catalogVersions is how many versions of a file the catalog remembers.
+const catalogVersions = 16
+
+// CatalogVersion is a version of a file and the nodes that hold it, the
+// replicas of a replicated file or the nodes with its shards.
+type CatalogVersion struct {
+	Version  int64
+	Replicas []string
+}
+
+// CatalogEntry is what the metadata service knows of the file of an owner,
+// its versions oldest first.
+type CatalogEntry struct {
+	ID       string
+	Key      string
+	Versions []CatalogVersion
+}
+
+// Current returns the newest version of the file.
+func (e CatalogEntry) Current() CatalogVersion {
+	if len(e.Versions) == 0 {
+		return CatalogVersion{}
+	}
+	return e.Versions[len(e.Versions)-1]
+}
+
+type metaOp int
+
+const (
+	// metaNoop is what a new leader commits the entries of earlier terms
+	// with.
+	metaNoop metaOp = iota
+	metaPut
+	metaDelete
+	metaAcquire
+	metaRenew
+	metaRelease
+	// metaFence checks that a lease still holds its lock, for a write
+	// made with it.
+	metaFence
+)
+
+// metaCommand is a change of the state, the entries of the raft log. The
+// lock commands name the lock in Key.
+type metaCommand struct {
+	Op       metaOp
+	ID       string
+	Key      string
+	Version  int64
+	Replicas []string
+	Holder   string
+	TTL      time.Duration
+	Token    uint64
+	// Now is when the leader took the command, leases run on its clock.
+	Now time.Time
+}
+
+// metaState is what the raft log builds up, the catalog of the files and the
+// locks.
+type metaState struct {
+	Catalog map[string]CatalogEntry
+	Locks   map[string]lockState
+}
+
+func newMetaState() metaState {
+	return metaState{
+		Catalog: make(map[string]CatalogEntry),
+		Locks:   make(map[string]lockState),
+	}
+}
+
+func (st metaState) clone() metaState {
+	c := newMetaState()
+	maps.Copy(c.Catalog, st.Catalog)
+	maps.Copy(c.Locks, st.Locks)
+	return c
+}
+
+// apply changes the state as the command at the index of the log says and
+// returns the fencing token of a lock command, or why it was refused.
+// Entries are replaced and never changed in place, the leader hands them out
+// without its lock.
+func (st metaState) apply(cmd metaCommand, index uint64) (uint64, string) {
+	k := historyKey(cmd.ID, cmd.Key)
+	switch cmd.Op {
+	case metaPut:
+		e := st.Catalog[k]
+		e.ID, e.Key = cmd.ID, cmd.Key
+		versions := slices.DeleteFunc(slices.Clone(e.Versions), func(v CatalogVersion) bool {
+			return v.Version == cmd.Version
+		})
+		versions = append(versions, CatalogVersion{Version: cmd.Version, Replicas: cmd.Replicas})
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+		if len(versions) > catalogVersions {
+			versions = versions[len(versions)-catalogVersions:]
+		}
+		e.Versions = versions
+		st.Catalog[k] = e
+	case metaDelete:
+		delete(st.Catalog, k)
+	case metaAcquire, metaRenew, metaRelease, metaFence:
+		return st.applyLock(cmd, index)
+	}
+	return 0, ""
+}
+
+type MessageRequestVote struct {
+	Term      uint64
+	LastIndex uint64
+	LastTerm  uint64
+}
+
+type MessageRequestVoteResponse struct {
+	Term    uint64
+	Granted bool
+}
+
+// MessageAppendEntries carries the entries of the log after PrevIndex, none
+// for a heartbeat.
+type MessageAppendEntries struct {
+	Term      uint64
+	PrevIndex uint64
+	PrevTerm  uint64
+	Entries   []logEntry
+	Commit    uint64
+	// Round is the heartbeat round of the leader, the follower sends it
+	// back so the leader knows which lookups it may answer.
+	Round uint64
+}
+
+// MessageAppendEntriesResponse answers appends and snapshots, Match is the
+// last index the follower has in common with the leader, or a hint where to
+// continue if it failed. Round is the one of the message it answers.
+type MessageAppendEntriesResponse struct {
+	Term    uint64
+	Success bool
+	Match   uint64
+	Round   uint64
+}
+
+// MessageInstallSnapshot replaces the log of a follower that is too far
+// behind with the state as of LastIndex.
+type MessageInstallSnapshot struct {
+	Term      uint64
+	LastIndex uint64
+	LastTerm  uint64
+	State     metaState
+	Round     uint64
+}
+
+// MessageMetaPropose asks a metadata node to commit the command, only the
+// leader does.
+type MessageMetaPropose struct {
+	ReqID   uint64
+	Command metaCommand
+}
+
+// MessageMetaProposeResponse tells if the command was committed. A node
+// that is not the leader tells who is, if it knows. Token and Refused are
+// the outcome of a lock command.
+type MessageMetaProposeResponse struct {
+	ReqID   uint64
+	Leader  string
+	Err     string
+	Token   uint64
+	Refused string
+}
+
+type MessageMetaLookup struct {
+	ReqID uint64
+	ID    string
+	Key   string
+}
+
+type MessageMetaLookupResponse struct {
+	ReqID  uint64
+	Leader string
+	Err    string
+	Found  bool
+	Entry  CatalogEntry
+}
+
+func (m MessageMetaProposeResponse) answer() (string, string) { return m.Leader, m.Err }
+func (m MessageMetaLookupResponse) answer() (string, string)  { return m.Leader, m.Err }
+
+// metaAnswer is an answer of a metadata node, which may send us on to the
+// leader.
+type metaAnswer interface {
+	answer() (leader string, err string)
+}
+
+// handleRaft hands the message of another metadata node to our raft.
+func (s *FileServer) handleRaft(from string, payload any) error {
+	if s.meta == nil {
+		return fmt.Errorf("[%s] got %T from %s, we are not a metadata node", s.Transport.Addr(), payload, from)
+	}
+	node := s.peerNode(from)
+	if node == "" {
+		return fmt.Errorf("[%s] got %T from %s before its hello", s.Transport.Addr(), payload, from)
+	}
+
+	var envs []envelope
+	switch v := payload.(type) {
+	case MessageRequestVote:
+		envs = s.meta.handleRequestVote(node, v)
+	case MessageRequestVoteResponse:
+		envs = s.meta.handleVoteResponse(node, v)
+	case MessageAppendEntries:
+		envs = s.meta.handleAppendEntries(node, v)
+	case MessageAppendEntriesResponse:
+		envs = s.meta.handleAppendResponse(node, v)
+	case MessageInstallSnapshot:
+		envs = s.meta.handleInstallSnapshot(node, v)
+	case MessageMetaPropose:
+		envs = s.meta.propose(node, v)
+	case MessageMetaLookup:
+		envs = s.meta.lookup(node, v)
+	}
+	s.deliver(envs)
+	return nil
+}
+
+// deliver sends what our raft has to say, answers to our own requests are
+// resolved right here.
+func (s *FileServer) deliver(envs []envelope) {
+	for _, env := range envs {
+		if env.to == s.ID {
+			go s.handleMessage("", &Message{Payload: env.payload})
+			continue
+		}
+		peer, ok := s.nodePeer(env.to)
+		if !ok {
+			continue
+		}
+		if err := s.send(peer, &Message{Payload: env.payload}); err != nil {
+			log.Printf("[%s] failed to send %T to %s: %v", s.Transport.Addr(), env.payload, env.to, err)
+		}
+	}
+}
+
+func (s *FileServer) raftLoop() {
+	ticker := time.NewTicker(heartbeatInterval / 5)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			s.deliver(s.meta.tick(now))
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// askMeta sends the request built for the request id to the metadata nodes,
+// following them to the leader, and returns the answer of the leader.
+func (s *FileServer) askMeta(build func(reqID uint64) any) (any, error) {
+	var (
+		deadline = time.Now().Add(requestTimeout)
+		target   = s.metaLeader.Load().(string)
+		tried    = 0
+	)
+	for time.Now().Before(deadline) {
+		node := target
+		if node == "" {
+			node = s.MetadataNodes[tried%len(s.MetadataNodes)]
+			tried++
+		}
+		target = ""
+
+		rep := s.askMetaNode(node, build, time.Until(deadline))
+		if rep != nil {
+			leader, err := rep.(metaAnswer).answer()
+			if err == "" {
+				s.metaLeader.Store(node)
+				return rep, nil
+			}
+			if leader != "" && leader != node {
+				target = leader
+				continue
+			}
+		}
+
+		// the node is down or there is no leader yet, an election may be
+		// going on
+		select {
+		case <-time.After(heartbeatInterval):
+		case <-s.quitch:
+			return nil, errShuttingDown
+		}
+	}
+	s.metaLeader.Store("")
+	return nil, fmt.Errorf("[%s] no metadata leader answered in time", s.Transport.Addr())
+}
+
+// askMetaNode sends the request to the metadata node and waits for its
+// answer, nil if it did not answer.
+func (s *FileServer) askMetaNode(node string, build func(reqID uint64) any, timeout time.Duration) any {
+	req := s.newRequest()
+	defer s.finishRequest(req)
+
+	payload := build(req.id)
+	if node == s.ID && s.meta != nil {
+		go s.handleRaftLocal(payload)
+	} else {
+		peer, ok := s.nodePeer(node)
+		if !ok {
+			return nil
+		}
+		if err := s.send(peer, &Message{Payload: payload}); err != nil {
+			return nil
+		}
+	}
+
+	timer := time.NewTimer(min(timeout, time.Second))
+	defer timer.Stop()
+
+	rep := req.wait(timer)
+	if rep == nil {
+		return nil
+	}
+	rep.Close()
+	return rep.payload
+}
+
+// handleRaftLocal hands a request of our own to our raft.
+func (s *FileServer) handleRaftLocal(payload any) {
+	switch v := payload.(type) {
+	case MessageMetaPropose:
+		s.deliver(s.meta.propose(s.ID, v))
+	case MessageMetaLookup:
+		s.deliver(s.meta.lookup(s.ID, v))
+	}
+}
+
+// recordMeta commits the version of the file of the owner and the nodes
+// that hold it to the catalog, if the cluster has a metadata service. The
+// file is stored either way, a failure is only logged.
+func (s *FileServer) recordMeta(id string, m *Manifest, replicas []string) {
+	if len(s.MetadataNodes) == 0 {
+		return
+	}
+
+	cmd := metaCommand{
+		Op:       metaPut,
+		ID:       id,
+		Key:      m.Key,
+		Version:  m.Version,
+		Replicas: m.locations(replicas),
+	}
+	_, err := s.askMeta(func(reqID uint64) any {
+		return MessageMetaPropose{ReqID: reqID, Command: cmd}
+	})
+	if err != nil {
+		log.Printf("[%s] failed to record version %s of %s in the catalog: %v", s.Transport.Addr(), versionID(m.Version), m.Key, err)
+	}
+}
+
+// forgetMeta drops the file of the owner from the catalog.
+func (s *FileServer) forgetMeta(id string, hkey string) {
+	if len(s.MetadataNodes) == 0 {
+		return
+	}
+
+	cmd := metaCommand{Op: metaDelete, ID: id, Key: hkey}
+	_, err := s.askMeta(func(reqID uint64) any {
+		return MessageMetaPropose{ReqID: reqID, Command: cmd}
+	})
+	if err != nil {
+		log.Printf("[%s] failed to drop %s from the catalog: %v", s.Transport.Addr(), hkey, err)
+	}
+}
+
+// locations returns the nodes that hold the chunks of the file, the replicas
+// or the nodes its shards were placed on.
+func (m *Manifest) locations(replicas []string) []string {
+	if !m.Durability.erasureCoded() {
+		return slices.Clone(replicas)
+	}
+	nodes := []string{}
+	for _, c := range m.Chunks {
+		for _, node := range c.Nodes {
+			if !slices.Contains(nodes, node) {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+// Locate asks the metadata service which versions of the file exist and
+// where they are, the last one is the current one.
+func (s *FileServer) Locate(key string) (CatalogEntry, error) {
+	if len(s.MetadataNodes) == 0 {
+		return CatalogEntry{}, fmt.Errorf("[%s] the cluster has no metadata service", s.Transport.Addr())
+	}
+
+	hkey := hashKey(key)
+	rep, err := s.askMeta(func(reqID uint64) any {
+		return MessageMetaLookup{ReqID: reqID, ID: s.Owner, Key: hkey}
+	})
+	if err != nil {
+		return CatalogEntry{}, err
+	}
+
+	res := rep.(MessageMetaLookupResponse)
+	if !res.Found {
+		return CatalogEntry{}, fmt.Errorf("[%s] file (%s) is not in the catalog", s.Transport.Addr(), key)
+	}
+	return res.Entry, nil
+}
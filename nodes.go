@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/pavanmanikanta98/dfs-with-go/p2p"
+)
+
+// MessageHello is the first thing a node sends on a new connection. Peers
+// only know each other by the address of the connection, which is different
+// on both ends, the id is what the nodes agree on.
+type MessageHello struct {
+	ID   string
+	Addr string
+	// Leaving is set by a node that is being decommissioned.
+	Leaving bool
+	// Capacity is how much space the node has, see MessageCapacity for
+	// when it changes.
+	Capacity Capacity
+}
+
+func (s *FileServer) sendHello(peer p2p.Peer) error {
+	msg := Message{
+		Payload: MessageHello{
+			ID:       s.ID,
+			Addr:     s.Transport.Addr(),
+			Leaving:  s.leaving.Load(),
+			Capacity: s.capacity(),
+		},
+	}
+	return s.send(peer, &msg)
+}
+
+func (s *FileServer) handleMessageHello(from string, msg MessageHello) error {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if _, ok := s.peers[from]; !ok || msg.ID == s.ID {
+		return nil
+	}
+
+	s.nodes[msg.ID] = from
+	s.peerNodes[from] = msg.ID
+	s.capacities[msg.ID] = msg.Capacity
+	if msg.Leaving {
+		s.leavingNodes[msg.ID] = true
+		return nil
+	}
+	delete(s.leavingNodes, msg.ID)
+	s.members[msg.ID] = msg.Addr
+
+	log.Printf("[%s] peer %s is node %s listening on %s", s.Transport.Addr(), from, msg.ID, msg.Addr)
+
+	// the node may have missed writes while it was gone, and it may be a
+	// replica of files now.
+	go s.replayHints(msg.ID)
+	s.triggerRebalance()
+
+	return nil
+}
+
+// nodePeer returns the peer of the node with the id.
+func (s *FileServer) nodePeer(id string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addr, ok := s.nodes[id]
+	if !ok {
+		return nil, false
+	}
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
+
+// peerNode returns the id of the node of the peer.
+func (s *FileServer) peerNode(addr string) string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	return s.peerNodes[addr]
+}
+
+// nodeList returns the ids of all nodes we know, including our own. Nodes
+// that are leaving don't count, us neither if we are.
+func (s *FileServer) nodeList() []string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	ids := []string{}
+	if !s.leaving.Load() {
+		ids = append(ids, s.ID)
+	}
+	for id := range s.nodes {
+		if !s.leavingNodes[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// memberList returns the ids of all nodes we ever saw, connected or not,
+// including our own unless we are leaving.
+func (s *FileServer) memberList() []string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	ids := []string{}
+	if !s.leaving.Load() {
+		ids = append(ids, s.ID)
+	}
+	for id := range s.members {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// downNodes returns the members we are not connected with.
+func (s *FileServer) downNodes() []string {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	down := []string{}
+	for id := range s.members {
+		if _, ok := s.nodes[id]; !ok {
+			down = append(down, id)
+		}
+	}
+	return down
+}
+
+func (s *FileServer) memberAddr(id string) (string, bool) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	addr, ok := s.members[id]
+	return addr, ok
+}
+
+// rankNodes orders the nodes by how much they want the key (rendezvous
+// hashing). Every node ranks the same set the same way, and a node joining
+// or leaving only moves the keys it wins or held.
+func rankNodes(key string, nodes []string) []string {
+	score := func(node string) uint64 {
+		return rankScore(key, node)
+	}
+
+	ranked := append([]string{}, nodes...)
+	sort.Slice(ranked, func(i, j int) bool {
+		si, sj := score(ranked[i]), score(ranked[j])
+		if si != sj {
+			return si > sj
+		}
+		return ranked[i] < ranked[j]
+	})
+	return ranked
+}
+
+func rankScore(key string, node string) uint64 {
+	h := sha256.Sum256([]byte(key + "/" + node))
+	return binary.BigEndian.Uint64(h[:8])
+}
+
+// rankNodesWeighted orders the nodes like rankNodes, but a node with twice
+// the weight wins the key twice as often (weighted rendezvous hashing). Nodes
+// without a weight have a weight of one, with equal weights the order is the
+// one of rankNodes.
+func rankNodesWeighted(key string, nodes []string, weights map[string]float64) []string {
+	weight := func(node string) float64 {
+		if w, ok := weights[node]; ok {
+			return w
+		}
+		return 1
+	}
+	equal := true
+	for _, node := range nodes {
+		equal = equal && weight(node) == weight(nodes[0])
+	}
+	if equal {
+		return rankNodes(key, nodes)
+	}
+
+	score := func(node string) float64 {
+		// a uniform draw in (0, 1) from the hash
+		u := (float64(rankScore(key, node)>>11) + 0.5) / (1 << 53)
+		return weight(node) / -math.Log(u)
+	}
+
+	ranked := append([]string{}, nodes...)
+	sort.Slice(ranked, func(i, j int) bool {
+		si, sj := score(ranked[i]), score(ranked[j])
+		if si != sj {
+			return si > sj
+		}
+		return ranked[i] < ranked[j]
+	})
+	return ranked
+}
@@ -1,7 +1,9 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
@@ -17,6 +19,10 @@ func (dec GOBDecoder) Decode(r io.Reader, rpc *RPC) error {
 
 type DefaultDecoder struct{}
 
+// maxFrameSize bounds a single message frame so a corrupted length prefix
+// can not make us allocate the whole memory of the node.
+const maxFrameSize = 16 << 20
+
 func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 
 	peekBuf := make([]byte, 1)
@@ -25,25 +31,37 @@ func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 		return err
 	}
 
-	// In case of a stream we are not decoding what is being sent over the network
-	// we are just setting stream true so we can handle that in our logic
-	stream := peekBuf[0] == IncomingStream
-
-	if stream {
-		msg.Stream = true
-		return nil
+	// Every frame is prefixed with the length of its payload, so we read
+	// exactly one message and never eat bytes of the next one.
+	var size uint32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return err
+	}
+	if size > maxFrameSize {
+		return fmt.Errorf("frame of %d bytes exceeds the limit of %d bytes", size, maxFrameSize)
 	}
 
-	buf := make([]byte, 1028)
-	// buf := new(bytes.Buffer)
-
-	n, err := r.Read(buf)
-
-	if err != nil {
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
 	}
 
-	msg.Payload = buf[:n]
+	msg.Payload = buf
+
+	// In case of a stream the payload is only the header of the stream, the
+	// raw bytes are following on the connection and are consumed by whoever
+	// handles the header. We are just setting stream true so the read loop
+	// can wait for that in our logic
+	msg.Stream = peekBuf[0] == IncomingStream
 
 	return nil
 }
+
+// encodeFrame prefixes the payload with its kind and length.
+func encodeFrame(kind byte, payload []byte) []byte {
+	frame := make([]byte, 5+len(payload))
+	frame[0] = kind
+	binary.LittleEndian.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[5:], payload)
+	return frame
+}
@@ -3,6 +3,7 @@ package p2p
 import (
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"sync"
@@ -19,6 +20,10 @@ type TCPPeer struct {
 	outbound bool
 
 	wg *sync.WaitGroup
+
+	// sendMu keeps frames (and the raw bytes of a stream) of concurrent
+	// senders from interleaving on the connection.
+	sendMu sync.Mutex
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
@@ -31,9 +36,12 @@ func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 
 }
 
+// Send writes b as a single message frame to the peer.
 func (p *TCPPeer) Send(b []byte) error {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
 
-	_, err := p.Conn.Write(b)
+	_, err := p.Conn.Write(encodeFrame(IncomingMessage, b))
 
 	// if err != nil {
 	// 	return err
@@ -43,6 +51,25 @@ func (p *TCPPeer) Send(b []byte) error {
 	return err
 }
 
+// Stream writes the header as a stream frame followed by everything read
+// from r. The header has to tell the remote how many bytes follow. If r fails
+// halfway the connection is closed, because the remote can no longer tell
+// where the next frame starts.
+func (p *TCPPeer) Stream(header []byte, r io.Reader) (int64, error) {
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+
+	if _, err := p.Conn.Write(encodeFrame(IncomingStream, header)); err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(p.Conn, r)
+	if err != nil {
+		p.Conn.Close()
+	}
+	return n, err
+}
+
 func (p *TCPPeer) CloseStream() {
 	p.wg.Done()
 }
@@ -52,6 +79,9 @@ type TCPTransportopts struct {
 	HandShakeFunc HandShakeFunc
 	Decoder       Decoder
 	OnPeer        func(Peer) error
+	// OnPeerLost is called once the connection of a peer that made it
+	// through OnPeer is gone.
+	OnPeerLost func(Peer)
 }
 
 type TCPTransport struct {
@@ -91,7 +121,15 @@ func (t *TCPTransport) Consume() <-chan RPC {
 
 // Close implements the Transport interface, which will close the   underlying TCP transport connection and disconnect from the server
 func (t *TCPTransport) Close() error {
-	return t.listener.Close()
+	t.mu.RLock()
+	ln := t.listener
+	t.mu.RUnlock()
+
+	// a server can be shut down before it listens
+	if ln == nil {
+		return nil
+	}
+	return ln.Close()
 }
 
 // Dial implements the Transport interface,
@@ -108,24 +146,26 @@ func (t *TCPTransport) Dial(addr string) error {
 }
 
 func (t *TCPTransport) ListenAndAccept() error {
-	var err error
-	t.listener, err = net.Listen("tcp", t.ListenAddr)
+	ln, err := net.Listen("tcp", t.ListenAddr)
 	if err != nil {
 		return err
 	}
 
-	// t.listener = ln
-	go t.startAcceptLoop()
+	t.mu.Lock()
+	t.listener = ln
+	t.mu.Unlock()
+
+	go t.startAcceptLoop(ln)
 	log.Printf("TCP transport listening on %s\t", t.ListenAddr)
 	return nil
 
 }
 
-func (t *TCPTransport) startAcceptLoop() {
+func (t *TCPTransport) startAcceptLoop(ln net.Listener) {
 
 	for {
 
-		conn, err := t.listener.Accept()
+		conn, err := ln.Accept()
 
 		if errors.Is(err, net.ErrClosed) {
 			return
@@ -148,15 +188,21 @@ type Temp struct{}
 
 func (t *TCPTransport) handleConnection(conn net.Conn, outbound bool) {
 
-	var err error
+	var (
+		err       error
+		connected bool
+	)
+
+	peer := NewTCPPeer(conn, true)
 
 	defer func() {
 		fmt.Printf("Dropping Peer connection %s \n", err)
 		conn.Close()
+		if connected && t.OnPeerLost != nil {
+			t.OnPeerLost(peer)
+		}
 	}()
 
-	peer := NewTCPPeer(conn, true)
-
 	if err = t.HandShakeFunc(peer); err != nil {
 
 		return
@@ -172,6 +218,7 @@ func (t *TCPTransport) handleConnection(conn net.Conn, outbound bool) {
 		}
 
 	}
+	connected = true
 
 	// Read loop
 
@@ -186,10 +233,11 @@ func (t *TCPTransport) handleConnection(conn net.Conn, outbound bool) {
 		rpc.From = conn.RemoteAddr().String()
 
 		if rpc.Stream {
+			// The handler of the header reads the stream directly from the
+			// connection, so we have to stay away until it closes the stream.
 			peer.wg.Add(1)
-			fmt.Printf("[%s] incoming  stream , waiting... \n", conn.RemoteAddr())
+			t.rpcch <- rpc
 			peer.wg.Wait()
-			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
 			continue
 
 		}
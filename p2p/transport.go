@@ -1,6 +1,9 @@
 package p2p
 
-import "net"
+import (
+	"io"
+	"net"
+)
 
 // Peer is an interface that represents the remote node
 // peer embeds net.Conn interface which is basically also implements
@@ -9,6 +12,7 @@ import "net"
 type Peer interface {
 	net.Conn
 	Send([]byte) error
+	Stream([]byte, io.Reader) (int64, error)
 	CloseStream()
 
 	// conn() net.Conn
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/pavanmanikanta98/dfs-with-go/p2p"
+)
+
+// Consistency is how many nodes have to take part in a read or write before
+// it counts. The node doing it is one of them.
+type Consistency int
+
+const (
+	// ConsistencyOne is done as soon as a single node has it, for a write
+	// that's our own disk.
+	ConsistencyOne Consistency = iota
+	// ConsistencyQuorum needs a majority of the nodes. A quorum read always
+	// sees the newest quorum write.
+	ConsistencyQuorum
+	// ConsistencyAll needs every node that is to have the file, down ones
+	// included, so it fails while one of them is away.
+	ConsistencyAll
+)
+
+func (c Consistency) String() string {
+	switch c {
+	case ConsistencyOne:
+		return "ONE"
+	case ConsistencyQuorum:
+		return "QUORUM"
+	case ConsistencyAll:
+		return "ALL"
+	default:
+		return fmt.Sprintf("Consistency(%d)", int(c))
+	}
+}
+
+// required returns how many of n nodes have to answer.
+func (c Consistency) required(n int) int {
+	switch c {
+	case ConsistencyQuorum:
+		return n/2 + 1
+	case ConsistencyAll:
+		return n
+	default:
+		return 1
+	}
+}
+
+// writeQuorum returns how many of the nodes that are to hold the file have
+// to have it for the consistency. They are counted among all members, not
+// only the ones we are connected with, or a node cut off from the others
+// would make a quorum on its own. reachable is how many of them we can send
+// the file to right now.
+func (s *FileServer) writeQuorum(hkey string, consistency Consistency, coded bool, reachable int) (int, error) {
+	configured := len(s.memberList())
+	if !coded && s.ReplicationFactor > 0 {
+		configured = min(configured, s.ReplicationFactor)
+	}
+
+	need := consistency.required(configured)
+	if reachable < need {
+		return 0, fmt.Errorf("[%s] %s write of (%s) needs (%d) of (%d) nodes, only (%d) are reachable", s.Transport.Addr(), consistency, hkey, need, configured, reachable)
+	}
+	return need, nil
+}
+
+// MessageStoreAck is sent once the manifest of a MessageStorageFile is on
+// disk together with everything of the file the node is supposed to hold.
+// Err is set if that did not work out, Missing lists the chunks that did not
+// arrive. Fenced is set if the write was turned down for its fencing token,
+// Quota if it would have gone over a quota of the node.
+type MessageStoreAck struct {
+	ReqID   uint64
+	Key     string
+	Version int64
+	Err     string
+	Missing []string
+	Fenced  bool
+	Quota   *QuotaError
+}
+
+func (s *FileServer) ackStoreFile(peer p2p.Peer, msg MessageStorageFile, version int64, err error) error {
+	if msg.ReqID == 0 {
+		return nil
+	}
+
+	ack := MessageStoreAck{
+		ReqID:   msg.ReqID,
+		Key:     msg.Key,
+		Version: version,
+	}
+	if err != nil {
+		ack.Err = err.Error()
+	}
+	var missing *missingChunksError
+	if errors.As(err, &missing) {
+		ack.Missing = missing.hashes
+	}
+	ack.Fenced = errors.Is(err, errFenced)
+	errors.As(err, &ack.Quota)
+
+	return s.send(peer, &Message{Payload: ack})
+}
+
+// waitForAcks waits until need peers acknowledged the write of the request.
+func (s *FileServer) waitForAcks(req *pendingRequest, need int, hkey string) error {
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
+
+	acked := 0
+	for acked < need {
+		rep := req.wait(timeout)
+		if rep == nil {
+			return fmt.Errorf("[%s] only (%d) of (%d) peers acknowledged (%s) in time", s.Transport.Addr(), acked, need, hkey)
+		}
+		rep.Close()
+
+		ack := rep.payload.(MessageStoreAck)
+		if ack.Fenced {
+			// no other peer is going to take it either
+			return fmt.Errorf("[%s] peer %s turned down (%s): %w", s.Transport.Addr(), rep.from, hkey, errFenced)
+		}
+		if ack.Quota != nil {
+			// the file does not fit, waiting for the others won't change that
+			return fmt.Errorf("[%s] peer %s turned down (%s): %w", s.Transport.Addr(), rep.from, hkey, ack.Quota)
+		}
+		if ack.Err != "" {
+			log.Printf("[%s] peer %s failed to store %s: %s", s.Transport.Addr(), rep.from, hkey, ack.Err)
+			continue
+		}
+		acked++
+	}
+
+	return nil
+}
+
+// manifestAnswer is what a peer answered when we asked for a manifest, m is
+// nil if it does not have the file.
+type manifestAnswer struct {
+	from string
+	m    *Manifest
+}
+
+// fetchManifests asks all peers for the manifest of the key, of the version
+// if it's not empty. It waits until need peers answered and one of them has
+// the file, and then a little longer for the others that answer about as
+// fast.
+func (s *FileServer) fetchManifests(hkey string, version string, need int) ([]manifestAnswer, error) {
+	req := s.newRequest()
+	defer s.finishRequest(req)
+
+	msg := Message{
+		Payload: MessageGetFile{
+			ReqID:   req.id,
+			ID:      s.Owner,
+			Key:     hkey,
+			Version: version,
+		},
+	}
+
+	if err := s.broadcast(&msg); err != nil {
+		return nil, err
+	}
+
+	var (
+		answers = []manifestAnswer{}
+		found   = false
+		window  = false
+	)
+
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
+
+	for pending := len(s.peerList()); pending > 0; pending-- {
+		rep := req.wait(timeout)
+		if rep == nil {
+			break
+		}
+
+		answer := manifestAnswer{from: rep.from}
+		if rep.payload.(MessageManifestResponse).Found {
+			m, err := decodeManifest(rep.r)
+			switch {
+			case err != nil:
+				log.Printf("[%s] invalid manifest from %s: %v", s.Transport.Addr(), rep.from, err)
+			case m.Key != hkey:
+				log.Printf("[%s] peer %s answered with the manifest of %s", s.Transport.Addr(), rep.from, m.Key)
+			case version != "" && versionID(m.Version) != version:
+				log.Printf("[%s] peer %s answered with version %s of %s", s.Transport.Addr(), rep.from, versionID(m.Version), hkey)
+			default:
+				answer.m = m
+				found = true
+			}
+		}
+		rep.Close()
+		answers = append(answers, answer)
+
+		if found && len(answers) >= need && !window {
+			window = true
+			resetTimer(timeout, holderWindow)
+		}
+	}
+
+	return answers, nil
+}
+
+// newestManifest returns the newest manifest of the answers and the peers
+// that have that version.
+func newestManifest(answers []manifestAnswer) (*Manifest, []string) {
+	var newest *Manifest
+	for _, a := range answers {
+		if a.m != nil && a.m.newerThan(newest) {
+			newest = a.m
+		}
+	}
+
+	if newest == nil {
+		return nil, nil
+	}
+	return newest, holdersOf(answers, newest)
+}
+
+// holdersOf returns the peers that answered with the same version of the
+// file as m.
+func holdersOf(answers []manifestAnswer, m *Manifest) []string {
+	holders := []string{}
+	for _, a := range answers {
+		if a.m != nil && a.m.sameVersion(m) {
+			holders = append(holders, a.from)
+		}
+	}
+	return holders
+}
+
+// fetchManifest asks all peers for the manifest of the key and returns the
+// newest one that is found together with all the peers that have it.
+func (s *FileServer) fetchManifest(hkey string) (*Manifest, []string, error) {
+	answers, err := s.fetchManifests(hkey, "", 1)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	m, holders := newestManifest(answers)
+	if m == nil {
+		return nil, nil, fmt.Errorf("[%s] file (%s) not found in the network", s.Transport.Addr(), hkey)
+	}
+	return m, holders, nil
+}
+
+// quorumRead is what the nodes told us about a file.
+type quorumRead struct {
+	m *Manifest
+	// holders are the peers that have the version of m, stale the ones
+	// that have an older or a different one, or none at all.
+	holders []string
+	stale   []string
+	// local tells if m is the version we have.
+	local bool
+}
+
+// readQuorum reads the manifest of the key from need nodes, us included, and
+// returns the newest version.
+func (s *FileServer) readQuorum(hkey string, need int) (*quorumRead, error) {
+	var mine *Manifest
+	if s.store.Has(s.Owner, hkey) {
+		var err error
+		if mine, err = s.store.ReadManifest(s.Owner, hkey); err != nil {
+			return nil, err
+		}
+	}
+
+	answers, err := s.fetchManifests(hkey, "", need-1)
+	if err != nil {
+		return nil, err
+	}
+
+	// we are one of the nodes that answered
+	if len(answers)+1 < need {
+		return nil, fmt.Errorf("[%s] only (%d) of (%d) nodes answered for (%s)", s.Transport.Addr(), len(answers)+1, need, hkey)
+	}
+
+	q := &quorumRead{}
+	q.m, _ = newestManifest(answers)
+	if mine != nil && !q.m.newerThan(mine) {
+		q.m, q.local = mine, true
+	}
+	if q.m == nil {
+		return nil, fmt.Errorf("[%s] file (%s) not found in the network", s.Transport.Addr(), hkey)
+	}
+
+	q.holders = holdersOf(answers, q.m)
+	for _, a := range answers {
+		if a.m == nil || !a.m.sameVersion(q.m) {
+			q.stale = append(q.stale, a.from)
+		}
+	}
+
+	return q, nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"sync"
+)
+
+// Quota limits how much may be stored, in logical bytes of files and in
+// files. A zero field does not limit.
+//
+// The quota is logical per owner: a file counts with its whole size on every
+// node that has its manifest, whether the node holds its chunks, some shards
+// of it or nothing at all. Every node thus limits what the owner stores in
+// the whole cluster, not what it takes up on the node. The disk of the node
+// is guarded by the free space checks.
+type Quota struct {
+	LogicalBytes int64
+	Objects      int
+}
+
+// Usage is how much is stored, the size of the current versions of the files
+// and how many there are. Old versions, siblings and tombstones don't count.
+type Usage struct {
+	LogicalBytes int64
+	Objects      int
+}
+
+func (u Usage) add(other Usage) Usage {
+	return Usage{LogicalBytes: u.LogicalBytes + other.LogicalBytes, Objects: u.Objects + other.Objects}
+}
+
+func (u Usage) sub(other Usage) Usage {
+	return Usage{LogicalBytes: u.LogicalBytes - other.LogicalBytes, Objects: u.Objects - other.Objects}
+}
+
+// exceeds tells if the usage is over the quota.
+func (u Usage) exceeds(q Quota) bool {
+	return (q.LogicalBytes > 0 && u.LogicalBytes > q.LogicalBytes) || (q.Objects > 0 && u.Objects > q.Objects)
+}
+
+// reaches tells if the usage is at the quota, nothing more fits.
+func (u Usage) reaches(q Quota) bool {
+	return (q.LogicalBytes > 0 && u.LogicalBytes >= q.LogicalBytes) || (q.Objects > 0 && u.Objects >= q.Objects)
+}
+
+// usageOf is what the manifest, which may be nil, adds to the usage. That is
+// the size of the file, no matter which of its chunks we hold.
+func usageOf(m *Manifest) Usage {
+	if m == nil || m.Deleted {
+		return Usage{}
+	}
+	return Usage{LogicalBytes: m.Size, Objects: 1}
+}
+
+// Quotas are the limits of a node. Owner applies to every owner, Owners
+// overrides it for single owners, Node limits all owners together.
+type Quotas struct {
+	Owner  Quota
+	Owners map[string]Quota
+	Node   Quota
+}
+
+func (q Quotas) of(id string) Quota {
+	if quota, ok := q.Owners[id]; ok {
+		return quota
+	}
+	return q.Owner
+}
+
+// errQuotaExceeded is what a QuotaError is.
+var errQuotaExceeded = errors.New("quota exceeded")
+
+// QuotaError is returned for a write that would take its owner, or the node,
+// over the quota. Owner is empty if the node is full.
+type QuotaError struct {
+	Node  string
+	Owner string
+	Quota Quota
+	Usage Usage
+}
+
+func (e *QuotaError) Error() string {
+	who := "all owners"
+	if e.Owner != "" {
+		who = "owner " + e.Owner
+	}
+	where := ""
+	if e.Node != "" {
+		where = " on node " + e.Node
+	}
+	return fmt.Sprintf("%v%s: %s would store %d logical bytes in %d files, the quota is %d logical bytes in %d files",
+		errQuotaExceeded, where, who, e.Usage.LogicalBytes, e.Usage.Objects, e.Quota.LogicalBytes, e.Quota.Objects)
+}
+
+func (e *QuotaError) Is(target error) bool {
+	return target == errQuotaExceeded
+}
+
+// usageCounter keeps the usage of every owner up to date with the manifests
+// that are written and deleted.
+type usageCounter struct {
+	mu     sync.Mutex
+	owners map[string]Usage
+	total  Usage
+}
+
+func (u *usageCounter) reset() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.owners = make(map[string]Usage)
+	u.total = Usage{}
+}
+
+// change moves the usage of the owner from what old added to what m adds.
+func (u *usageCounter) change(id string, old *Manifest, m *Manifest) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if u.owners == nil {
+		u.owners = make(map[string]Usage)
+	}
+	delta := usageOf(m).sub(usageOf(old))
+	owner := u.owners[id].add(delta)
+	if owner == (Usage{}) {
+		delete(u.owners, id)
+	} else {
+		u.owners[id] = owner
+	}
+	u.total = u.total.add(delta)
+}
+
+// admit tells if the owner may replace old with m under the quotas. Writes
+// that don't grow the usage are always fine.
+func (u *usageCounter) admit(quotas Quotas, id string, old *Manifest, m *Manifest) error {
+	return u.admitUsage(quotas, id, usageOf(old), usageOf(m))
+}
+
+// admitUsage tells if the owner may replace what old adds to its usage with
+// what m adds.
+func (u *usageCounter) admitUsage(quotas Quotas, id string, old Usage, m Usage) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	delta := m.sub(old)
+	if delta.LogicalBytes <= 0 && delta.Objects <= 0 {
+		return nil
+	}
+
+	if owner := u.owners[id].add(delta); owner.exceeds(quotas.of(id)) {
+		return &QuotaError{Owner: id, Quota: quotas.of(id), Usage: owner}
+	}
+	if total := u.total.add(delta); total.exceeds(quotas.Node) {
+		return &QuotaError{Quota: quotas.Node, Usage: total}
+	}
+	return nil
+}
+
+// UsageReport is how much every owner stores on a node and the quotas it
+// enforces.
+type UsageReport struct {
+	Node   Usage
+	Owners map[string]Usage
+	Quotas Quotas
+}
+
+// Usage reports how much is stored on this node, per owner and in total.
+func (s *FileServer) Usage() UsageReport {
+	s.store.usage.mu.Lock()
+	defer s.store.usage.mu.Unlock()
+
+	return UsageReport{
+		Node:   s.store.usage.total,
+		Owners: maps.Clone(s.store.usage.owners),
+		Quotas: s.Quotas,
+	}
+}
+
+// checkQuota fails if the file of the owner, grown to size bytes, does not
+// fit the quotas on this node. The chunks of an upload are checked before we
+// take any of their bytes, the manifest would be turned down anyway.
+func (s *FileServer) checkQuota(id string, hkey string, size int64) error {
+	old, _ := s.store.ReadManifest(id, hkey)
+	return s.onNode(s.store.usage.admitUsage(s.Quotas, id, usageOf(old), Usage{LogicalBytes: size, Objects: 1}))
+}
+
+// onNode names us as the node of a quota error, the store does not know who
+// it belongs to.
+func (s *FileServer) onNode(err error) error {
+	var quota *QuotaError
+	if errors.As(err, &quota) {
+		quota.Node = s.ID
+	}
+	return err
+}
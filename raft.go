@@ -0,0 +1,680 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// raftNamespace holds what a metadata node keeps across restarts: its term
+// and vote, its log and the latest snapshot of its state.
+const raftNamespace = "raft"
+
+const (
+	heartbeatInterval = 50 * time.Millisecond
+	// electionTimeout is the least a follower waits for the leader before
+	// it stands for election, it waits up to twice as long so the nodes
+	// rarely split the vote.
+	electionTimeout = 300 * time.Millisecond
+	// snapshotThreshold is how many applied entries the log keeps before
+	// they are folded into a snapshot.
+	snapshotThreshold = 256
+	// maxAppendEntries is how many entries a single append carries.
+	maxAppendEntries = 64
+)
+
+type raftRole int
+
+const (
+	follower raftRole = iota
+	candidate
+	leader
+)
+
+type logEntry struct {
+	Index   uint64
+	Term    uint64
+	Command metaCommand
+}
+
+// envelope is a message a raft node wants to send to another node, it is
+// sent once the node let go of its lock.
+type envelope struct {
+	to      string
+	payload any
+}
+
+// pendingRead is a lookup of a node the leader answers once a majority
+// acknowledged a heartbeat of the round, or later.
+type pendingRead struct {
+	node  string
+	msg   MessageMetaLookup
+	round uint64
+	at    time.Time
+}
+
+// proposal is a command a node asked the leader for, answered once the entry
+// is applied.
+type proposal struct {
+	term  uint64
+	node  string
+	reqID uint64
+}
+
+type raftState struct {
+	Term     uint64
+	VotedFor string
+}
+
+type raftSnapshot struct {
+	Index uint64
+	Term  uint64
+	State metaState
+}
+
+// raft is the consensus of the metadata nodes over the catalog and the
+// locks. Every change of them is an entry of the log, which the leader
+// replicates to the other voters and applies once a majority has it.
+type raft struct {
+	mu     sync.Mutex
+	id     string
+	voters []string
+	store  *store
+
+	// what survives a restart
+	term      uint64
+	votedFor  string
+	log       []logEntry
+	snapIndex uint64
+	snapTerm  uint64
+
+	role      raftRole
+	leader    string
+	commit    uint64
+	applied   uint64
+	votes     map[string]bool
+	next      map[string]uint64
+	match     map[string]uint64
+	deadline  time.Time
+	lastBeat  time.Time
+	state     metaState
+	snapshot  metaState
+	proposals map[uint64][]proposal
+
+	// round counts the heartbeats of the leader, acked is the latest round
+	// every voter answered.
+	round uint64
+	acked map[string]uint64
+	reads []pendingRead
+}
+
+func newRaft(id string, voters []string, store *store) *raft {
+	r := &raft{
+		id:        id,
+		voters:    voters,
+		store:     store,
+		state:     newMetaState(),
+		snapshot:  newMetaState(),
+		proposals: make(map[uint64][]proposal),
+	}
+
+	var (
+		state raftState
+		snap  raftSnapshot
+	)
+	if err := r.load("state", &state); err != nil {
+		log.Printf("failed to load the raft state of %s: %v", id, err)
+	}
+	if err := r.load("snapshot", &snap); err != nil {
+		log.Printf("failed to load the raft snapshot of %s: %v", id, err)
+	}
+	if err := r.load("log", &r.log); err != nil {
+		log.Printf("failed to load the raft log of %s: %v", id, err)
+	}
+
+	r.term, r.votedFor = state.Term, state.VotedFor
+	if snap.Index > 0 {
+		r.state, r.snapshot = snap.State.clone(), snap.State.clone()
+	}
+	r.snapIndex, r.snapTerm = snap.Index, snap.Term
+	r.commit, r.applied = snap.Index, snap.Index
+	// a snapshot that was written before the log it shortened
+	r.log = slices.DeleteFunc(r.log, func(e logEntry) bool { return e.Index <= r.snapIndex })
+
+	r.resetDeadline(time.Now())
+	return r
+}
+
+func (r *raft) load(key string, v any) error {
+	_, f, err := r.store.readStream(raftNamespace, key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return gob.NewDecoder(f).Decode(v)
+}
+
+func (r *raft) save(key string, v any) {
+	buf := new(bytes.Buffer)
+	err := gob.NewEncoder(buf).Encode(v)
+	if err == nil {
+		_, err = r.store.Write(raftNamespace, key, buf)
+	}
+	if err != nil {
+		log.Printf("failed to persist the raft %s of %s: %v", key, r.id, err)
+	}
+}
+
+func (r *raft) persistState() {
+	r.save("state", raftState{Term: r.term, VotedFor: r.votedFor})
+}
+
+func (r *raft) persistLog() {
+	r.save("log", r.log)
+}
+
+func (r *raft) persistSnapshot() {
+	r.save("snapshot", raftSnapshot{Index: r.snapIndex, Term: r.snapTerm, State: r.snapshot})
+}
+
+func (r *raft) majority() int {
+	return len(r.voters)/2 + 1
+}
+
+func (r *raft) lastIndex() uint64 {
+	if len(r.log) > 0 {
+		return r.log[len(r.log)-1].Index
+	}
+	return r.snapIndex
+}
+
+func (r *raft) lastTerm() uint64 {
+	if len(r.log) > 0 {
+		return r.log[len(r.log)-1].Term
+	}
+	return r.snapTerm
+}
+
+// termAt returns the term of the entry at the index, if we still have it.
+func (r *raft) termAt(index uint64) (uint64, bool) {
+	switch {
+	case index == r.snapIndex:
+		return r.snapTerm, true
+	case index < r.snapIndex || index > r.lastIndex():
+		return 0, false
+	}
+	return r.log[index-r.snapIndex-1].Term, true
+}
+
+func (r *raft) resetDeadline(now time.Time) {
+	r.deadline = now.Add(electionTimeout + time.Duration(rand.Int63n(int64(electionTimeout))))
+}
+
+// tick sends the heartbeats of a leader and starts an election once a
+// follower did not hear from one in time.
+func (r *raft) tick(now time.Time) []envelope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.role == leader {
+		envs := r.expireReads(now)
+		if now.Sub(r.lastBeat) < heartbeatInterval {
+			return envs
+		}
+		return append(envs, r.broadcastAppend(now)...)
+	}
+	if now.Before(r.deadline) {
+		return nil
+	}
+	return r.startElection(now)
+}
+
+func (r *raft) startElection(now time.Time) []envelope {
+	r.role = candidate
+	r.term++
+	r.votedFor = r.id
+	r.leader = ""
+	r.persistState()
+	r.votes = map[string]bool{r.id: true}
+	r.resetDeadline(now)
+
+	if len(r.votes) >= r.majority() {
+		return r.becomeLeader(now)
+	}
+
+	envs := []envelope{}
+	for _, v := range r.voters {
+		if v == r.id {
+			continue
+		}
+		envs = append(envs, envelope{to: v, payload: MessageRequestVote{
+			Term:      r.term,
+			LastIndex: r.lastIndex(),
+			LastTerm:  r.lastTerm(),
+		}})
+	}
+	return envs
+}
+
+func (r *raft) becomeLeader(now time.Time) []envelope {
+	r.role = leader
+	r.leader = r.id
+	r.next = make(map[string]uint64)
+	r.match = make(map[string]uint64)
+	r.acked = make(map[string]uint64)
+	for _, v := range r.voters {
+		r.next[v] = r.lastIndex() + 1
+	}
+
+	// the entries of earlier terms are committed along with one of ours
+	r.log = append(r.log, logEntry{Index: r.lastIndex() + 1, Term: r.term})
+	r.persistLog()
+
+	log.Printf("%s is the metadata leader of term %d", r.id, r.term)
+
+	envs := r.advanceCommit()
+	return append(envs, r.broadcastAppend(now)...)
+}
+
+// stepDown makes us a follower, of the term if it is newer than ours.
+func (r *raft) stepDown(term uint64) []envelope {
+	if term > r.term {
+		r.term = term
+		r.votedFor = ""
+		r.persistState()
+	}
+	var envs []envelope
+	if r.role == leader {
+		envs = append(r.failProposals(), r.failReads()...)
+	}
+	r.role = follower
+	return envs
+}
+
+func (r *raft) broadcastAppend(now time.Time) []envelope {
+	r.lastBeat = now
+	r.round++
+
+	envs := []envelope{}
+	for _, v := range r.voters {
+		if v != r.id {
+			envs = append(envs, r.appendFor(v))
+		}
+	}
+	return envs
+}
+
+// appendFor returns the next entries the voter misses, or our snapshot if
+// they are not in the log anymore.
+func (r *raft) appendFor(v string) envelope {
+	next := r.next[v]
+	if next <= r.snapIndex {
+		return envelope{to: v, payload: MessageInstallSnapshot{
+			Term:      r.term,
+			LastIndex: r.snapIndex,
+			LastTerm:  r.snapTerm,
+			State:     r.snapshot,
+			Round:     r.round,
+		}}
+	}
+
+	prevTerm, _ := r.termAt(next - 1)
+	from := next - r.snapIndex - 1
+	to := min(uint64(len(r.log)), from+maxAppendEntries)
+	return envelope{to: v, payload: MessageAppendEntries{
+		Term:      r.term,
+		PrevIndex: next - 1,
+		PrevTerm:  prevTerm,
+		Entries:   slices.Clone(r.log[from:to]),
+		Commit:    r.commit,
+		Round:     r.round,
+	}}
+}
+
+func (r *raft) handleRequestVote(from string, msg MessageRequestVote) []envelope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var envs []envelope
+	if msg.Term > r.term {
+		envs = r.stepDown(msg.Term)
+	}
+
+	upToDate := msg.LastTerm > r.lastTerm() || (msg.LastTerm == r.lastTerm() && msg.LastIndex >= r.lastIndex())
+	granted := msg.Term == r.term && (r.votedFor == "" || r.votedFor == from) && upToDate
+	if granted {
+		r.votedFor = from
+		r.persistState()
+		r.resetDeadline(time.Now())
+	}
+
+	return append(envs, envelope{to: from, payload: MessageRequestVoteResponse{Term: r.term, Granted: granted}})
+}
+
+func (r *raft) handleVoteResponse(from string, msg MessageRequestVoteResponse) []envelope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if msg.Term > r.term {
+		return r.stepDown(msg.Term)
+	}
+	if r.role != candidate || msg.Term != r.term || !msg.Granted {
+		return nil
+	}
+
+	r.votes[from] = true
+	if len(r.votes) >= r.majority() {
+		return r.becomeLeader(time.Now())
+	}
+	return nil
+}
+
+func (r *raft) handleAppendEntries(from string, msg MessageAppendEntries) []envelope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reply := func(success bool, match uint64) envelope {
+		return envelope{to: from, payload: MessageAppendEntriesResponse{Term: r.term, Success: success, Match: match, Round: msg.Round}}
+	}
+
+	if msg.Term < r.term {
+		return []envelope{reply(false, 0)}
+	}
+	envs := r.stepDown(msg.Term)
+	r.leader = from
+	r.resetDeadline(time.Now())
+
+	if msg.PrevIndex > r.lastIndex() {
+		return append(envs, reply(false, r.lastIndex()))
+	}
+	if msg.PrevIndex >= r.snapIndex {
+		if term, _ := r.termAt(msg.PrevIndex); term != msg.PrevTerm {
+			// what we committed matches the leader for sure
+			return append(envs, reply(false, r.commit))
+		}
+	}
+
+	changed := false
+	for _, e := range msg.Entries {
+		if e.Index <= r.snapIndex {
+			continue
+		}
+		if e.Index <= r.lastIndex() {
+			if term, _ := r.termAt(e.Index); term == e.Term {
+				continue
+			}
+			r.log = r.log[:e.Index-r.snapIndex-1]
+		}
+		r.log = append(r.log, e)
+		changed = true
+	}
+	if changed {
+		r.persistLog()
+	}
+
+	match := msg.PrevIndex + uint64(len(msg.Entries))
+	if msg.Commit > r.commit {
+		r.commit = max(r.commit, min(msg.Commit, match))
+	}
+	envs = append(envs, r.applyCommitted()...)
+
+	return append(envs, reply(true, match))
+}
+
+func (r *raft) handleAppendResponse(from string, msg MessageAppendEntriesResponse) []envelope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if msg.Term > r.term {
+		return r.stepDown(msg.Term)
+	}
+	if r.role != leader || msg.Term != r.term {
+		return nil
+	}
+
+	// even a failed append shows the voter follows us in this term
+	r.acked[from] = max(r.acked[from], msg.Round)
+	if !msg.Success {
+		r.next[from] = max(1, min(r.next[from]-1, msg.Match+1))
+		return append(r.confirmReads(), r.appendFor(from))
+	}
+
+	r.match[from] = max(r.match[from], msg.Match)
+	r.next[from] = r.match[from] + 1
+	envs := append(r.advanceCommit(), r.confirmReads()...)
+	if r.next[from] <= r.lastIndex() {
+		envs = append(envs, r.appendFor(from))
+	}
+	return envs
+}
+
+func (r *raft) handleInstallSnapshot(from string, msg MessageInstallSnapshot) []envelope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	reply := func(success bool, match uint64) envelope {
+		return envelope{to: from, payload: MessageAppendEntriesResponse{Term: r.term, Success: success, Match: match, Round: msg.Round}}
+	}
+
+	if msg.Term < r.term {
+		return []envelope{reply(false, 0)}
+	}
+	envs := r.stepDown(msg.Term)
+	r.leader = from
+	r.resetDeadline(time.Now())
+
+	if msg.LastIndex <= r.commit {
+		return append(envs, reply(true, msg.LastIndex))
+	}
+
+	// the entries after the snapshot stay if ours agree with it
+	if term, ok := r.termAt(msg.LastIndex); ok && term == msg.LastTerm {
+		r.log = slices.Clone(r.log[msg.LastIndex-r.snapIndex:])
+	} else {
+		r.log = nil
+	}
+	r.snapIndex, r.snapTerm = msg.LastIndex, msg.LastTerm
+	r.snapshot = msg.State.clone()
+	r.state = msg.State.clone()
+	r.commit, r.applied = msg.LastIndex, msg.LastIndex
+	r.persistSnapshot()
+	r.persistLog()
+
+	return append(envs, reply(true, msg.LastIndex))
+}
+
+// advanceCommit commits the entries of our term a majority has.
+func (r *raft) advanceCommit() []envelope {
+	for n := r.lastIndex(); n > r.commit; n-- {
+		if term, _ := r.termAt(n); term != r.term {
+			break
+		}
+		count := 1
+		for _, v := range r.voters {
+			if v != r.id && r.match[v] >= n {
+				count++
+			}
+		}
+		if count >= r.majority() {
+			r.commit = n
+			break
+		}
+	}
+	return r.applyCommitted()
+}
+
+// applyCommitted applies the committed entries to the state, answers the
+// proposals of them and takes a snapshot once the log grew long enough.
+func (r *raft) applyCommitted() []envelope {
+	envs := []envelope{}
+	for r.applied < r.commit {
+		r.applied++
+		e := r.log[r.applied-r.snapIndex-1]
+		token, refused := r.state.apply(e.Command, e.Index)
+
+		for _, p := range r.proposals[e.Index] {
+			res := MessageMetaProposeResponse{ReqID: p.reqID, Token: token, Refused: refused}
+			if p.term != e.Term {
+				res.Err = "the entry was overwritten by another leader"
+			}
+			envs = append(envs, envelope{to: p.node, payload: res})
+		}
+		delete(r.proposals, e.Index)
+	}
+
+	if r.applied-r.snapIndex >= snapshotThreshold {
+		r.snapTerm, _ = r.termAt(r.applied)
+		r.log = slices.Clone(r.log[r.applied-r.snapIndex:])
+		r.snapIndex = r.applied
+		r.snapshot = r.state.clone()
+		r.persistSnapshot()
+		r.persistLog()
+	}
+	return envs
+}
+
+// failProposals turns down the proposals we can't answer anymore once we
+// are no longer the leader.
+func (r *raft) failProposals() []envelope {
+	envs := []envelope{}
+	for _, proposals := range r.proposals {
+		for _, p := range proposals {
+			envs = append(envs, envelope{to: p.node, payload: MessageMetaProposeResponse{
+				ReqID: p.reqID,
+				Err:   "lost the leadership",
+			}})
+		}
+	}
+	r.proposals = make(map[uint64][]proposal)
+	return envs
+}
+
+// propose appends the command of the node to the log if we are the leader,
+// the node is answered once it is applied. Otherwise the node is told who
+// the leader is.
+func (r *raft) propose(node string, msg MessageMetaPropose) []envelope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.role != leader {
+		return []envelope{{to: node, payload: MessageMetaProposeResponse{
+			ReqID:  msg.ReqID,
+			Leader: r.leader,
+			Err:    "not the leader",
+		}}}
+	}
+
+	// the leader's clock is the one the leases run on
+	msg.Command.Now = time.Now()
+	e := logEntry{Index: r.lastIndex() + 1, Term: r.term, Command: msg.Command}
+	r.log = append(r.log, e)
+	r.persistLog()
+	r.proposals[e.Index] = append(r.proposals[e.Index], proposal{term: r.term, node: node, reqID: msg.ReqID})
+
+	envs := r.advanceCommit()
+	return append(envs, r.broadcastAppend(time.Now())...)
+}
+
+// lookup answers the node with the catalog entry of the file if we are the
+// leader. Another leader may have been elected without us knowing, so the
+// answer waits until a majority of the voters acknowledged a heartbeat we
+// sent after the lookup came in. Our state then has every change committed
+// before the lookup, and the answer is never older than that.
+func (r *raft) lookup(node string, msg MessageMetaLookup) []envelope {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.role != leader {
+		return []envelope{{to: node, payload: MessageMetaLookupResponse{
+			ReqID:  msg.ReqID,
+			Leader: r.leader,
+			Err:    "not the leader",
+		}}}
+	}
+
+	now := time.Now()
+	envs := r.broadcastAppend(now)
+	r.reads = append(r.reads, pendingRead{node: node, msg: msg, round: r.round, at: now})
+	return append(envs, r.confirmReads()...)
+}
+
+// confirmReads answers the lookups a majority of the voters confirmed our
+// leadership for. A new leader first has to commit an entry of its term,
+// until then it may not have applied everything that was committed.
+func (r *raft) confirmReads() []envelope {
+	if term, _ := r.termAt(r.commit); len(r.reads) == 0 || term != r.term {
+		return nil
+	}
+
+	envs := []envelope{}
+	waiting := r.reads[:0]
+	for _, p := range r.reads {
+		count := 1
+		for _, v := range r.voters {
+			if v != r.id && r.acked[v] >= p.round {
+				count++
+			}
+		}
+		if count < r.majority() {
+			waiting = append(waiting, p)
+			continue
+		}
+		entry, found := r.state.Catalog[historyKey(p.msg.ID, p.msg.Key)]
+		envs = append(envs, envelope{to: p.node, payload: MessageMetaLookupResponse{
+			ReqID: p.msg.ReqID,
+			Entry: entry,
+			Found: found,
+		}})
+	}
+	r.reads = waiting
+	return envs
+}
+
+// expireReads turns down the lookups no majority confirmed within an
+// election timeout, we are likely cut off from the other voters.
+func (r *raft) expireReads(now time.Time) []envelope {
+	envs := []envelope{}
+	waiting := r.reads[:0]
+	for _, p := range r.reads {
+		if now.Sub(p.at) < electionTimeout {
+			waiting = append(waiting, p)
+			continue
+		}
+		envs = append(envs, envelope{to: p.node, payload: MessageMetaLookupResponse{
+			ReqID: p.msg.ReqID,
+			Err:   "could not confirm the leadership",
+		}})
+	}
+	r.reads = waiting
+	return envs
+}
+
+// failReads turns down the lookups we can't answer anymore.
+func (r *raft) failReads() []envelope {
+	envs := []envelope{}
+	for _, p := range r.reads {
+		envs = append(envs, envelope{to: p.node, payload: MessageMetaLookupResponse{
+			ReqID: p.msg.ReqID,
+			Err:   "lost the leadership",
+		}})
+	}
+	r.reads = nil
+	return envs
+}
+
+func (r *raft) isLeader() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.role == leader
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRaftSnapshotSurvivesRestart(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	// a single voter elects itself and commits on its own
+	r := newRaft("n1", []string{"n1"}, s)
+	r.tick(time.Now().Add(time.Hour))
+	if !r.isLeader() {
+		t.Fatal("single voter did not become the leader")
+	}
+
+	n := snapshotThreshold + 10
+	for i := 0; i < n; i++ {
+		envs := r.propose("n1", MessageMetaPropose{
+			ReqID:   uint64(i),
+			Command: metaCommand{Op: metaPut, ID: "owner", Key: "file", Version: int64(i + 1), Replicas: []string{"n1"}},
+		})
+		if len(envs) != 1 || envs[0].payload.(MessageMetaProposeResponse).Err != "" {
+			t.Fatalf("proposal %d was not committed right away", i)
+		}
+	}
+	if r.snapIndex == 0 || len(r.log) >= snapshotThreshold {
+		t.Fatalf("log of %d entries after a snapshot at %d, want it shortened", len(r.log), r.snapIndex)
+	}
+
+	// the catalog comes back from the snapshot and the rest of the log
+	r = newRaft("n1", []string{"n1"}, s)
+	r.tick(time.Now().Add(time.Hour))
+	e, ok := r.state.Catalog[historyKey("owner", "file")]
+	if !ok || e.Current().Version != int64(n) {
+		t.Fatalf("catalog has version %d after the restart, want %d", e.Current().Version, n)
+	}
+	if len(e.Versions) != catalogVersions {
+		t.Fatalf("catalog keeps %d versions, want %d", len(e.Versions), catalogVersions)
+	}
+}
+
+// TestRaftLookupWaitsForQuorum cuts the leader off, another one is elected
+// and commits a newer version. The old leader must not answer from its state.
+func TestRaftLookupWaitsForQuorum(t *testing.T) {
+	nodes := map[string]*raft{}
+	voters := []string{"n1", "n2", "n3"}
+	for _, id := range voters {
+		nodes[id] = newRaft(id, voters, NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc}))
+	}
+
+	// route delivers the messages between the nodes that are up and
+	// returns the answers to lookups
+	down := map[string]bool{}
+	route := func(from string, envs []envelope) []MessageMetaLookupResponse {
+		type sent struct {
+			from string
+			env  envelope
+		}
+		queue := []sent{}
+		for _, env := range envs {
+			queue = append(queue, sent{from, env})
+		}
+		answers := []MessageMetaLookupResponse{}
+		for len(queue) > 0 {
+			m := queue[0]
+			queue = queue[1:]
+			if res, ok := m.env.payload.(MessageMetaLookupResponse); ok {
+				answers = append(answers, res)
+				continue
+			}
+			r, ok := nodes[m.env.to]
+			if !ok || down[m.from] || down[m.env.to] {
+				continue
+			}
+			var next []envelope
+			switch v := m.env.payload.(type) {
+			case MessageRequestVote:
+				next = r.handleRequestVote(m.from, v)
+			case MessageRequestVoteResponse:
+				next = r.handleVoteResponse(m.from, v)
+			case MessageAppendEntries:
+				next = r.handleAppendEntries(m.from, v)
+			case MessageAppendEntriesResponse:
+				next = r.handleAppendResponse(m.from, v)
+			case MessageInstallSnapshot:
+				next = r.handleInstallSnapshot(m.from, v)
+			}
+			for _, env := range next {
+				queue = append(queue, sent{m.env.to, env})
+			}
+		}
+		return answers
+	}
+	put := func(leader string, version int64) {
+		route(leader, nodes[leader].propose("client", MessageMetaPropose{
+			Command: metaCommand{Op: metaPut, ID: "owner", Key: "file", Version: version, Replicas: voters},
+		}))
+	}
+	lookup := func(leader string) []MessageMetaLookupResponse {
+		return route(leader, nodes[leader].lookup("client", MessageMetaLookup{ID: "owner", Key: "file"}))
+	}
+
+	route("n1", nodes["n1"].tick(time.Now().Add(time.Hour)))
+	if !nodes["n1"].isLeader() {
+		t.Fatal("n1 did not become the leader")
+	}
+	put("n1", 1)
+	if answers := lookup("n1"); len(answers) != 1 || !answers[0].Found || answers[0].Entry.Current().Version != 1 {
+		t.Fatalf("lookup on the leader answered %+v", answers)
+	}
+
+	down["n1"] = true
+	route("n2", nodes["n2"].tick(time.Now().Add(time.Hour)))
+	if !nodes["n2"].isLeader() {
+		t.Fatal("n2 did not take over")
+	}
+	put("n2", 2)
+
+	if answers := lookup("n1"); len(answers) != 0 {
+		t.Fatalf("the cut off leader answered %+v", answers)
+	}
+	if answers := route("n1", nodes["n1"].tick(time.Now().Add(time.Hour))); len(answers) != 1 || answers[0].Err == "" {
+		t.Fatalf("the lookup nobody confirmed was answered with %+v", answers)
+	}
+
+	// once it hears of the new term it knows it is not the leader anymore
+	down["n1"] = false
+	if answers := lookup("n1"); len(answers) != 1 || answers[0].Err == "" {
+		t.Fatalf("the old leader answered %+v", answers)
+	}
+	if answers := lookup("n2"); len(answers) != 1 || answers[0].Entry.Current().Version != 2 {
+		t.Fatalf("the new leader answered %+v", answers)
+	}
+}
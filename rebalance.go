@@ -0,0 +1,239 @@
+package main
+
+import (
+	"log"
+	"slices"
+	"time"
+
+	"github.com/pavanmanikanta98/dfs-with-go/p2p"
+)
+
+const (
+	// rebalanceDelay lets the membership settle before we move data, a
+	// node that comes up connects to several peers one after the other.
+	rebalanceDelay = time.Second
+
+	// rebalanceRate is how many bytes per second the rebalancer sends at
+	// most, the reads and writes of the users come first.
+	rebalanceRate = 8 << 20
+)
+
+// placeReplicas returns the nodes that hold the chunks of the replicated file
+// of the owner, the factor best ranked of the nodes. A factor of zero places
+// the file on all of them.
+func placeReplicas(id string, hkey string, nodes []string, factor int) []string {
+	return placeWeighted(id, hkey, nodes, factor, nil)
+}
+
+// placeWeighted is placeReplicas with the nodes weighted by their free
+// space, see Capacity.weight.
+func placeWeighted(id string, hkey string, nodes []string, factor int, weights map[string]float64) []string {
+	ranked := rankNodesWeighted(id+"/"+hkey, nodes, weights)
+	if factor > 0 && len(ranked) > factor {
+		ranked = ranked[:factor]
+	}
+	return ranked
+}
+
+// placement returns the replicas of the file under the current membership,
+// weighted the way they were when the file was written. Every node that has
+// the manifest comes to the same replicas.
+func (s *FileServer) placement(id string, m *Manifest) []string {
+	return placeWeighted(id, m.Key, s.nodeList(), s.ReplicationFactor, m.Weights)
+}
+
+// replicaPeers splits the peers into the replicas of the file and the rest.
+func (s *FileServer) replicaPeers(peers []p2p.Peer, replicas []string) ([]p2p.Peer, []p2p.Peer) {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	var in, out []p2p.Peer
+	for _, peer := range peers {
+		if slices.Contains(replicas, s.peerNodes[peer.RemoteAddr().String()]) {
+			in = append(in, peer)
+		} else {
+			out = append(out, peer)
+		}
+	}
+	return in, out
+}
+
+// replicaHolders narrows the holders down to the replicas of the file, the
+// others only have its manifest. If none of them is a replica all are tried.
+func (s *FileServer) replicaHolders(id string, m *Manifest, holders []string) []string {
+	replicas := s.placement(id, m)
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	narrowed := []string{}
+	for _, addr := range holders {
+		if slices.Contains(replicas, s.peerNodes[addr]) {
+			narrowed = append(narrowed, addr)
+		}
+	}
+	if len(narrowed) == 0 {
+		return holders
+	}
+	return narrowed
+}
+
+// OnPeerLost forgets the peer once its connection is gone.
+func (s *FileServer) OnPeerLost(peer p2p.Peer) {
+	s.forgetPeer(peer)
+
+	log.Printf("[%s] lost (remote) peer %s", s.Transport.Addr(), peer.RemoteAddr())
+}
+
+// triggerRebalance asks the rebalancer for another round, rounds that are
+// asked for while one is pending are merged into it.
+func (s *FileServer) triggerRebalance() {
+	select {
+	case s.rebalancech <- struct{}{}:
+	default:
+	}
+}
+
+func (s *FileServer) rebalanceLoop() {
+	for {
+		select {
+		case <-s.rebalancech:
+			select {
+			case <-time.After(rebalanceDelay):
+			case <-s.quitch:
+				return
+			}
+
+			moved, dropped := s.rebalance()
+			if moved > 0 || dropped > 0 {
+				log.Printf("[%s] rebalanced: sent (%d) files, dropped (%d) chunks", s.Transport.Addr(), moved, dropped)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// rebalance makes sure the replicas of every replicated file we have the
+// chunks of have them too, and drops the chunks we are no longer a replica
+// of once all replicas confirmed they have them. Shards stay on the nodes
+// they were placed on. It returns how many files it sent to other nodes and
+// how many chunks it dropped.
+func (s *FileServer) rebalance() (int, int) {
+	var (
+		moved int
+		keep  = make(map[string]bool)
+		drop  = []string{}
+	)
+
+	// cached files stay until they are evicted
+	for hash := range s.cache.pinned() {
+		keep[hash] = true
+	}
+
+	// what we hold for nodes that are down stays too
+	if hints, err := s.store.hints(""); err == nil {
+		for _, h := range hints {
+			for _, hash := range h.Pieces {
+				keep[hash] = true
+			}
+		}
+	}
+
+	for _, e := range s.store.tree.all() {
+		select {
+		case <-s.quitch:
+			return moved, 0
+		default:
+		}
+
+		m, err := s.store.ReadManifest(e.ID, e.Key)
+		if err != nil {
+			continue
+		}
+
+		replicas := s.placement(e.ID, m)
+		held, _ := m.heldBy(s.ID, replicas)
+		for _, hash := range held {
+			keep[hash] = true
+		}
+		// siblings and old versions stay where they were written
+		siblings, _ := s.store.readSiblings(e.ID, e.Key)
+		for _, sibling := range siblings {
+			for _, hash := range uniqueChunks(sibling) {
+				keep[hash] = true
+			}
+		}
+		if h, err := s.store.readHistory(e.ID, e.Key); err == nil {
+			for _, v := range h.Versions {
+				for _, hash := range uniqueChunks(v.Manifest) {
+					keep[hash] = true
+				}
+			}
+		}
+
+		if m.Durability.erasureCoded() || len(s.store.missingChunks(m.Chunks)) > 0 {
+			continue
+		}
+
+		var (
+			confirmed = true
+			sent      = false
+		)
+		for _, node := range replicas {
+			if node == s.ID {
+				continue
+			}
+			peer, ok := s.nodePeer(node)
+			if !ok {
+				confirmed = false
+				continue
+			}
+
+			n, err := s.repairReplica(peer, e.ID, m, true)
+			if err != nil {
+				log.Printf("[%s] failed to move %s to %s: %v", s.Transport.Addr(), e.Key, node, err)
+				confirmed = false
+				continue
+			}
+			if n > 0 {
+				moved++
+				sent = true
+				s.throttle(n)
+			}
+		}
+
+		// the catalog learns where the file went
+		if sent && confirmed {
+			s.recordMeta(e.ID, m, replicas)
+		}
+
+		if !slices.Contains(replicas, s.ID) && confirmed {
+			for _, c := range m.Chunks {
+				drop = append(drop, c.Hash)
+			}
+		}
+	}
+
+	dropped := 0
+	for _, hash := range drop {
+		if keep[hash] || !s.store.HasChunk(hash) {
+			continue
+		}
+		if err := s.store.Delete(chunkNamespace, chunkKey(hash)); err != nil {
+			log.Printf("[%s] failed to drop chunk %s: %v", s.Transport.Addr(), hash, err)
+			continue
+		}
+		dropped++
+	}
+
+	return moved, dropped
+}
+
+// throttle waits as long as sending n bytes takes at the rebalance rate.
+func (s *FileServer) throttle(n int64) {
+	select {
+	case <-time.After(time.Duration(n) * time.Second / rebalanceRate):
+	case <-s.quitch:
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+// chunkNamespace is where the chunks of all owners live. A chunk is stored
+// once per node no matter how many files of how many owners use it.
+const chunkNamespace = "chunks"
+
+// chunkGracePeriod protects freshly written chunks from the garbage
+// collector, their manifest usually arrives right after them.
+const chunkGracePeriod = 10 * time.Minute
+
+const gcInterval = 30 * time.Minute
+
+// reservedNamespaces are ids of the store that don't belong to an owner and
+// don't hold manifests.
+var reservedNamespaces = map[string]bool{
+	chunkNamespace:   true,
+	partialNamespace: true,
+	uploadNamespace:  true,
+	metaNamespace:    true,
+	hintNamespace:    true,
+	versionNamespace: true,
+	siblingNamespace: true,
+	raftNamespace:    true,
+}
+
+// refCounter counts the manifests referencing every chunk of the pool. The
+// manifests are the source of truth, the counts are rebuilt from them when
+// the store is opened.
+type refCounter struct {
+	mu   sync.Mutex
+	refs map[string]int
+}
+
+// uniqueChunks returns every chunk hash of the manifest once, a chunk that
+// appears twice in a file is still a single reference. Of an erasure coded
+// chunk the shards are referenced, a whole copy of it is only kept around
+// for reads until the sweep gets it.
+func uniqueChunks(m *Manifest) []string {
+	seen := make(map[string]bool, len(m.Chunks))
+	hashes := []string{}
+	for _, c := range m.Chunks {
+		objects := []string{c.Hash}
+		if len(c.Shards) > 0 {
+			objects = c.Shards
+		}
+		for _, hash := range objects {
+			if !seen[hash] {
+				seen[hash] = true
+				hashes = append(hashes, hash)
+			}
+		}
+	}
+	return hashes
+}
+
+func (s *store) acquireChunks(m *Manifest) {
+	s.acquirePieces(uniqueChunks(m))
+}
+
+// releaseChunks drops the references of the manifest and deletes the chunks
+// nobody references anymore.
+func (s *store) releaseChunks(m *Manifest) {
+	s.releasePieces(uniqueChunks(m))
+}
+
+// acquirePieces references chunks, or shards, of the pool.
+func (s *store) acquirePieces(hashes []string) {
+	s.refs.mu.Lock()
+	defer s.refs.mu.Unlock()
+
+	for _, hash := range hashes {
+		s.refs.refs[hash]++
+	}
+}
+
+func (s *store) releasePieces(hashes []string) {
+	s.refs.mu.Lock()
+	defer s.refs.mu.Unlock()
+
+	for _, hash := range hashes {
+		s.refs.refs[hash]--
+		if s.refs.refs[hash] > 0 {
+			continue
+		}
+		delete(s.refs.refs, hash)
+
+		// A chunk that was just written is probably about to be referenced
+		// by a manifest that is still on its way, the sweep takes care of
+		// it if it isn't.
+		_, written, err := s.stat(chunkNamespace, chunkKey(hash))
+		if err != nil || time.Since(written) < chunkGracePeriod {
+			continue
+		}
+		if err := s.Delete(chunkNamespace, chunkKey(hash)); err != nil {
+			log.Printf("failed to delete chunk %s: %v", hash, err)
+		}
+	}
+}
+
+func (s *store) refCount(hash string) int {
+	s.refs.mu.Lock()
+	defer s.refs.mu.Unlock()
+
+	return s.refs.refs[hash]
+}
+
+// rebuildRefs counts the references of all manifests, siblings, hints and
+// old versions on disk and puts the manifests into the merkle tree.
+func (s *store) rebuildRefs() error {
+	ids, err := s.namespaces()
+	if err != nil {
+		return err
+	}
+
+	s.refs.mu.Lock()
+	s.refs.refs = make(map[string]int)
+	s.refs.mu.Unlock()
+	s.usage.reset()
+
+	for _, id := range ids {
+		if reservedNamespaces[id] {
+			continue
+		}
+		err := s.walk(id, func(info ObjectInfo) error {
+			f, err := s.open(id, info.Name)
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+
+			m, err := decodeManifest(f)
+			if err != nil {
+				log.Printf("skipping %s, not a manifest: %v", info.Name, err)
+				return nil
+			}
+			s.acquireChunks(m)
+			s.tree.put(newMerkleEntry(id, m))
+			s.usage.change(id, nil, m)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	hints, err := s.hints("")
+	if err != nil {
+		return err
+	}
+	for _, h := range hints {
+		s.acquirePieces(h.Pieces)
+	}
+
+	err = s.walk(siblingNamespace, func(info ObjectInfo) error {
+		f, err := s.open(siblingNamespace, info.Name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		siblings := []*Manifest{}
+		if err := gob.NewDecoder(f).Decode(&siblings); err != nil {
+			log.Printf("skipping %s, not a list of siblings: %v", info.Name, err)
+			return nil
+		}
+		for _, m := range siblings {
+			s.acquireChunks(m)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.walk(versionNamespace, func(info ObjectInfo) error {
+		f, err := s.open(versionNamespace, info.Name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h, err := decodeHistory(f)
+		if err != nil {
+			log.Printf("skipping %s, not a history: %v", info.Name, err)
+			return nil
+		}
+		for _, v := range h.Versions {
+			s.acquireChunks(v.Manifest)
+		}
+		return nil
+	})
+}
+
+func (s *store) HasChunk(hash string) bool {
+	return s.Has(chunkNamespace, chunkKey(hash))
+}
+
+func (s *store) ReadChunk(hash string) (int64, io.ReadCloser, error) {
+	return s.readStream(chunkNamespace, chunkKey(hash))
+}
+
+// ReadChunkAt returns length bytes of the encrypted chunk from offset on.
+func (s *store) ReadChunkAt(hash string, offset int64, length int64) (io.ReadCloser, error) {
+	return s.ReadAt(chunkNamespace, chunkKey(hash), offset, length)
+}
+
+// errChunkMismatch is returned for a chunk whose bytes don't have its hash.
+var errChunkMismatch = errors.New("chunk does not match its hash")
+
+// WriteChunk stores the encrypted chunk in the pool unless we already have
+// it. The hash is checked while writing, a chunk that does not match is
+// thrown away.
+func (s *store) WriteChunk(hash string, r io.Reader) (int64, error) {
+	if s.HasChunk(hash) {
+		// keep it away from the sweep, it's about to be referenced again
+		return 0, s.touch(chunkNamespace, chunkKey(hash))
+	}
+
+	h := sha256.New()
+	n, err := s.Write(chunkNamespace, chunkKey(hash), io.TeeReader(r, h))
+	if err == nil && hex.EncodeToString(h.Sum(nil)) != hash {
+		err = fmt.Errorf("%w: chunk %s", errChunkMismatch, hash)
+	}
+	if err != nil {
+		s.Delete(chunkNamespace, chunkKey(hash))
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// sweepChunks deletes the chunks no manifest references that are older than
+// the grace period, these are left behind by uploads that never finished.
+func (s *store) sweepChunks(grace time.Duration) (int, error) {
+	s.refs.mu.Lock()
+	referenced := make(map[string]bool, len(s.refs.refs))
+	for hash := range s.refs.refs {
+		referenced[s.name(chunkKey(hash))] = true
+	}
+	s.refs.mu.Unlock()
+
+	deleted := 0
+	err := s.walk(chunkNamespace, func(info ObjectInfo) error {
+		if referenced[info.Name] || time.Since(info.ModTime) < grace {
+			return nil
+		}
+		if err := s.backend.Delete(chunkNamespace, info.Name); err != nil {
+			return err
+		}
+		deleted++
+		return nil
+	})
+
+	return deleted, err
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/pavanmanikanta98/dfs-with-go/p2p"
+)
+
+// missingChunksError is returned when a manifest arrived but chunks, or
+// shards, the node is supposed to hold did not. The sender gets them back in
+// the ack.
+type missingChunksError struct {
+	key    string
+	hashes []string
+}
+
+func (e *missingChunksError) Error() string {
+	return fmt.Sprintf("(%d) chunks of %s did not arrive", len(e.hashes), e.key)
+}
+
+// repairReplicas brings the peers that had an older version of the file, or
+// none at all, up to the version we read. A peer gets the manifest first and
+// answers with the chunks it is missing, those that we have follow.
+func (s *FileServer) repairReplicas(m *Manifest, peers []string) {
+	for _, addr := range peers {
+		peer, ok := s.peer(addr)
+		if !ok {
+			continue
+		}
+
+		hold := slices.Contains(s.placement(s.Owner, m), s.peerNode(addr))
+		if _, err := s.repairReplica(peer, s.Owner, m, hold); err != nil {
+			log.Printf("[%s] failed to repair %s on %s: %v", s.Transport.Addr(), m.Key, addr, err)
+			continue
+		}
+
+		fmt.Printf("[%s] repaired (%s) on %s\n", s.Transport.Addr(), m.Key, addr)
+	}
+}
+
+// repairReplica brings the peer up to our version of the file of the owner
+// and returns how many bytes of chunks it had to send. With hold the peer
+// has to hold the chunks of a replicated file, whatever it thinks its
+// placement is.
+func (s *FileServer) repairReplica(peer p2p.Peer, id string, m *Manifest, hold bool) (int64, error) {
+	ack, err := s.pushManifest(peer, id, m, hold)
+	if err != nil || len(ack.Missing) == 0 {
+		return 0, err
+	}
+
+	var sent int64
+	for _, hash := range ack.Missing {
+		b, ok := s.readPiece(m, hash)
+		if !ok {
+			continue
+		}
+		if err := s.replicateChunk([]p2p.Peer{peer}, nil, id, m.Key, m.Size, hash, b); err != nil {
+			return sent, err
+		}
+		sent += int64(len(b))
+	}
+	if sent == 0 {
+		return 0, fmt.Errorf("we have none of the (%d) chunks it is missing", len(ack.Missing))
+	}
+
+	// the manifest again, so the peer checks the chunks once more
+	ack, err = s.pushManifest(peer, id, m, hold)
+	if err != nil {
+		return sent, err
+	}
+	if len(ack.Missing) > 0 {
+		return sent, fmt.Errorf("still missing (%d) chunks", len(ack.Missing))
+	}
+	return sent, nil
+}
+
+// pushManifest sends the manifest of the file of the owner to the peer and
+// waits for its ack.
+func (s *FileServer) pushManifest(peer p2p.Peer, id string, m *Manifest, hold bool) (MessageStoreAck, error) {
+	b, err := m.Encode()
+	if err != nil {
+		return MessageStoreAck{}, err
+	}
+
+	req := s.newRequest()
+	defer s.finishRequest(req)
+
+	msg := Message{
+		Payload: MessageStorageFile{
+			ReqID:   req.id,
+			ID:      id,
+			Key:     m.Key,
+			Size:    int64(len(b)),
+			Hold:    hold,
+			Clock:   m.Clock,
+			Fence:   m.Fence,
+			Expires: m.Expires,
+		},
+	}
+
+	header, err := encodeMessage(&msg)
+	if err != nil {
+		return MessageStoreAck{}, err
+	}
+	if _, err := peer.Stream(header, bytes.NewReader(b)); err != nil {
+		return MessageStoreAck{}, err
+	}
+
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
+
+	rep := req.wait(timeout)
+	if rep == nil {
+		return MessageStoreAck{}, fmt.Errorf("no ack in time")
+	}
+	rep.Close()
+
+	ack := rep.payload.(MessageStoreAck)
+	if ack.Err != "" && len(ack.Missing) == 0 {
+		return ack, fmt.Errorf("%s", ack.Err)
+	}
+	return ack, nil
+}
+
+// readPiece returns the chunk or shard of the manifest with the hash if we
+// have it. A shard we don't have is cut again from the whole chunk, the
+// shards of a chunk are always the same.
+func (s *FileServer) readPiece(m *Manifest, hash string) ([]byte, bool) {
+	if s.store.HasChunk(hash) {
+		b, err := s.readShard(hash)
+		return b, err == nil
+	}
+
+	if !m.Durability.erasureCoded() {
+		return nil, false
+	}
+	coder, err := newErasureCoder(m.Durability.DataShards, m.Durability.ParityShards)
+	if err != nil {
+		return nil, false
+	}
+
+	for _, c := range m.Chunks {
+		for i, shard := range c.Shards {
+			if shard != hash || !s.store.HasChunk(c.Hash) {
+				continue
+			}
+			b, err := s.readShard(c.Hash)
+			if err != nil {
+				return nil, false
+			}
+			shards := coder.Split(b)
+			if i < len(shards) && hashChunk(shards[i]) == hash {
+				return shards[i], true
+			}
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+const requestTimeout = 5 * time.Second
+
+// holderWindow is how long we keep collecting answers once the first peer
+// told us it has what we asked for.
+const holderWindow = 200 * time.Millisecond
+
+// reply is an answer of a peer to one of our requests. For stream replies r
+// is the part of the connection that belongs to the reply, the read loop of
+// that peer is blocked until the reply is closed.
+type reply struct {
+	from    string
+	payload any
+	r       io.Reader
+	done    chan struct{}
+}
+
+// Close drains whatever the requester did not read of the stream and hands
+// the connection back to the read loop.
+func (rep *reply) Close() {
+	if rep.r != nil {
+		io.Copy(io.Discard, rep.r)
+	}
+	close(rep.done)
+}
+
+type pendingRequest struct {
+	id      uint64
+	replies chan *reply
+	done    chan struct{}
+}
+
+var requestIDs atomic.Uint64
+
+// newRequest registers a request we are waiting replies for. Replies are
+// delivered until the request is finished.
+func (s *FileServer) newRequest() *pendingRequest {
+	req := &pendingRequest{
+		id:      requestIDs.Add(1),
+		replies: make(chan *reply),
+		done:    make(chan struct{}),
+	}
+
+	s.pendingLock.Lock()
+	s.pending[req.id] = req
+	s.pendingLock.Unlock()
+
+	return req
+}
+
+func (s *FileServer) finishRequest(req *pendingRequest) {
+	s.pendingLock.Lock()
+	delete(s.pending, req.id)
+	s.pendingLock.Unlock()
+
+	close(req.done)
+}
+
+// resolve hands a reply to the request waiting for it. It blocks until the
+// requester is done with the stream of the reply, or drains the stream itself
+// if nobody is waiting anymore.
+func (s *FileServer) resolve(reqID uint64, from string, payload any, r io.Reader) {
+	s.pendingLock.Lock()
+	req, ok := s.pending[reqID]
+	s.pendingLock.Unlock()
+
+	rep := &reply{
+		from:    from,
+		payload: payload,
+		r:       r,
+		done:    make(chan struct{}),
+	}
+
+	if !ok {
+		rep.Close()
+		return
+	}
+
+	select {
+	case req.replies <- rep:
+		if r != nil {
+			<-rep.done
+		}
+	case <-req.done:
+		rep.Close()
+	}
+}
+
+// wait returns the next reply of the request, or nil once the timeout passed.
+func (req *pendingRequest) wait(timeout *time.Timer) *reply {
+	select {
+	case rep := <-req.replies:
+		return rep
+	case <-timeout.C:
+		return nil
+	}
+}
+
+// resetTimer resets a timer that did not fire or whose firing was not
+// received yet.
+func resetTimer(t *time.Timer, d time.Duration) {
+	if !t.Stop() {
+		select {
+		case <-t.C:
+		default:
+		}
+	}
+	t.Reset(d)
+}
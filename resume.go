@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	// partialNamespace holds the chunks we only received part of. The
+	// bytes we have are kept, so the transfer continues where it stopped,
+	// even after a restart.
+	partialNamespace = "partial"
+
+	// uploadNamespace holds a journal per upload we receive, listing the
+	// chunks the sender already started to send us.
+	uploadNamespace = "uploads"
+
+	// metaNamespace holds what the node has to remember about itself.
+	metaNamespace = "meta"
+)
+
+// uploadRetention is how long partial chunks and upload journals are kept
+// around for the sender to come back.
+const uploadRetention = 24 * time.Hour
+
+// nodeID returns the id of the node, it's generated the first time the
+// store is used and stays the same over restarts. Without it the files we
+// stored, and the uploads we started, would belong to somebody else after a
+// restart.
+func (s *store) nodeID() (string, error) {
+	if s.Has(metaNamespace, "id") {
+		_, r, err := s.readStream(metaNamespace, "id")
+		if err != nil {
+			return "", err
+		}
+		defer r.Close()
+
+		b, err := io.ReadAll(r)
+		return string(b), err
+	}
+
+	id := generateID()
+	if _, err := s.Write(metaNamespace, "id", strings.NewReader(id)); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// partialChunkSize returns how many bytes of the chunk we already have.
+func (s *store) partialChunkSize(hash string) int64 {
+	size, _, err := s.stat(partialNamespace, chunkKey(hash))
+	if err != nil {
+		return 0
+	}
+	return size
+}
+
+// WriteChunkAt continues the partial chunk at offset with r. Once the chunk
+// has all of its size bytes it is verified and moved into the pool. If r
+// ends early the bytes we got are kept for the next attempt.
+func (s *store) WriteChunkAt(hash string, offset int64, size int64, r io.Reader) (int64, error) {
+	defer s.lockChunk(hash)()
+
+	if s.HasChunk(hash) {
+		return 0, nil
+	}
+
+	if have := s.partialChunkSize(hash); offset > have {
+		return 0, fmt.Errorf("chunk %s continues at %d, but we only have %d bytes of it", hash, offset, have)
+	}
+
+	n, err := s.writeAt(partialNamespace, chunkKey(hash), offset, r)
+	if err != nil {
+		return n, err
+	}
+	if offset+n < size {
+		return n, io.ErrUnexpectedEOF
+	}
+
+	return n, s.promotePartial(hash)
+}
+
+// lockChunk locks the stripe of the chunk.
+func (s *store) lockChunk(hash string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(hash))
+	mu := &s.chunkLocks[h.Sum32()%chunkStripes]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// promotePartial moves the completed partial chunk into the pool, its hash
+// is checked on the way.
+func (s *store) promotePartial(hash string) error {
+	_, r, err := s.readStream(partialNamespace, chunkKey(hash))
+	if err != nil {
+		return err
+	}
+	_, err = s.WriteChunk(hash, r)
+	r.Close()
+	if err != nil && !errors.Is(err, errChunkMismatch) {
+		return err
+	}
+
+	// a chunk that does not match is sent again from the start
+	if derr := s.Delete(partialNamespace, chunkKey(hash)); err == nil {
+		err = derr
+	}
+	return err
+}
+
+func uploadKey(id string, key string) string {
+	return id + "/" + key
+}
+
+// recordUpload adds the chunk to the journal of the upload of the key.
+func (s *store) recordUpload(id string, key string, hash string) error {
+	_, err := s.Append(uploadNamespace, uploadKey(id, key), strings.NewReader(hash+"\n"))
+	return err
+}
+
+// uploadStatus returns the chunks of the upload of the key we have, and how
+// far we got with the ones we only have part of.
+func (s *store) uploadStatus(id string, key string) ([]string, map[string]int64, error) {
+	var (
+		complete = []string{}
+		partial  = make(map[string]int64)
+	)
+
+	if !s.Has(uploadNamespace, uploadKey(id, key)) {
+		return complete, partial, nil
+	}
+
+	_, r, err := s.readStream(uploadNamespace, uploadKey(id, key))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+
+	seen := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		hash := scanner.Text()
+		if seen[hash] {
+			continue
+		}
+		seen[hash] = true
+
+		if s.HasChunk(hash) {
+			complete = append(complete, hash)
+		} else if n := s.partialChunkSize(hash); n > 0 {
+			partial[hash] = n
+		}
+	}
+
+	return complete, partial, scanner.Err()
+}
+
+// finishUpload drops the journal once the manifest of the upload arrived.
+func (s *store) finishUpload(id string, key string) error {
+	return s.Delete(uploadNamespace, uploadKey(id, key))
+}
+
+// sweepUploads deletes partial chunks and journals of uploads nobody came
+// back for within the retention.
+func (s *store) sweepUploads(retention time.Duration) (int, error) {
+	deleted := 0
+	for _, id := range []string{partialNamespace, uploadNamespace} {
+		err := s.walk(id, func(info ObjectInfo) error {
+			if time.Since(info.ModTime) < retention {
+				return nil
+			}
+			if err := s.backend.Delete(id, info.Name); err != nil {
+				return err
+			}
+			deleted++
+			return nil
+		})
+		if err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// uploadProgress is what a peer already has of the upload we are sending.
+type uploadProgress struct {
+	complete map[string]bool
+	partial  map[string]int64
+}
+
+// offset returns where the chunk has to continue for the peer, or -1 if the
+// peer has all of it.
+func (p *uploadProgress) offset(hash string, size int64) int64 {
+	if p == nil {
+		return 0
+	}
+	if p.complete[hash] {
+		return -1
+	}
+	if n := p.partial[hash]; n <= size {
+		return n
+	}
+	return 0
+}
+
+func newUploadProgress(res MessageUploadStatusResponse) *uploadProgress {
+	p := &uploadProgress{
+		complete: make(map[string]bool, len(res.Chunks)),
+		partial:  res.Partial,
+	}
+	for _, hash := range res.Chunks {
+		p.complete[hash] = true
+	}
+	return p
+}
@@ -2,12 +2,13 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
 	"encoding/gob"
 	"fmt"
 	"io"
 	"log"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pavanmanikanta98/dfs-with-go/p2p"
@@ -20,6 +21,39 @@ type FileServerOpts struct {
 	PathTransformFunc PathTransformFunc
 	Transport         p2p.Transport
 	BootstrapNodes    []string
+	// Owner is the namespace the files of the node go to, its ID by
+	// default. Nodes with the same Owner and EncKey write the same files,
+	// the writes of a key they make concurrently become siblings.
+	Owner string
+	// Backend keeps the data of the node, files in StorageRoot by default.
+	// See DiskBackend, MemoryBackend and LogBackend.
+	Backend Backend
+	// ChunkSize is the size of the chunks files are split into before
+	// they are stored and replicated.
+	ChunkSize int
+	// ReplicationFactor is how many nodes hold the chunks of a replicated
+	// file, zero keeps them on all nodes. Every node has the manifest.
+	ReplicationFactor int
+	// MetadataNodes are the ids of the nodes that run the metadata service,
+	// which keeps the catalog of the files with raft. None runs without it.
+	MetadataNodes []string
+	// Quotas limit how much every owner, and all of them together, may
+	// store on this node. None are enforced by default.
+	Quotas Quotas
+	// HighWaterMark is the share of the disk that may be used before the
+	// node takes no more chunks, CriticalMark the share before it turns
+	// read-only. They default to 90% and 97%.
+	HighWaterMark float64
+	CriticalMark  float64
+	// DiskSpaceFunc measures the disk of the storage root, DiskSpace by
+	// default.
+	DiskSpaceFunc func(root string) (Capacity, error)
+	// CacheBytes is how much of the files the node reads but is no replica
+	// of it keeps for the next read, 256 MB by default. A negative one
+	// keeps none of them.
+	CacheBytes int64
+	// CachePolicy picks the cached file to evict, CacheLRU by default.
+	CachePolicy CachePolicy
 	// TCPTransportOpts  p2p.TCPTransportopts
 }
 
@@ -27,45 +61,124 @@ type FileServer struct {
 	FileServerOpts
 	peerLock sync.Mutex
 	peers    map[string]p2p.Peer
+	// nodes maps the ids of the nodes we are connected with to the address
+	// of their peer, peerNodes the other way around.
+	nodes     map[string]string
+	peerNodes map[string]string
+	// members are all nodes we ever saw and the address they listen on,
+	// the ones missing in nodes are down.
+	members  map[string]string
 	store    *store
 	quitch   chan struct{}
+	stopOnce sync.Once
+	// rebalancech asks the rebalancer for a round, see triggerRebalance.
+	rebalancech chan struct{}
+	// leaving is set once we are being decommissioned, leavingNodes are
+	// the peers that are.
+	leaving      atomic.Bool
+	leavingNodes map[string]bool
+	// transfers is the work in flight a shutdown waits for.
+	transfers *transfers
+	// meta is our raft if we are a metadata node, metaLeader the metadata
+	// node that answered us last.
+	meta       *raft
+	metaLeader atomic.Value
+	// ownCapacity is our Capacity as measured last, capacities the ones
+	// the peers advertised.
+	ownCapacity atomic.Value
+	capacities  map[string]Capacity
+	// cache keeps the files we read but don't hold a replica of.
+	cache *readCache
+
+	pendingLock sync.Mutex
+	pending     map[uint64]*pendingRequest
 }
 
 func NewFileServer(opts FileServerOpts) *FileServer {
 	storeOpts := StoreOpts{
 		Root:              opts.StorageRoot,
 		PathTransformFunc: opts.PathTransformFunc,
+		Backend:           opts.Backend,
+		Quotas:            opts.Quotas,
 	}
+	store := NewStore(storeOpts)
 	if len(opts.ID) == 0 {
-		opts.ID = generateID()
+		id, err := store.nodeID()
+		if err != nil {
+			log.Printf("failed to load the node id from %s: %v", store.Root, err)
+			id = generateID()
+		}
+		opts.ID = id
+	}
+	if len(opts.Owner) == 0 {
+		opts.Owner = opts.ID
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = defaultChunkSize
+	}
+	if opts.HighWaterMark <= 0 {
+		opts.HighWaterMark = defaultHighWaterMark
+	}
+	if opts.CriticalMark <= 0 {
+		opts.CriticalMark = defaultCriticalMark
 	}
-	return &FileServer{
+	if opts.DiskSpaceFunc == nil {
+		opts.DiskSpaceFunc = DiskSpace
+	}
+	if opts.CacheBytes == 0 {
+		opts.CacheBytes = defaultCacheBytes
+	}
+	s := &FileServer{
 		FileServerOpts: opts,
-		store:          NewStore(storeOpts),
+		store:          store,
 		quitch:         make(chan struct{}),
+		rebalancech:    make(chan struct{}, 1),
 		peers:          make(map[string]p2p.Peer),
+		nodes:          make(map[string]string),
+		peerNodes:      make(map[string]string),
+		members:        make(map[string]string),
+		leavingNodes:   make(map[string]bool),
+		transfers:      newTransfers(),
+		pending:        make(map[uint64]*pendingRequest),
+		capacities:     make(map[string]Capacity),
+	}
+	s.cache = newReadCache(store, opts.CacheBytes, opts.CachePolicy)
+	store.changed = func(id string, key string) {
+		if id == s.Owner {
+			s.cache.invalidate(key)
+		}
+	}
+	s.metaLeader.Store("")
+	s.ownCapacity.Store(Capacity{})
+	if slices.Contains(opts.MetadataNodes, opts.ID) {
+		s.meta = newRaft(opts.ID, opts.MetadataNodes, store)
 	}
+	return s
+}
+
+func encodeMessage(msg *Message) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return nil, fmt.Errorf("failed to encode payload: %v", err)
+	}
+	return buf.Bytes(), nil
 }
 
 // BIG thing to understand here
-func (s *FileServer) stream(msg *Message) error {
+func (s *FileServer) stream(peers []p2p.Peer, msg *Message, data []byte) error {
 
-	//Uses io.MultiWriter to broadcast to all peers at once.
-	//If any single peer connection fails,io.MultiWriter stops,
-	//causing the entire broadcast operation to fail for all peers.
+	// Every peer gets the header followed by the same bytes. A peer whose
+	// connection fails is dropped, the others still get the stream.
 
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(msg); err != nil {
-		return fmt.Errorf("failed to encode payload: %v", err)
+	header, err := encodeMessage(msg)
+	if err != nil {
+		return err
 	}
 
-	s.peerLock.Lock()
-	defer s.peerLock.Unlock()
-
-	for addr, peer := range s.peers {
-		if _, err := io.Copy(peer, bytes.NewReader(buf.Bytes())); err != nil {
-			log.Printf("Error broadcasting to peer %s: %v", addr, err)
-			delete(s.peers, addr)
+	for _, peer := range peers {
+		if _, err := peer.Stream(header, bytes.NewReader(data)); err != nil {
+			log.Printf("Error streaming to peer %s: %v", peer.RemoteAddr(), err)
+			s.dropPeer(peer)
 		}
 	}
 
@@ -73,16 +186,14 @@ func (s *FileServer) stream(msg *Message) error {
 }
 
 func (s *FileServer) broadcast(msg *Message) error {
-	buf := new(bytes.Buffer)
-
-	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+	buf, err := encodeMessage(msg)
+	if err != nil {
 		log.Printf("Error encoding message: %v", err) // Log the error
-		return fmt.Errorf("failed to encode payload: %v", err)
+		return err
 	}
 
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
+	for _, peer := range s.peerList() {
+		if err := peer.Send(buf); err != nil {
 			return err
 
 		}
@@ -93,154 +204,643 @@ func (s *FileServer) broadcast(msg *Message) error {
 
 }
 
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
+	buf, err := encodeMessage(msg)
+	if err != nil {
+		return err
+	}
+	return peer.Send(buf)
+}
+
 type Message struct {
 	// From    string
 	Payload any
 }
 
+// MessageStorageFile is followed by the stream of the encoded manifest of
+// the file, the chunks of the file are sent before it.
 type MessageStorageFile struct {
-	ID   string
-	Key  string
-	Size int64
+	// ReqID is set if the sender waits for a MessageStoreAck.
+	ReqID uint64
+	ID    string
+	Key   string
+	Size  int64
+	// Hold tells the receiver it is a replica of the file, the sender may
+	// know of nodes it does not know yet.
+	Hold bool
+	// Clock is the version vector of the manifest, Fence its fencing
+	// token and Expires when it runs out its time to live.
+	Clock   VersionVector
+	Fence   uint64
+	Expires time.Time
+}
+
+// MessageStoreChunk is followed by the stream of the encrypted chunk from
+// Offset on, Size bytes to its end. ID and Key tell which upload the chunk
+// belongs to, the chunk itself is shared by all owners. FileSize is how big
+// the file is up to and including the chunk, the receiver checks it against
+// the quota of the owner before it takes the chunk.
+type MessageStoreChunk struct {
+	ID       string
+	Key      string
+	Hash     string
+	Offset   int64
+	Size     int64
+	FileSize int64
+}
+
+// MessageUploadStatus asks a peer what it already has of the upload of the
+// key, so an interrupted upload does not start from byte zero again.
+type MessageUploadStatus struct {
+	ReqID uint64
+	ID    string
+	Key   string
+}
+
+type MessageUploadStatusResponse struct {
+	ReqID   uint64
+	Chunks  []string
+	Partial map[string]int64
 }
 
 type MessageGetFile struct {
-	ID  string
-	Key string
+	ReqID uint64
+	ID    string
+	Key   string
+	// Version asks for an old version of the file instead of the current
+	// one.
+	Version string
+}
+
+// MessageManifestResponse answers a MessageGetFile and is followed by the
+// stream of the encoded manifest if the peer has the file.
+type MessageManifestResponse struct {
+	ReqID uint64
+	Found bool
+	Size  int64
+}
+
+type MessageGetChunks struct {
+	ReqID  uint64
+	Chunks []ChunkRequest
+}
+
+// ChunkRequest asks for the chunk from Offset on, which is where a
+// download that died halfway continues.
+type ChunkRequest struct {
+	Hash   string
+	Offset int64
+}
+
+// MessageChunkResponse is sent for every chunk of a MessageGetChunks, followed
+// by the stream of the encrypted chunk from Offset on if the peer has it.
+type MessageChunkResponse struct {
+	ReqID  uint64
+	Hash   string
+	Found  bool
+	Offset int64
+	Size   int64
+}
+
+// streamHeader is implemented by every message that is followed by a stream
+// of bytes on the connection.
+type streamHeader interface {
+	streamSize() int64
+}
+
+func (m MessageStorageFile) streamSize() int64      { return m.Size }
+func (m MessageStoreChunk) streamSize() int64       { return m.Size }
+func (m MessageManifestResponse) streamSize() int64 { return m.Size }
+func (m MessageChunkResponse) streamSize() int64    { return m.Size }
+
+// ReadOpts select what GETWith reads of a file.
+type ReadOpts struct {
+	// Offset is where the read starts in the file.
+	Offset int64
+	// Length is how many bytes are read, zero reads to the end of the file.
+	Length int64
+	// Consistency is how many nodes are asked for the file, the newest
+	// version any of them has is read.
+	Consistency Consistency
+	// Version reads that version of a versioned file instead of the
+	// current one, see ListVersions.
+	Version string
+}
+
+// Durability is how the chunks of a file survive losing nodes. The zero
+// value replicates every chunk to every peer. With DataShards and
+// ParityShards set, every chunk is erasure coded into that many shards on
+// distinct nodes instead, any DataShards of them get the chunk back.
+type Durability struct {
+	DataShards   int
+	ParityShards int
+}
+
+func (d Durability) erasureCoded() bool {
+	return d.DataShards > 0 || d.ParityShards > 0
+}
+
+// WriteOpts select how StoreWith stores a file.
+type WriteOpts struct {
+	Durability Durability
+	// Consistency is how many nodes, us included, must have the file on
+	// disk before StoreWith returns.
+	Consistency Consistency
+	// Versioned keeps the version the write replaces, Retention says for
+	// how long. A file stays versioned once it was written that way.
+	Versioned bool
+	Retention Retention
+	// Lease is a lease of the lock named like the key. The write is fenced
+	// off once the lease ran out or the lock was taken over, and the
+	// replicas turn it down once a newer lease wrote the file.
+	Lease *Lease
+	// TTL is how long the file lives, zero keeps it until it is replaced.
+	TTL time.Duration
 }
 
 func (s *FileServer) GET(key string) (io.Reader, error) {
+	return s.GETWith(key, ReadOpts{})
+}
 
-	if s.store.Has(s.ID, key) {
+// GETWith reads the file, or the part of it selected by the opts. Only the
+// chunks holding that part are fetched over the network.
+func (s *FileServer) GETWith(key string, opts ReadOpts) (io.Reader, error) {
+	done, err := s.beginTransfer("get " + key)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
 
-		fmt.Printf("[%s] Serving File (%s) found locally. Reading from disk...\n", s.Transport.Addr(), key)
-		_, file, err := s.store.Read(s.ID, key)
-		return file, err
+	var (
+		hkey    = hashKey(key)
+		local   = s.store.Has(s.Owner, hkey)
+		peers   = s.peerList()
+		need    = opts.Consistency.required(len(s.memberList()))
+		cached  *Manifest
+		q       *quorumRead
+		m       *Manifest
+		holders []string
+	)
+	if len(peers)+1 < need {
+		return nil, fmt.Errorf("[%s] %s read of (%s) needs (%d) nodes, only (%d) are reachable", s.Transport.Addr(), opts.Consistency, key, need, len(peers)+1)
+	}
+	if opts.Version == "" && !local && need <= 1 {
+		cached = s.cache.peek(hkey)
 	}
 
-	fmt.Printf("[%s] Don't have file (%s )locally, fetching from network... \n", s.Transport.Addr(), key)
+	if opts.Version != "" {
+		// an old version never replaces the one we have
+		m, holders, err = s.fetchVersion(hkey, opts.Version)
+		local = false
+	} else if local && need <= 1 {
+		m, err = s.store.ReadManifest(s.Owner, hkey)
+	} else if cached != nil {
+		m = cached
+	} else {
+		if !local {
+			fmt.Printf("[%s] Don't have file (%s )locally, fetching from network... \n", s.Transport.Addr(), key)
+		}
+		q, err = s.readQuorum(hkey, need)
+		if err == nil {
+			m, holders = q.m, q.holders
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.Deleted || m.expired(time.Now()) {
+		return nil, fmt.Errorf("[%s] file (%s) not found, it expired", s.Transport.Addr(), key)
+	}
 
-	msg := Message{
-		Payload: MessageGetFile{
-			ID:  s.ID,
-			Key: hashKey(key),
-		},
+	// replicas that are behind get the version we read once we are done,
+	// the file we have is older if we had one that lost. A cached copy is
+	// dropped as soon as there is a newer version.
+	current := (local || m == cached) && (q == nil || q.local)
+	if q != nil && len(q.stale) > 0 && need > 1 {
+		defer func() { go s.repairReplicas(m, q.stale) }()
 	}
 
-	if err := s.broadcast(&msg); err != nil {
+	spans, err := m.spans(opts.Offset, opts.Length)
+	if err != nil {
 		return nil, err
 	}
 
-	time.Sleep(time.Millisecond * 500)
+	// we hold the chunks of the files we are a replica of, the others only
+	// if they are cached
+	held, _ := m.heldBy(s.ID, s.placement(s.Owner, m))
+	owned := len(held) > 0
+
+	missing := s.store.missingChunks(spannedChunks(spans))
+	if len(missing) == 0 && (current || opts.Version != "") {
+		if !owned && opts.Version == "" && s.cache.get(hkey) != nil {
+			fmt.Printf("[%s] Serving File (%s) from the cache\n", s.Transport.Addr(), key)
+		} else {
+			fmt.Printf("[%s] Serving File (%s) found locally. Reading from disk...\n", s.Transport.Addr(), key)
+		}
+		return s.store.newSpanReader(s.EncKey, spans), nil
+	}
 
-	for _, peer := range s.peers {
-		// First read the file size so we can limit the amount of bytes
-		//that we read from the connection, so it will  not hanging.
-		var fileSize int64
-		err := binary.Read(peer, binary.LittleEndian, &fileSize)
+	if len(missing) > 0 && m.Durability.erasureCoded() {
+		// nobody has the whole chunks, they are put back together
+		// from the shards of the nodes they were placed on.
+		if err := s.reconstructChunks(m.Durability, missing); err != nil {
+			return nil, err
+		}
+	} else if len(missing) > 0 {
+		if holders == nil {
+			// we know the file but lost chunks of it, or never were a
+			// replica of it.
+			if _, holders, err = s.fetchManifest(hkey); err != nil {
+				return nil, err
+			}
+		}
+		if err := s.fetchChunks(s.replicaHolders(s.Owner, m, holders), missing); err != nil {
+			return nil, err
+		}
+	}
+
+	// The manifest goes last, so we never have a manifest on disk
+	// without its chunks. Reading a file only makes it ours if we are one
+	// of its replicas, or already had an older version of it. The others
+	// go to the cache, once we have all of their chunks.
+	if !current && opts.Version == "" && (local || (owned && len(spans) == len(m.Chunks))) {
+		if err := s.store.WriteManifest(s.Owner, m); err != nil {
+			return nil, err
+		}
+	}
+	if !owned && opts.Version == "" && len(s.store.missingChunks(m.Chunks)) == 0 {
+		if s.cache.put(m) > 0 {
+			// chunks of evicted files our manifests still reference go
+			// with the next rebalance
+			s.triggerRebalance()
+		}
+	}
+
+	fmt.Printf("[%s] received (%d) chunks over the network from (%d) peers\n", s.Transport.Addr(), len(missing), len(holders))
+
+	return s.store.newSpanReader(s.EncKey, spans), nil
+}
+
+func (s *FileServer) Store(key string, r io.Reader) error {
+	return s.StoreWith(key, r, WriteOpts{})
+}
+
+// StoreWith stores the file the way the opts ask for.
+func (s *FileServer) StoreWith(key string, r io.Reader, opts WriteOpts) error {
+	// 1. cut the file into chunks, store every chunk to disk and stream it
+	//    to all the known peers in the network as soon as we have it, or
+	//    spread its shards over the nodes if the file is erasure coded.
+	// 2. store and broadcast the manifest listing the chunks.
+
+	if s.leaving.Load() {
+		return fmt.Errorf("[%s] refusing to store %s, the node is being decommissioned", s.Transport.Addr(), key)
+	}
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	if opts.Lease != nil {
+		if err := s.checkLease(opts.Lease, key); err != nil {
+			return err
+		}
+	}
+	done, err := s.beginTransfer("store " + key)
+	if err != nil {
+		return err
+	}
+	defer done()
 
+	var (
+		m      = &Manifest{Key: hashKey(key), Durability: opts.Durability, Weights: s.spaceWeights()}
+		chunks = newChunker(r, s.ChunkSize)
+		peers  = s.peerList()
+		coder  *erasureCoder
+		nodes  []string
+		// the replicas of a replicated file, the other peers only get
+		// the manifest.
+		replicas = s.placement(s.Owner, m)
+		local    = slices.Contains(replicas, s.ID)
+		in, _    = s.replicaPeers(peers, replicas)
+	)
+
+	// nothing is sent if we can't reach enough nodes anyway
+	reachable := len(replicas)
+	if opts.Durability.erasureCoded() {
+		reachable = len(peers) + 1
+	}
+	if _, err := s.writeQuorum(m.Key, opts.Consistency, opts.Durability.erasureCoded(), reachable); err != nil {
+		return err
+	}
+
+	if opts.Durability.erasureCoded() {
+		var err error
+		if coder, err = newErasureCoder(opts.Durability.DataShards, opts.Durability.ParityShards); err != nil {
+			return err
+		}
+		// nodes that are down get their shards later
+		nodes = s.memberList()
+		if len(nodes) < coder.data+coder.parity {
+			return fmt.Errorf("[%s] erasure coding %s into %d shards needs as many nodes, we know %d", s.Transport.Addr(), key, coder.data+coder.parity, len(nodes))
+		}
+	}
+
+	progress := s.uploadProgress(peers, m.Key)
+
+	for {
+		chunk, err := chunks.Next()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			continue
+			return err
 		}
 
-		n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
+		ref, encrypted, err := s.sealChunk(chunk)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		// n, err := s.store.Write(key, io.LimitReader(peer, fileSize))
-		// if err != nil {
-		// 	//continue
-		// 	return nil, err
-		// }
+		if coder != nil {
+			if ref, err = s.storeShards(coder, nodes, progress, m.Key, m.Size+ref.Size, ref, encrypted); err != nil {
+				return err
+			}
+		} else {
+			if local {
+				if err := s.checkSpace(int64(len(encrypted))); err != nil {
+					return err
+				}
+				if _, err := s.store.WriteChunk(ref.Hash, bytes.NewReader(encrypted)); err != nil {
+					return err
+				}
+			}
+
+			if err := s.replicateChunk(in, progress, s.Owner, m.Key, m.Size+ref.Size, ref.Hash, encrypted); err != nil {
+				return err
+			}
+		}
 
-		fmt.Printf("[%s] received (%d) bytes  over the network from (%s)\n", s.Transport.Addr(), n, peer.RemoteAddr())
+		m.Chunks = append(m.Chunks, ref)
+		m.Size += ref.Size
+	}
 
-		peer.CloseStream()
+	m.Version = s.store.nextVersion(s.Owner, m.Key)
+	m.Clock = s.store.nextClock(s.Owner, m.Key, s.ID)
+	m.Created = time.Now()
+	if opts.TTL > 0 {
+		m.Expires = m.Created.Add(opts.TTL)
+	}
+	m.Versioned, m.Retention = opts.Versioned, opts.Retention
+	if old, err := s.store.ReadManifest(s.Owner, m.Key); err == nil {
+		if old.Versioned && !opts.Versioned {
+			m.Versioned, m.Retention = true, old.Retention
+		}
+		m.Fence = old.Fence
+	}
+	if opts.Lease != nil {
+		m.Fence = opts.Lease.Token
+	}
+	if err := s.publish(m, peers, replicas, opts.Consistency); err != nil {
+		return err
 	}
 
-	_, file, err := s.store.Read(s.ID, key)
+	fmt.Printf("[%s] stored (%d) bytes in (%d) chunks and sent them to (%d) peers\n", s.Transport.Addr(), m.Size, len(m.Chunks), len(peers))
+
+	return nil
 
-	return file, err
 }
 
-func (s *FileServer) Store(key string, r io.Reader) error {
-	// 1.store the file to disk
-	// 2. broadcast this file to all the known peers in the network
+// publish writes the manifest of our file and sends it to the peers, whose
+// chunks are already where they belong. The consistency says how many of the
+// nodes that hold the file have to have it before publish returns.
+func (s *FileServer) publish(m *Manifest, peers []p2p.Peer, replicas []string, consistency Consistency) error {
+	if err := s.store.WriteManifest(s.Owner, m); err != nil {
+		return s.onNode(err)
+	}
+
+	b, err := m.Encode()
+	if err != nil {
+		return err
+	}
 
+	// our own copy is the first of the nodes that need to have it. Shards
+	// are on every node, the chunks of a replicated file on its replicas.
 	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
+		coded     = m.Durability.erasureCoded()
+		local     = slices.Contains(replicas, s.ID)
+		in, out   = s.replicaPeers(peers, replicas)
+		reachable = len(replicas)
 	)
-
-	size, err := s.store.Write(s.ID, key, tee)
+	if coded {
+		in, out = peers, nil
+		reachable = len(peers) + 1
+	}
+	need, err := s.writeQuorum(m.Key, consistency, coded, reachable)
 	if err != nil {
 		return err
 	}
+	if coded || local {
+		need--
+	}
+
+	req := s.newRequest()
+	defer s.finishRequest(req)
 
 	msg := Message{
 		Payload: MessageStorageFile{
-			ID:   s.ID,
-			Key:  hashKey(key),
-			Size: size + 16,
+			ReqID:   req.id,
+			ID:      s.Owner,
+			Key:     m.Key,
+			Size:    int64(len(b)),
+			Hold:    !coded,
+			Clock:   m.Clock,
+			Fence:   m.Fence,
+			Expires: m.Expires,
 		},
 	}
+	if err := s.stream(in, &msg, b); err != nil {
+		return err
+	}
 
-	if err := s.broadcast(&msg); err != nil {
+	// the rest only keeps the manifest, nobody waits for them
+	msg.Payload = MessageStorageFile{
+		ID:      s.Owner,
+		Key:     m.Key,
+		Size:    int64(len(b)),
+		Clock:   m.Clock,
+		Fence:   m.Fence,
+		Expires: m.Expires,
+	}
+	if err := s.stream(out, &msg, b); err != nil {
 		return err
 	}
 
-	time.Sleep(time.Millisecond * 5)
+	s.handOff(m, replicas)
 
-	// MultiWriter staff
+	if need > 0 {
+		if err := s.waitForAcks(req, need, m.Key); err != nil {
+			return err
+		}
+	}
 
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+	s.recordMeta(s.Owner, m, replicas)
+	return nil
+}
+
+// sealChunk encrypts the chunk with its convergent key and returns the
+// reference to it for the manifest.
+func (s *FileServer) sealChunk(chunk []byte) (ChunkRef, []byte, error) {
+	key := convergentKey(chunk)
+
+	encrypted, err := encryptChunk(key, chunk)
+	if err != nil {
+		return ChunkRef{}, nil, err
 	}
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	n, err := copyEncrypt(s.EncKey, fileBuffer, mw)
 
+	sealed, err := sealKey(s.EncKey, key)
 	if err != nil {
-		return err
+		return ChunkRef{}, nil, err
 	}
 
-	// for _, peer := range s.peers {
+	ref := ChunkRef{
+		Hash: hashChunk(encrypted),
+		Size: int64(len(chunk)),
+		Key:  sealed,
+	}
 
-	// 	peer.Send([]byte{p2p.IncomingStream})
-	// 	n, err := copyEncrypt(s.EncKey, fileBuffer, peer)
+	return ref, encrypted, nil
+}
 
-	// 	if err != nil {
-	// 		return err
-	// 	}
+// replicateChunk streams the encrypted chunk of the file of the owner to the
+// peers, every peer only gets the part of it that it doesn't have yet. The
+// file is size bytes big with the chunk.
+func (s *FileServer) replicateChunk(peers []p2p.Peer, progress map[string]*uploadProgress, id string, hkey string, size int64, hash string, encrypted []byte) error {
+	chunkSize := int64(len(encrypted))
 
-	// 	fmt.Printf("[%s] received and written (%d) bytes to disk\n", s.Transport.Addr(), n)
+	for _, peer := range peers {
+		offset := progress[peer.RemoteAddr().String()].offset(hash, chunkSize)
+		if offset < 0 {
+			continue
+		}
 
-	// }
+		msg := Message{
+			Payload: MessageStoreChunk{
+				ID:       id,
+				Key:      hkey,
+				Hash:     hash,
+				Offset:   offset,
+				Size:     chunkSize - offset,
+				FileSize: size,
+			},
+		}
 
-	fmt.Printf("[%s] received and written (%d) bytes to disk\n", s.Transport.Addr(), n)
+		if err := s.stream([]p2p.Peer{peer}, &msg, encrypted[offset:]); err != nil {
+			return err
+		}
+	}
 
 	return nil
+}
+
+// uploadProgress asks the peers what they already have of the upload of the
+// key. Peers that don't answer in time get the whole file.
+func (s *FileServer) uploadProgress(peers []p2p.Peer, hkey string) map[string]*uploadProgress {
+	progress := make(map[string]*uploadProgress)
+	if len(peers) == 0 {
+		return progress
+	}
+
+	req := s.newRequest()
+	defer s.finishRequest(req)
+
+	msg := Message{
+		Payload: MessageUploadStatus{
+			ReqID: req.id,
+			ID:    s.Owner,
+			Key:   hkey,
+		},
+	}
+
+	asked := 0
+	for _, peer := range peers {
+		if err := s.send(peer, &msg); err != nil {
+			log.Printf("[%s] failed to ask %s for the upload status: %v", s.Transport.Addr(), peer.RemoteAddr(), err)
+			continue
+		}
+		asked++
+	}
+
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
+
+	for ; asked > 0; asked-- {
+		rep := req.wait(timeout)
+		if rep == nil {
+			break
+		}
+		progress[rep.from] = newUploadProgress(rep.payload.(MessageUploadStatusResponse))
+		rep.Close()
+	}
 
+	return progress
 }
 
 func (s *FileServer) Stop() {
 
-	close(s.quitch)
+	// Decommission stops the server too
+	s.stopOnce.Do(func() { close(s.quitch) })
 }
 
 func (s *FileServer) OnPeer(peer p2p.Peer) error {
 	s.peerLock.Lock()
+	s.peers[peer.RemoteAddr().String()] = peer
+	s.peerLock.Unlock()
+
+	log.Printf("connected with (remote) peer %s", peer.RemoteAddr())
+
+	return s.sendHello(peer)
+
+}
 
+func (s *FileServer) peer(addr string) (p2p.Peer, bool) {
+	s.peerLock.Lock()
 	defer s.peerLock.Unlock()
 
-	s.peers[peer.RemoteAddr().String()] = peer
+	peer, ok := s.peers[addr]
+	return peer, ok
+}
 
-	log.Printf("connected with (remote) peer %s", peer.RemoteAddr())
+func (s *FileServer) peerList() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
 
-	return nil
+	peers := make([]p2p.Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
 
+func (s *FileServer) dropPeer(peer p2p.Peer) {
+	s.forgetPeer(peer)
+	peer.Close()
+}
+
+// forgetPeer removes the peer and its node from the lists. The files it was
+// a replica of lost one, the rebalancer picks new ones.
+func (s *FileServer) forgetPeer(peer p2p.Peer) {
+	s.peerLock.Lock()
+	addr := peer.RemoteAddr().String()
+	_, known := s.peers[addr]
+	if id, ok := s.peerNodes[addr]; ok && s.nodes[id] == addr {
+		delete(s.nodes, id)
+		delete(s.leavingNodes, id)
+	}
+	delete(s.peerNodes, addr)
+	delete(s.peers, addr)
+	s.peerLock.Unlock()
+
+	if known {
+		s.triggerRebalance()
+	}
 }
 
 func (s *FileServer) loop() {
@@ -254,11 +854,26 @@ func (s *FileServer) loop() {
 		case rpc := <-s.Transport.Consume():
 			var msg Message
 			if err := gob.NewDecoder(bytes.NewReader(rpc.Payload)).Decode(&msg); err != nil {
-				if err == io.EOF {
-					log.Println("Received EOF, continuing to next message.")
-					continue
-				}
 				log.Printf("Error decoding Message: %v", err)
+				if rpc.Stream {
+					// we can't tell how long the stream is, so the
+					// connection is lost anyway.
+					if peer, ok := s.peer(rpc.From); ok {
+						s.dropPeer(peer)
+						peer.CloseStream()
+					}
+				}
+				continue
+			}
+
+			if rpc.Stream {
+				// Streams are handled on their own goroutine, the read loop of
+				// the peer waits for us and the other peers don't have to.
+				go func(from string) {
+					if err := s.handleStream(from, &msg); err != nil {
+						log.Printf("Error handling stream: %v", err)
+					}
+				}(rpc.From)
 				continue
 			}
 
@@ -277,14 +892,50 @@ func (s *FileServer) loop() {
 
 // handle the payload or Message
 func (s *FileServer) handleMessage(from string, msg *Message) error {
+	if isRequest(msg.Payload) && s.transfers.closing() {
+		return fmt.Errorf("[%s] turned down %T from %s: %v", s.Transport.Addr(), msg.Payload, from, errShuttingDown)
+	}
 
 	switch v := msg.Payload.(type) {
-	case MessageStorageFile:
-		return s.handleMessageStoreFile(from, v)
-		// fmt.Printf("Received Message : %+v\n", v)
-
+	case MessageHello:
+		return s.handleMessageHello(from, v)
 	case MessageGetFile:
-		return s.handleMessageFile(from, v)
+		return s.handleMessageGetFile(from, v)
+	case MessageGetChunks:
+		return s.handleMessageGetChunks(from, v)
+	case MessageUploadStatus:
+		return s.handleMessageUploadStatus(from, v)
+	case MessageUploadStatusResponse:
+		s.resolve(v.ReqID, from, v, nil)
+		return nil
+	case MessageStoreAck:
+		s.resolve(v.ReqID, from, v, nil)
+		return nil
+	case MessageRequestVote, MessageRequestVoteResponse, MessageAppendEntries, MessageAppendEntriesResponse,
+		MessageInstallSnapshot, MessageMetaPropose, MessageMetaLookup:
+		return s.handleRaft(from, v)
+	case MessageMetaProposeResponse:
+		s.resolve(v.ReqID, from, v, nil)
+		return nil
+	case MessageMetaLookupResponse:
+		s.resolve(v.ReqID, from, v, nil)
+		return nil
+	case MessageHint:
+		return s.handleMessageHint(from, v)
+	case MessageLeaving:
+		return s.handleMessageLeaving(from, v)
+	case MessageCapacity:
+		return s.handleMessageCapacity(from, v)
+	case MessageMerkleHashes:
+		return s.handleMessageMerkleHashes(from, v)
+	case MessageMerkleEntries:
+		return s.handleMessageMerkleEntries(from, v)
+	case MessageMerkleHashesResponse:
+		s.resolve(v.ReqID, from, v, nil)
+		return nil
+	case MessageMerkleEntriesResponse:
+		s.resolve(v.ReqID, from, v, nil)
+		return nil
 	default:
 		log.Printf("Unhandled payload type: %T", v)
 		return nil
@@ -293,68 +944,303 @@ func (s *FileServer) handleMessage(from string, msg *Message) error {
 	// return nil
 }
 
-func (s *FileServer) handleMessageFile(from string, msg MessageGetFile) error {
+// handleStream hands the stream that follows the header to its handler.
+// Whatever the handler does not read is drained, afterwards the read loop of
+// the peer can continue.
+func (s *FileServer) handleStream(from string, msg *Message) error {
+	peer, ok := s.peer(from)
+	if !ok {
+		return fmt.Errorf("peer %s not found in the peer list", from)
+	}
+	defer peer.CloseStream()
+
+	header, ok := msg.Payload.(streamHeader)
+	if !ok {
+		s.dropPeer(peer)
+		return fmt.Errorf("unexpected stream with payload type %T from %s", msg.Payload, from)
+	}
+
+	r := io.LimitReader(peer, header.streamSize())
+	defer io.Copy(io.Discard, r)
+
+	// answers are part of transfers that already began
+	done, err := s.beginTransfer(fmt.Sprintf("%T from %s", msg.Payload, from))
+	if err != nil && isRequest(msg.Payload) {
+		if v, ok := msg.Payload.(MessageStorageFile); ok {
+			s.ackStoreFile(peer, v, 0, err)
+		}
+		return err
+	}
+	if err == nil {
+		defer done()
+	}
+
+	switch v := msg.Payload.(type) {
+	case MessageStorageFile:
+		version, err := s.handleMessageStoreFile(from, v, r)
+		if ackErr := s.ackStoreFile(peer, v, version, err); ackErr != nil {
+			log.Printf("[%s] failed to acknowledge %s to %s: %v", s.Transport.Addr(), v.Key, from, ackErr)
+		}
+		return err
+	case MessageStoreChunk:
+		return s.handleMessageStoreChunk(from, v, r)
+	case MessageManifestResponse:
+		s.resolve(v.ReqID, from, v, r)
+	case MessageChunkResponse:
+		s.resolve(v.ReqID, from, v, r)
+	}
+
+	return nil
+}
+
+func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
+	peer, ok := s.peer(from)
+
+	if !ok {
+		return fmt.Errorf("peer %s not found in the peer list", from)
+	}
+
+	if msg.Version != "" {
+		return s.serveVersion(peer, msg)
+	}
+
 	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not found in the disk", s.Transport.Addr(), msg.Key)
+		fmt.Printf("[%s] need to serve file (%s) but it does not found in the disk\n", s.Transport.Addr(), msg.Key)
+		return s.streamReply(peer, MessageManifestResponse{ReqID: msg.ReqID}, nil)
 	}
 
 	fmt.Printf("[%s] serving file (%s) over the network \n", s.Transport.Addr(), msg.Key)
 
-	fileSize, r, err := s.store.Read(msg.ID, msg.Key)
+	size, r, err := s.store.readStream(msg.ID, msg.Key)
 	if err != nil {
 		return err
 	}
+	defer r.Close()
+
+	res := MessageManifestResponse{
+		ReqID: msg.ReqID,
+		Found: true,
+		Size:  size,
+	}
+
+	return s.streamReply(peer, res, r)
+}
+
+// serveVersion answers with the manifest of an old version of the file.
+func (s *FileServer) serveVersion(peer p2p.Peer, msg MessageGetFile) error {
+	m, err := s.store.readVersion(msg.ID, msg.Key, msg.Version)
+	if err != nil {
+		return s.streamReply(peer, MessageManifestResponse{ReqID: msg.ReqID}, nil)
+	}
 
-	// NEW LEARNING :  In GO is basically you could assert if
-	//certain implementations are true like you would say that
-	//ReadCloser , a boolean equals the reader is that a readCloser
-	//(if it's a read closer) then  ok will be true next follows the next
-	if rc, ok := r.(io.ReadCloser); ok {
+	b, err := m.Encode()
+	if err != nil {
+		return err
+	}
 
-		defer rc.Close()
+	res := MessageManifestResponse{
+		ReqID: msg.ReqID,
+		Found: true,
+		Size:  int64(len(b)),
 	}
+	return s.streamReply(peer, res, bytes.NewReader(b))
+}
 
-	peer, ok := s.peers[from]
+func (s *FileServer) handleMessageGetChunks(from string, msg MessageGetChunks) error {
+	peer, ok := s.peer(from)
 
 	if !ok {
 		return fmt.Errorf("peer %s not found in the peer list", from)
 	}
 
-	// First send the "incomingStream" byte to the peer and then we can
-	//send the file size as an int64.
-	peer.Send([]byte{p2p.IncomingStream})
-	// var fileSize int64 = 17
-	binary.Write(peer, binary.LittleEndian, fileSize)
+	// Chunks can be large, we don't want to block the loop while they are
+	// written to the connection.
+	go func() {
+		done, err := s.beginTransfer("chunks to " + from)
+		if err != nil {
+			return
+		}
+		defer done()
+
+		var n int64
+		for _, c := range msg.Chunks {
+			written, err := s.serveChunk(peer, msg.ReqID, c)
+			if err != nil {
+				log.Printf("[%s] failed to serve chunk %s to %s: %v", s.Transport.Addr(), c.Hash, from, err)
+				return
+			}
+			n += written
+		}
 
-	n, err := io.Copy(peer, r)
-	if err != nil {
-		return err
-	}
+		fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, from)
+	}()
 
-	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, from)
 	return nil
 }
 
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStorageFile) error {
+func (s *FileServer) serveChunk(peer p2p.Peer, reqID uint64, c ChunkRequest) (int64, error) {
+	size, _, err := s.store.stat(chunkNamespace, chunkKey(c.Hash))
+	if err != nil {
+		return 0, s.streamReply(peer, MessageChunkResponse{ReqID: reqID, Hash: c.Hash}, nil)
+	}
 
-	peer, ok := s.peers[from]
+	offset := c.Offset
+	if offset < 0 || offset > size {
+		offset = 0
+	}
+	// not every backend can seek, ReadChunkAt skips ahead for those
+	r, err := s.store.ReadChunkAt(c.Hash, offset, 0)
+	if err != nil {
+		return 0, s.streamReply(peer, MessageChunkResponse{ReqID: reqID, Hash: c.Hash}, nil)
+	}
+	defer r.Close()
+
+	res := MessageChunkResponse{
+		ReqID:  reqID,
+		Hash:   c.Hash,
+		Found:  true,
+		Offset: offset,
+		Size:   size - offset,
+	}
 
+	return res.Size, s.streamReply(peer, res, r)
+}
+
+func (s *FileServer) handleMessageUploadStatus(from string, msg MessageUploadStatus) error {
+	peer, ok := s.peer(from)
 	if !ok {
 		return fmt.Errorf("peer %s not found in the peer list", from)
 	}
 
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	chunks, partial, err := s.store.uploadStatus(msg.ID, msg.Key)
+	if err != nil {
+		return err
+	}
+
+	res := Message{
+		Payload: MessageUploadStatusResponse{
+			ReqID:   msg.ReqID,
+			Chunks:  chunks,
+			Partial: partial,
+		},
+	}
+
+	return s.send(peer, &res)
+}
+
+// streamReply sends the reply header followed by r, which has to yield
+// exactly as many bytes as the header announces.
+func (s *FileServer) streamReply(peer p2p.Peer, payload any, r io.Reader) error {
+	header, err := encodeMessage(&Message{Payload: payload})
 	if err != nil {
 		return err
 	}
+	if r == nil {
+		r = bytes.NewReader(nil)
+	}
+
+	_, err = peer.Stream(header, r)
+	return err
+}
+
+// handleMessageStoreFile stores the manifest and returns its version. The
+// chunks came before it on the same connection, if any of the ones we are
+// supposed to hold is missing the write did not make it.
+func (s *FileServer) handleMessageStoreFile(from string, msg MessageStorageFile, r io.Reader) (int64, error) {
+
+	m, err := decodeManifest(r)
+	if err != nil {
+		return 0, err
+	}
+	if m.Key != msg.Key {
+		return 0, fmt.Errorf("[%s] manifest of %s sent as %s by %s", s.Transport.Addr(), m.Key, msg.Key, from)
+	}
+	if err := s.checkWritable(); err != nil {
+		return 0, err
+	}
+	if !m.Clock.equal(msg.Clock) || m.Fence != msg.Fence || !m.Expires.Equal(msg.Expires) {
+		return 0, fmt.Errorf("[%s] manifest of %s from %s does not match the header it was sent with", s.Transport.Addr(), msg.Key, from)
+	}
+
+	if err := s.store.WriteManifest(msg.ID, m); err != nil {
+		return 0, s.onNode(err)
+	}
+
+	if err := s.store.finishUpload(msg.ID, msg.Key); err != nil {
+		log.Printf("[%s] failed to drop the upload journal of %s: %v", s.Transport.Addr(), msg.Key, err)
+	}
+
+	replicas := s.placement(msg.ID, m)
+	if msg.Hold {
+		replicas = append(replicas, s.ID)
+	}
+	if missing := s.store.missingHeld(m, s.ID, replicas); len(missing) > 0 {
+		return m.Version, &missingChunksError{key: msg.Key, hashes: missing}
+	}
+
+	fmt.Printf("[%s]  Writtten manifest (%s) of %d byte to disk.\n", s.Transport.Addr(), msg.Key, m.Size)
+
+	return m.Version, nil
+}
+
+func (s *FileServer) handleMessageStoreChunk(from string, msg MessageStoreChunk, r io.Reader) error {
+
+	if err := s.checkQuota(msg.ID, msg.Key, msg.FileSize); err != nil {
+		return err
+	}
+	if err := s.checkSpace(msg.Size); err != nil {
+		return err
+	}
 
-	fmt.Printf("[%s]  Writtten %d byte to disk.\n", s.Transport.Addr(), n)
-	// peer.(*p2p.TCPPeer).Wg.Done()
-	peer.CloseStream()
+	if msg.Offset == 0 {
+		if err := s.store.recordUpload(msg.ID, msg.Key, msg.Hash); err != nil {
+			return err
+		}
+	}
+
+	// if the stream breaks off, the bytes we got stay in the partial chunk
+	// and the sender continues from there next time.
+	if _, err := s.store.WriteChunkAt(msg.Hash, msg.Offset, msg.Offset+msg.Size, r); err != nil {
+		return err
+	}
 
 	return nil
 }
 
+// collectGarbage periodically sweeps the chunks nobody references anymore.
+func (s *FileServer) collectGarbage() {
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			n, err := s.store.sweepChunks(chunkGracePeriod)
+			if err != nil {
+				log.Printf("[%s] garbage collection failed: %v", s.Transport.Addr(), err)
+				continue
+			}
+			if n > 0 {
+				log.Printf("[%s] garbage collected %d chunks", s.Transport.Addr(), n)
+			}
+
+			if _, err := s.store.sweepUploads(uploadRetention); err != nil {
+				log.Printf("[%s] failed to sweep abandoned uploads: %v", s.Transport.Addr(), err)
+			}
+
+			if _, err := s.store.sweepHints(hintRetention); err != nil {
+				log.Printf("[%s] failed to sweep old hints: %v", s.Transport.Addr(), err)
+			}
+
+			if _, err := s.store.pruneVersions(); err != nil {
+				log.Printf("[%s] failed to prune old versions: %v", s.Transport.Addr(), err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
 func (s *FileServer) BootstrapNetwork() error {
 	for _, addr := range s.BootstrapNodes {
 
@@ -379,6 +1265,8 @@ func (s *FileServer) BootstrapNetwork() error {
 
 func (s *FileServer) Start() error {
 
+	s.measureSpace()
+
 	if err := s.Transport.ListenAndAccept(); err != nil {
 
 		return err
@@ -387,6 +1275,16 @@ func (s *FileServer) Start() error {
 
 	s.BootstrapNetwork()
 
+	go s.collectGarbage()
+	go s.antiEntropy()
+	go s.replayLoop()
+	go s.rebalanceLoop()
+	go s.expireLoop()
+	go s.spaceLoop()
+	if s.meta != nil {
+		go s.raftLoop()
+	}
+
 	s.loop()
 	fmt.Println("File server died")
 	return nil
@@ -396,7 +1294,31 @@ func (s *FileServer) Start() error {
 func init() {
 
 	// fmt.Println("rtc")
+	gob.Register(MessageHello{})
 	gob.Register(MessageGetFile{})
 	gob.Register(MessageStorageFile{})
+	gob.Register(MessageStoreChunk{})
+	gob.Register(MessageManifestResponse{})
+	gob.Register(MessageGetChunks{})
+	gob.Register(MessageChunkResponse{})
+	gob.Register(MessageUploadStatus{})
+	gob.Register(MessageUploadStatusResponse{})
+	gob.Register(MessageStoreAck{})
+	gob.Register(MessageHint{})
+	gob.Register(MessageMerkleHashes{})
+	gob.Register(MessageMerkleHashesResponse{})
+	gob.Register(MessageMerkleEntries{})
+	gob.Register(MessageMerkleEntriesResponse{})
+	gob.Register(MessageLeaving{})
+	gob.Register(MessageRequestVote{})
+	gob.Register(MessageRequestVoteResponse{})
+	gob.Register(MessageAppendEntries{})
+	gob.Register(MessageAppendEntriesResponse{})
+	gob.Register(MessageInstallSnapshot{})
+	gob.Register(MessageMetaPropose{})
+	gob.Register(MessageMetaProposeResponse{})
+	gob.Register(MessageMetaLookup{})
+	gob.Register(MessageMetaLookupResponse{})
+	gob.Register(MessageCapacity{})
 
 }
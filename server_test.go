@@ -0,0 +1,1680 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pavanmanikanta98/dfs-with-go/p2p"
+)
+
+func newTestServer(t *testing.T, listenAddr string, nodes ...string) *FileServer {
+	return newTestServerWith(t, listenAddr, FileServerOpts{BootstrapNodes: nodes})
+}
+
+// newTestServerWith starts a server with the options, the ones every test
+// server shares are filled in.
+func newTestServerWith(t *testing.T, listenAddr string, opts FileServerOpts) *FileServer {
+	tr := p2p.NewTCPTransport(p2p.TCPTransportopts{
+		ListenAddr:    listenAddr,
+		HandShakeFunc: p2p.NoPHandShakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+
+	if opts.EncKey == nil {
+		opts.EncKey = newEncryptionkey()
+	}
+	opts.StorageRoot = t.TempDir()
+	opts.PathTransformFunc = CASPathTransformFunc
+	opts.Transport = tr
+	opts.ChunkSize = 1024
+
+	s := NewFileServer(opts)
+	tr.OnPeer = s.OnPeer
+	tr.OnPeerLost = s.OnPeerLost
+
+	go s.Start()
+	t.Cleanup(s.Stop)
+
+	return s
+}
+
+// waitForPeers blocks until every server is connected to n peers and knows
+// which nodes they are.
+func waitForPeers(t *testing.T, n int, servers ...*FileServer) {
+	deadline := time.Now().Add(3 * time.Second)
+	for _, s := range servers {
+		for len(s.peerList()) < n || len(s.nodeList()) < n+1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("[%s] connected to %d peers, want %d", s.Transport.Addr(), len(s.peerList()), n)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// newPlacement returns the replicas a file the server writes now goes to.
+func newPlacement(s *FileServer, key string) []string {
+	return s.placement(s.ID, &Manifest{Key: hashKey(key), Weights: s.spaceWeights()})
+}
+
+func TestStoreAndGetOverNetwork(t *testing.T) {
+	s1 := newTestServer(t, ":7101")
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServer(t, ":7102", ":7101")
+	waitForPeers(t, 1, s1, s2)
+
+	data := make([]byte, 20000)
+	rand.Read(data)
+	if err := s2.Store("big.file", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := s2.store.ReadManifest(s2.ID, hashKey("big.file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Chunks) < 2 || m.Size != int64(len(data)) {
+		t.Fatalf("want %d bytes in chunks, have %d chunks of %d bytes", len(data), len(m.Chunks), m.Size)
+	}
+
+	// throw away the local copy so the file has to come from s1
+	if err := s2.store.DeleteManifest(s2.ID, m.Key); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range m.Chunks {
+		if err := s2.store.Delete(chunkNamespace, chunkKey(c.Hash)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	r, err := s2.GET("big.file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("have %d bytes back, want %d", len(b), len(data))
+	}
+
+	// a range in the middle of the file only needs the chunks holding it
+	if err := s2.store.DeleteManifest(s2.ID, m.Key); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range m.Chunks {
+		s2.store.Delete(chunkNamespace, chunkKey(c.Hash))
+	}
+
+	r, err = s2.GETWith("big.file", ReadOpts{Offset: 5000, Length: 3000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err = io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data[5000:8000]) {
+		t.Fatalf("have %d bytes of the range back, want 3000", len(b))
+	}
+
+	fetched := 0
+	for _, c := range m.Chunks {
+		if s2.store.HasChunk(c.Hash) {
+			fetched++
+		}
+	}
+	if fetched == 0 || fetched == len(m.Chunks) {
+		t.Fatalf("fetched %d of %d chunks for the range", fetched, len(m.Chunks))
+	}
+
+	if _, err := s2.GET("not.there"); err == nil {
+		t.Fatal("expected an error for a file nobody has")
+	}
+}
+
+func TestGetFallsBackToOtherHolders(t *testing.T) {
+	s1 := newTestServer(t, ":7111")
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServer(t, ":7112", ":7111")
+	time.Sleep(50 * time.Millisecond)
+	s3 := newTestServer(t, ":7113", ":7111", ":7112")
+	waitForPeers(t, 2, s1, s2, s3)
+
+	data := make([]byte, 50000)
+	rand.Read(data)
+	// every holder has the chunks before they are taken away
+	if err := s3.StoreWith("spread.file", bytes.NewReader(data), WriteOpts{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := s3.store.ReadManifest(s3.ID, hashKey("spread.file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// s1 still has the manifest but lost every other chunk, s3 lost it all
+	for i, c := range m.Chunks {
+		if i%2 == 0 {
+			s1.store.Delete(chunkNamespace, chunkKey(c.Hash))
+		}
+		s3.store.Delete(chunkNamespace, chunkKey(c.Hash))
+	}
+	if err := s3.store.DeleteManifest(s3.ID, m.Key); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s3.GET("spread.file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("have %d bytes back, want %d", len(b), len(data))
+	}
+}
+
+func TestErasureCodedStoreSurvivesLostNode(t *testing.T) {
+	s1 := newTestServer(t, ":7121")
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServer(t, ":7122", ":7121")
+	time.Sleep(50 * time.Millisecond)
+	s3 := newTestServer(t, ":7123", ":7121", ":7122")
+	waitForPeers(t, 2, s1, s2, s3)
+
+	data := make([]byte, 30000)
+	rand.Read(data)
+
+	opts := WriteOpts{Durability: Durability{DataShards: 2, ParityShards: 1}}
+	if err := s3.StoreWith("coded.file", bytes.NewReader(data), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := s3.store.ReadManifest(s3.ID, hashKey("coded.file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	servers := map[string]*FileServer{s1.ID: s1, s2.ID: s2, s3.ID: s3}
+	for _, c := range m.Chunks {
+		if len(c.Shards) != 3 {
+			t.Fatalf("chunk %s has %d shards, want 3", c.Hash, len(c.Shards))
+		}
+		for _, s := range servers {
+			if s.store.HasChunk(c.Hash) {
+				t.Fatalf("[%s] has the whole chunk %s", s.Transport.Addr(), c.Hash)
+			}
+		}
+		for i, node := range c.Nodes {
+			// the shards are still on their way when Store returns
+			deadline := time.Now().Add(3 * time.Second)
+			for !servers[node].store.HasChunk(c.Shards[i]) {
+				if time.Now().After(deadline) {
+					t.Fatalf("node %s is missing shard %d of chunk %s", node, i, c.Hash)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+
+	// s1 loses all its shards, the other two nodes are enough
+	for _, c := range m.Chunks {
+		for _, hash := range c.Shards {
+			s1.store.Delete(chunkNamespace, chunkKey(hash))
+		}
+	}
+
+	r, err := s3.GET("coded.file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("have %d bytes back, want %d", len(b), len(data))
+	}
+
+	// more shards than nodes can't be placed
+	opts.Durability = Durability{DataShards: 3, ParityShards: 2}
+	if err := s3.StoreWith("wide.file", bytes.NewReader(data), opts); err == nil {
+		t.Fatal("expected an error for more shards than nodes")
+	}
+}
+
+func TestQuorumReadPicksNewestVersion(t *testing.T) {
+	s1 := newTestServer(t, ":7131")
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServer(t, ":7132", ":7131")
+	time.Sleep(50 * time.Millisecond)
+	s3 := newTestServer(t, ":7133", ":7131", ":7132")
+	waitForPeers(t, 2, s1, s2, s3)
+
+	all := WriteOpts{Consistency: ConsistencyAll}
+	if err := s3.StoreWith("versioned.file", bytes.NewReader([]byte("first version")), all); err != nil {
+		t.Fatal(err)
+	}
+
+	// every node acknowledged, so it's on every disk by now
+	for _, s := range []*FileServer{s1, s2} {
+		if !s.store.Has(s3.ID, hashKey("versioned.file")) {
+			t.Fatalf("[%s] does not have the file after an ALL write", s.Transport.Addr())
+		}
+	}
+
+	old, err := s3.store.ReadManifest(s3.ID, hashKey("versioned.file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s3.StoreWith("versioned.file", bytes.NewReader([]byte("second version")), all); err != nil {
+		t.Fatal(err)
+	}
+
+	// s3 goes back to the old version, as if it missed the second write
+	if err := s3.store.DeleteManifest(s3.ID, old.Key); err != nil {
+		t.Fatal(err)
+	}
+	if err := s3.store.WriteManifest(s3.ID, old); err != nil {
+		t.Fatal(err)
+	}
+
+	read := func(opts ReadOpts) string {
+		r, err := s3.GETWith("versioned.file", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	if b := read(ReadOpts{}); b != "first version" {
+		t.Fatalf("ONE read %q, want the local copy", b)
+	}
+	if b := read(ReadOpts{Consistency: ConsistencyQuorum}); b != "second version" {
+		t.Fatalf("QUORUM read %q, want the newest version", b)
+	}
+}
+
+func TestQuorumReadRepairsReplicas(t *testing.T) {
+	s1 := newTestServer(t, ":7141")
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServer(t, ":7142", ":7141")
+	time.Sleep(50 * time.Millisecond)
+	s3 := newTestServer(t, ":7143", ":7141", ":7142")
+	waitForPeers(t, 2, s1, s2, s3)
+
+	hkey := hashKey("repaired.file")
+	all := WriteOpts{Consistency: ConsistencyAll}
+
+	if err := s3.StoreWith("repaired.file", bytes.NewReader([]byte("first version")), all); err != nil {
+		t.Fatal(err)
+	}
+	old, err := s2.store.ReadManifest(s3.ID, hkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 10000)
+	rand.Read(data)
+	if err := s3.StoreWith("repaired.file", bytes.NewReader(data), all); err != nil {
+		t.Fatal(err)
+	}
+	m, err := s3.store.ReadManifest(s3.ID, hkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// s1 lost the file, s2 missed the second write
+	if err := s1.store.DeleteManifest(s3.ID, hkey); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range m.Chunks {
+		s1.store.Delete(chunkNamespace, chunkKey(c.Hash))
+	}
+	if err := s2.store.DeleteManifest(s3.ID, hkey); err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.store.WriteManifest(s3.ID, old); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s3.GETWith("repaired.file", ReadOpts{Consistency: ConsistencyQuorum})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatalf("have %d bytes back, want %d", len(b), len(data))
+	}
+
+	// the repair runs in the background
+	deadline := time.Now().Add(3 * time.Second)
+	for _, s := range []*FileServer{s1, s2} {
+		for {
+			got, err := s.store.ReadManifest(s3.ID, hkey)
+			if err == nil && got.sameVersion(m) && len(s.store.missingChunks(m.Chunks)) == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("[%s] was not repaired", s.Transport.Addr())
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestQuorumFailsOnIsolatedNode(t *testing.T) {
+	s1 := newTestServer(t, ":7331")
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServer(t, ":7332", ":7331")
+	time.Sleep(50 * time.Millisecond)
+	s3 := newTestServer(t, ":7333", ":7331", ":7332")
+	waitForPeers(t, 2, s1, s2, s3)
+
+	quorum := WriteOpts{Consistency: ConsistencyQuorum}
+	if err := s1.StoreWith("cut.file", bytes.NewReader([]byte("before")), quorum); err != nil {
+		t.Fatal(err)
+	}
+
+	// s1 is cut off from the others, they are still members
+	for _, s := range []*FileServer{s2, s3} {
+		peer, ok := s1.nodePeer(s.ID)
+		if !ok {
+			t.Fatalf("[%s] does not know %s", s1.Transport.Addr(), s.Transport.Addr())
+		}
+		s1.dropPeer(peer)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for len(s1.peerList()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("s1 is still connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := s1.StoreWith("cut.file", bytes.NewReader([]byte("after")), quorum); err == nil {
+		t.Fatal("QUORUM write on an isolated node succeeded")
+	}
+	if _, err := s1.GETWith("cut.file", ReadOpts{Consistency: ConsistencyQuorum}); err == nil {
+		t.Fatal("QUORUM read on an isolated node succeeded")
+	}
+
+	// ONE only needs our own disk
+	if err := s1.StoreWith("cut.file", bytes.NewReader([]byte("after")), WriteOpts{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAntiEntropyPullsMissedFiles(t *testing.T) {
+	s1 := newTestServer(t, ":7151")
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServer(t, ":7152", ":7151")
+	waitForPeers(t, 1, s1, s2)
+
+	data := make([]byte, 10000)
+	rand.Read(data)
+	all := WriteOpts{Consistency: ConsistencyAll}
+	if err := s2.StoreWith("missed.file", bytes.NewReader(data), all); err != nil {
+		t.Fatal(err)
+	}
+
+	// s3 was not around for the write
+	s3 := newTestServer(t, ":7153", ":7151", ":7152")
+	waitForPeers(t, 2, s3)
+
+	hkey := hashKey("missed.file")
+	if s3.store.Has(s2.ID, hkey) {
+		t.Fatal("s3 has the file before it synced")
+	}
+
+	peer, ok := s3.nodePeer(s1.ID)
+	if !ok {
+		t.Fatal("s3 does not know s1")
+	}
+	n, err := s3.syncWith(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("pulled %d files, want 1", n)
+	}
+
+	m, err := s3.store.ReadManifest(s2.ID, hkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing := s3.store.missingChunks(m.Chunks); len(missing) > 0 {
+		t.Fatalf("pulled the manifest without %d of its chunks", len(missing))
+	}
+
+	// nothing left to pull once the trees agree
+	if n, err := s3.syncWith(peer); err != nil || n != 0 {
+		t.Fatalf("pulled %d files from an equal tree: %v", n, err)
+	}
+}
+
+func TestHintedHandoffReplaysWhenNodeIsBack(t *testing.T) {
+	s1 := newTestServer(t, ":7161")
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServer(t, ":7162", ":7161")
+	time.Sleep(50 * time.Millisecond)
+	s3 := newTestServer(t, ":7163", ":7161", ":7162")
+	waitForPeers(t, 2, s1, s2, s3)
+
+	// s3 goes down
+	for _, s := range []*FileServer{s1, s2} {
+		peer, ok := s.nodePeer(s3.ID)
+		if !ok {
+			t.Fatalf("[%s] does not know s3", s.Transport.Addr())
+		}
+		s.dropPeer(peer)
+	}
+
+	data := make([]byte, 10000)
+	rand.Read(data)
+	if err := s1.Store("replicated.file", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	coded := WriteOpts{Durability: Durability{DataShards: 2, ParityShards: 1}}
+	if err := s1.StoreWith("coded.file", bytes.NewReader(data), coded); err != nil {
+		t.Fatal(err)
+	}
+
+	hints := 0
+	deadline := time.Now().Add(3 * time.Second)
+	for hints < 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("have %d hints for s3, want 2", hints)
+		}
+		time.Sleep(10 * time.Millisecond)
+		hints = 0
+		for _, s := range []*FileServer{s1, s2} {
+			h, err := s.store.hints(s3.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			hints += len(h)
+		}
+	}
+
+	// s3 is back, the stand-ins hand over what it missed
+	s3.Transport.Dial(":7161")
+	s3.Transport.Dial(":7162")
+
+	for _, key := range []string{"replicated.file", "coded.file"} {
+		hkey := hashKey(key)
+		m, err := s1.store.ReadManifest(s1.ID, hkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.Now().Add(3 * time.Second)
+		for !s3.store.Has(s1.ID, hkey) || len(s3.store.missingHeld(m, s3.ID, s3.placement(s1.ID, m))) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("s3 did not get %s back", key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestHintedHandoffWithReplicationFactor(t *testing.T) {
+	opts := FileServerOpts{ReplicationFactor: 2}
+	s1 := newTestServerWith(t, ":7341", opts)
+	time.Sleep(50 * time.Millisecond)
+	opts.BootstrapNodes = []string{":7341"}
+	s2 := newTestServerWith(t, ":7342", opts)
+	time.Sleep(50 * time.Millisecond)
+	opts.BootstrapNodes = []string{":7341", ":7342"}
+	s3 := newTestServerWith(t, ":7343", opts)
+	waitForPeers(t, 2, s1, s2, s3)
+
+	// s3 goes down
+	for _, s := range []*FileServer{s1, s2} {
+		peer, ok := s.nodePeer(s3.ID)
+		if !ok {
+			t.Fatalf("[%s] does not know s3", s.Transport.Addr())
+		}
+		s.dropPeer(peer)
+	}
+
+	// the files s3 is one of the two replicas of
+	missed := []string{}
+	for i := 0; i < 8; i++ {
+		data := make([]byte, 3000)
+		rand.Read(data)
+		key := fmt.Sprintf("file_%d", i)
+		if err := s1.Store(key, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		m, err := s1.store.ReadManifest(s1.ID, hashKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if slices.Contains(placeWeighted(s1.ID, m.Key, s1.memberList(), 2, m.Weights), s3.ID) {
+			missed = append(missed, key)
+		}
+	}
+	if len(missed) == 0 {
+		t.Fatal("s3 is not a replica of any of the files")
+	}
+
+	// the stand-ins have every piece they hold for s3
+	deadline := time.Now().Add(3 * time.Second)
+	for hints := 0; hints < len(missed); {
+		if time.Now().After(deadline) {
+			t.Fatalf("have %d hints for s3, want %d", hints, len(missed))
+		}
+		time.Sleep(10 * time.Millisecond)
+		hints = 0
+		for _, s := range []*FileServer{s1, s2} {
+			h, err := s.store.hints(s3.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, h := range h {
+				for _, hash := range h.Pieces {
+					if !s.store.HasChunk(hash) {
+						t.Fatalf("[%s] holds a hint of %s without its chunk %s", s.Transport.Addr(), h.Key, hash)
+					}
+				}
+			}
+			hints += len(h)
+		}
+	}
+
+	// s3 is back, the stand-ins hand over what it missed
+	s3.Transport.Dial(":7341")
+	s3.Transport.Dial(":7342")
+
+	for _, key := range missed {
+		hkey := hashKey(key)
+		m, err := s1.store.ReadManifest(s1.ID, hkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		deadline := time.Now().Add(3 * time.Second)
+		for !s3.store.Has(s1.ID, hkey) || len(s3.store.missingHeld(m, s3.ID, []string{s3.ID})) > 0 {
+			if time.Now().After(deadline) {
+				t.Fatalf("s3 did not get %s back", key)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	for _, s := range []*FileServer{s1, s2} {
+		deadline := time.Now().Add(3 * time.Second)
+		for {
+			h, err := s.store.hints(s3.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(h) == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("[%s] still holds (%d) hints for s3", s.Transport.Addr(), len(h))
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestRebalanceMovesChunksToNewReplicas(t *testing.T) {
+	opts := FileServerOpts{ReplicationFactor: 1}
+	s1 := newTestServerWith(t, ":7171", opts)
+	time.Sleep(50 * time.Millisecond)
+	opts.BootstrapNodes = []string{":7171"}
+	s2 := newTestServerWith(t, ":7172", opts)
+	waitForPeers(t, 1, s1, s2)
+
+	files := make(map[string][]byte)
+	for i := 0; i < 6; i++ {
+		data := make([]byte, 3000)
+		rand.Read(data)
+		key := fmt.Sprintf("file_%d", i)
+		if err := s1.Store(key, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+		files[key] = data
+	}
+
+	// s3 joins and becomes the replica of some of the files
+	opts.BootstrapNodes = []string{":7171", ":7172"}
+	s3 := newTestServerWith(t, ":7173", opts)
+	waitForPeers(t, 2, s1, s2, s3)
+
+	servers := []*FileServer{s1, s2, s3}
+	nodes := []string{s1.ID, s2.ID, s3.ID}
+	for key := range files {
+		hkey := hashKey(key)
+		m, err := s1.store.ReadManifest(s1.ID, hkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		replica := placeReplicas(s1.ID, hkey, nodes, 1)[0]
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			settled := true
+			for _, s := range servers {
+				missing := len(s.store.missingChunks(m.Chunks))
+				if (s.ID == replica) != (missing == 0) {
+					settled = false
+				}
+			}
+			if settled {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("chunks of %s did not end up on its replica only", key)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	// the owner still reads every file, from wherever its chunks are now
+	for key, data := range files {
+		r, err := s1.GET(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Fatalf("read back wrong bytes of %s", key)
+		}
+	}
+}
+
+func TestDecommissionHandsOffData(t *testing.T) {
+	opts := FileServerOpts{ReplicationFactor: 1}
+	s1 := newTestServerWith(t, ":7181", opts)
+	time.Sleep(50 * time.Millisecond)
+	opts.BootstrapNodes = []string{":7181"}
+	s2 := newTestServerWith(t, ":7182", opts)
+	time.Sleep(50 * time.Millisecond)
+	opts.BootstrapNodes = []string{":7181", ":7182"}
+	s3 := newTestServerWith(t, ":7183", opts)
+	waitForPeers(t, 2, s1, s2, s3)
+
+	// every node has every manifest before s3 leaves
+	all := WriteOpts{Consistency: ConsistencyAll}
+	files := make(map[string][]byte)
+	for i := 0; i < 6; i++ {
+		data := make([]byte, 3000)
+		rand.Read(data)
+		key := fmt.Sprintf("file_%d", i)
+		if err := s1.StoreWith(key, bytes.NewReader(data), all); err != nil {
+			t.Fatal(err)
+		}
+		files[key] = data
+	}
+	data := make([]byte, 3000)
+	rand.Read(data)
+	coded := WriteOpts{Durability: Durability{DataShards: 2, ParityShards: 1}, Consistency: ConsistencyAll}
+	if err := s1.StoreWith("coded.file", bytes.NewReader(data), coded); err != nil {
+		t.Fatal(err)
+	}
+	files["coded.file"] = data
+
+	var last DecommissionProgress
+	if err := s3.Decommission(func(p DecommissionProgress) { last = p }); err != nil {
+		t.Fatal(err)
+	}
+	if last.Done != last.Files || last.Files != len(files) {
+		t.Fatalf("handed off %d of %d files, want %d", last.Done, last.Files, len(files))
+	}
+	if err := s3.Store("late.file", bytes.NewReader(data)); err == nil {
+		t.Fatal("a leaving node took a write")
+	}
+
+	// no shard is left on s3
+	m, err := s1.store.ReadManifest(s1.ID, hashKey("coded.file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range m.Chunks {
+		if slices.Contains(c.Nodes, s3.ID) {
+			t.Fatalf("chunk %s still has a shard on s3", c.Hash)
+		}
+	}
+
+	// s3 is gone, the owner still reads every file
+	deadline := time.Now().Add(3 * time.Second)
+	for len(s1.peerList()) > 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("s3 did not go away")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for key, data := range files {
+		r, err := s1.GET(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, data) {
+			t.Fatalf("read back wrong bytes of %s", key)
+		}
+	}
+}
+
+func TestShutdownDrainsTransfers(t *testing.T) {
+	s1 := newTestServer(t, ":7191")
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServer(t, ":7192", ":7191")
+	waitForPeers(t, 1, s1, s2)
+
+	// a store that is still reading its file when the shutdown begins
+	pr, pw := io.Pipe()
+	stored := make(chan error, 1)
+	go func() {
+		stored <- s1.Store("slow.file", pr)
+	}()
+	data := make([]byte, 5000)
+	rand.Read(data)
+	pw.Write(data[:2500])
+
+	type result struct {
+		report ShutdownReport
+		err    error
+	}
+	shut := make(chan result, 1)
+	go func() {
+		report, err := s1.Shutdown(3 * time.Second)
+		shut <- result{report, err}
+	}()
+
+	deadline := time.Now().Add(time.Second)
+	for !s1.transfers.closing() {
+		if time.Now().After(deadline) {
+			t.Fatal("shutdown did not begin")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := s1.Store("new.file", bytes.NewReader(data)); !errors.Is(err, errShuttingDown) {
+		t.Fatalf("store during shutdown returned %v, want %v", err, errShuttingDown)
+	}
+
+	pw.Write(data[2500:])
+	pw.Close()
+	if err := <-stored; err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-shut
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if len(res.report.Aborted) > 0 || res.report.Peers != 1 {
+		t.Fatalf("shutdown aborted %v and closed %d peers, want none and 1", res.report.Aborted, res.report.Peers)
+	}
+
+	// s2 got the whole file before s1 went away
+	deadline = time.Now().Add(3 * time.Second)
+	for !s2.store.Has(s1.ID, hashKey("slow.file")) || len(s2.peerList()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("s2 did not get the file or still sees s1")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownAbortsAfterTimeout(t *testing.T) {
+	s := newTestServer(t, ":7193")
+	time.Sleep(50 * time.Millisecond)
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go s.Store("stuck.file", pr)
+	pw.Write(make([]byte, 100))
+
+	report, err := s.Shutdown(100 * time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Aborted) != 1 || report.Aborted[0] != "store stuck.file" {
+		t.Fatalf("aborted %v, want the stuck store", report.Aborted)
+	}
+}
+
+func TestVersionsAreKeptAndRestored(t *testing.T) {
+	s1 := newTestServer(t, ":7201")
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServer(t, ":7202", ":7201")
+	waitForPeers(t, 1, s1, s2)
+
+	contents := [][]byte{}
+	for i := 0; i < 4; i++ {
+		data := make([]byte, 3000)
+		rand.Read(data)
+		contents = append(contents, data)
+
+		// the first write turns versioning on, the others inherit it
+		opts := WriteOpts{Consistency: ConsistencyAll}
+		if i == 0 {
+			opts.Versioned, opts.Retention = true, Retention{MaxVersions: 2}
+		}
+		if err := s1.StoreWith("doc", bytes.NewReader(data), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	read := func(opts ReadOpts) []byte {
+		r, err := s1.GETWith("doc", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	versions, err := s1.ListVersions("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 || !versions[2].Current {
+		t.Fatalf("have %d versions, want 2 old ones and the current one", len(versions))
+	}
+	if !bytes.Equal(read(ReadOpts{Version: versions[0].ID}), contents[1]) {
+		t.Fatal("oldest kept version does not read as the second write")
+	}
+
+	// s2 keeps the history too
+	hkey := hashKey("doc")
+	s1.store.manifestLock.Lock()
+	err = s1.store.deleteHistory(s1.ID, hkey)
+	s1.store.manifestLock.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read(ReadOpts{Version: versions[1].ID}), contents[2]) {
+		t.Fatal("version read from s2 does not read as the third write")
+	}
+
+	if err := s1.Restore("doc", versions[1].ID); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read(ReadOpts{}), contents[2]) {
+		t.Fatal("restored file does not read as the third write")
+	}
+	versions, err = s1.ListVersions("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Current || !versions[1].Current {
+		t.Fatalf("have %d versions after the restore, want the replaced one and the current one", len(versions))
+	}
+}
+
+func TestConcurrentVersionsAreResolved(t *testing.T) {
+	// both nodes write the files of the same owner
+	opts := FileServerOpts{Owner: "shared", EncKey: newEncryptionkey()}
+	s1 := newTestServerWith(t, ":7211", opts)
+	time.Sleep(50 * time.Millisecond)
+	opts.BootstrapNodes = []string{":7211"}
+	s2 := newTestServerWith(t, ":7212", opts)
+	waitForPeers(t, 1, s1, s2)
+
+	hkey := hashKey("doc")
+	store := func(s *FileServer, consistency Consistency) []byte {
+		data := make([]byte, 3000)
+		rand.Read(data)
+		if err := s.StoreWith("doc", bytes.NewReader(data), WriteOpts{Consistency: consistency}); err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	store(s1, ConsistencyAll)
+
+	// the nodes lose each other and both write the file without seeing
+	// the write of the other
+	for _, s := range []*FileServer{s1, s2} {
+		for _, peer := range s.peerList() {
+			s.dropPeer(peer)
+		}
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for len(s1.peerList()) > 0 || len(s2.peerList()) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the nodes are still connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	contents := map[int64][]byte{}
+	for _, s := range []*FileServer{s1, s2} {
+		data := store(s, ConsistencyOne)
+		m, err := s.store.ReadManifest("shared", hkey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[m.Version] = data
+	}
+
+	// they are back and hand each other the write they missed
+	s2.Transport.Dial(":7211")
+
+	read := func(key string) []byte {
+		r, err := s1.GET(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	var siblings []VersionInfo
+	deadline = time.Now().Add(3 * time.Second)
+	for {
+		var err error
+		if siblings, err = s1.Siblings("doc"); err != nil {
+			t.Fatal(err)
+		}
+		if len(siblings) == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("have %d concurrent versions, want 2", len(siblings))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !siblings[0].Current {
+		t.Fatal("the first of the concurrent versions should be the current one")
+	}
+	var winner, loser []byte
+	for version, data := range contents {
+		if versionID(version) == siblings[0].ID {
+			winner = data
+		} else {
+			loser = data
+		}
+	}
+	if winner == nil || !bytes.Equal(read("doc"), winner) {
+		t.Fatal("the newest of the concurrent versions should be read")
+	}
+
+	if err := s1.Resolve("doc", ResolveKeepBoth); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read("doc"), winner) {
+		t.Fatal("resolved file does not read as the winning version")
+	}
+	if !bytes.Equal(read(conflictKey("doc", siblings[1].ID)), loser) {
+		t.Fatal("the losing version was not kept under its own key")
+	}
+
+	for _, s := range []*FileServer{s1, s2} {
+		if siblings, _ := s.store.readSiblings("shared", hkey); len(siblings) != 0 {
+			t.Fatalf("[%s] still has %d siblings after the resolve", s.Transport.Addr(), len(siblings))
+		}
+	}
+}
+
+// waitForMetaLeader blocks until one of the servers is the metadata leader.
+func waitForMetaLeader(t *testing.T, servers ...*FileServer) *FileServer {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, s := range servers {
+			if s.meta.isLeader() {
+				return s
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("no metadata leader was elected")
+	return nil
+}
+
+// newMetaCluster starts a server on every address, all of them run the
+// metadata service, and waits until they are connected.
+func newMetaCluster(t *testing.T, addrs ...string) []*FileServer {
+	ids := []string{}
+	for i := range addrs {
+		ids = append(ids, fmt.Sprintf("meta-%d", i+1))
+	}
+
+	servers := []*FileServer{}
+	for i, addr := range addrs {
+		servers = append(servers, newTestServerWith(t, addr, FileServerOpts{
+			ID:             ids[i],
+			MetadataNodes:  ids,
+			BootstrapNodes: slices.Clone(addrs[:i]),
+		}))
+		if i == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	waitForPeers(t, len(addrs)-1, servers...)
+	return servers
+}
+
+func TestMetadataCatalogSurvivesLeaderLoss(t *testing.T) {
+	servers := newMetaCluster(t, ":7221", ":7222", ":7223")
+
+	leader := waitForMetaLeader(t, servers...)
+	var writer *FileServer
+	for _, s := range servers {
+		if s != leader {
+			writer = s
+			break
+		}
+	}
+
+	store := func(consistency Consistency) *Manifest {
+		data := make([]byte, 3000)
+		rand.Read(data)
+		if err := writer.StoreWith("doc", bytes.NewReader(data), WriteOpts{Consistency: consistency}); err != nil {
+			t.Fatal(err)
+		}
+		m, err := writer.store.ReadManifest(writer.ID, hashKey("doc"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	m := store(ConsistencyAll)
+	e, err := writer.Locate("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur := e.Current(); cur.Version != m.Version || len(cur.Replicas) != 3 {
+		t.Fatalf("catalog has version %d on %d nodes, want %d on 3", cur.Version, len(cur.Replicas), m.Version)
+	}
+
+	// the two that are left elect a new leader, which has what was committed
+	if _, err := leader.Shutdown(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for len(writer.peerList()) > 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the old leader is still a peer")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	// the old leader is still a member, ALL would wait for it
+	m = store(ConsistencyQuorum)
+	e, err = writer.Locate("doc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(e.Versions) != 2 || e.Current().Version != m.Version {
+		t.Fatalf("catalog has %d versions after the leader left, current %d, want 2 and %d", len(e.Versions), e.Current().Version, m.Version)
+	}
+}
+
+func TestExpiredLeaseIsFencedOff(t *testing.T) {
+	servers := newMetaCluster(t, ":7231", ":7232", ":7233")
+	s1, s2 := servers[0], servers[1]
+	waitForMetaLeader(t, servers...)
+
+	write := func(s *FileServer, key string, l *Lease) error {
+		data := make([]byte, 3000)
+		rand.Read(data)
+		return s.StoreWith(key, bytes.NewReader(data), WriteOpts{Consistency: ConsistencyAll, Lease: l})
+	}
+
+	old, err := s1.AcquireLock("report", 200*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s2.AcquireLock("report", time.Minute); err == nil {
+		t.Fatal("took a lock that is held")
+	}
+	if err := write(s1, "report", &old); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(s1, "summary", &old); err == nil {
+		t.Fatal("wrote a file the lease is not for")
+	}
+
+	// the first holder stalls past its lease and another one takes over
+	time.Sleep(300 * time.Millisecond)
+	if _, err := s1.RenewLock(old, time.Minute); err == nil {
+		t.Fatal("renewed an expired lease")
+	}
+	cur, err := s2.AcquireLock("report", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cur.Token <= old.Token {
+		t.Fatalf("new lease has token %d, not above %d", cur.Token, old.Token)
+	}
+	if err := write(s2, "report", &cur); err != nil {
+		t.Fatal(err)
+	}
+
+	// the files of s1 never saw the new lease, the lock did
+	if err := write(s1, "report", &old); !errors.Is(err, errFenced) {
+		t.Fatalf("write with the expired lease returned %v, want it fenced off", err)
+	}
+
+	// the replicas check the token on their own too
+	m, err := s2.store.ReadManifest(s2.ID, hashKey("report"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := *m
+	stale.Fence = old.Token
+	stale.Clock = m.Clock.next(s1.ID)
+	if err := s1.store.WriteManifest(s2.ID, &stale); !errors.Is(err, errFenced) {
+		t.Fatalf("replica took a write with an old token: %v", err)
+	}
+
+	if err := s2.ReleaseLock(cur); err != nil {
+		t.Fatal(err)
+	}
+	if err := write(s2, "report", &cur); !errors.Is(err, errFenced) {
+		t.Fatalf("write with a released lease returned %v, want it fenced off", err)
+	}
+	if _, err := s1.AcquireLock("report", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExpiredFilesLeaveTombstones(t *testing.T) {
+	s1 := newTestServer(t, ":7241")
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServer(t, ":7242", ":7241")
+	waitForPeers(t, 1, s1, s2)
+
+	data := make([]byte, 3000)
+	rand.Read(data)
+	opts := WriteOpts{Consistency: ConsistencyAll, TTL: 300 * time.Millisecond}
+	if err := s1.StoreWith("scratch", bytes.NewReader(data), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s1.GET("scratch"); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	if _, err := s1.GET("scratch"); err == nil {
+		t.Fatal("read a file that expired")
+	}
+
+	hkey := hashKey("scratch")
+	file, err := s1.store.ReadManifest(s1.ID, hkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s1.expire()
+	m, err := s1.store.ReadManifest(s1.ID, hkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !m.Deleted {
+		t.Fatal("expired file was not replaced by a tombstone")
+	}
+	for _, c := range file.Chunks {
+		if s1.store.refCount(c.Hash) != 0 {
+			t.Fatal("chunks of the expired file are still referenced")
+		}
+	}
+
+	// s2 did not expire it yet, but the tombstone wins over its copy
+	if n, err := s1.syncWith(s1.peerList()[0]); err != nil || n != 0 {
+		t.Fatalf("pulled %d files from s2 (%v), want the expired one to stay gone", n, err)
+	}
+	s2.expire()
+	if !bytes.Equal(s1.store.tree.hash(""), s2.store.tree.hash("")) {
+		t.Fatal("the nodes did not agree on the tombstone")
+	}
+
+	// the tombstone goes once nobody can have the file anymore
+	_, dropped, err := s1.store.expireFiles(time.Now().Add(tombstoneRetention + time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dropped != 1 || s1.store.Has(s1.ID, hkey) {
+		t.Fatal("old tombstone was not deleted")
+	}
+}
+
+func TestQuotaExceededIsReported(t *testing.T) {
+	s1 := newTestServer(t, ":7251")
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServerWith(t, ":7252", FileServerOpts{
+		BootstrapNodes: []string{":7251"},
+		Quotas:         Quotas{Owner: Quota{LogicalBytes: 4000}},
+	})
+	waitForPeers(t, 1, s1, s2)
+
+	data := make([]byte, 3000)
+	rand.Read(data)
+	opts := WriteOpts{Consistency: ConsistencyAll}
+	if err := s1.StoreWith("first", bytes.NewReader(data), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	err := s1.StoreWith("second", bytes.NewReader(data), opts)
+	var quota *QuotaError
+	if !errors.As(err, &quota) || quota.Node != s2.ID || quota.Owner != s1.ID {
+		t.Fatalf("store over the quota of s2 returned %v, want its quota error", err)
+	}
+
+	usage := s2.Usage()
+	if usage.Owners[s1.ID] != (Usage{LogicalBytes: 3000, Objects: 1}) || usage.Node != usage.Owners[s1.ID] {
+		t.Fatalf("s2 reports %+v, want only the first file", usage)
+	}
+}
+
+// TestQuotaTurnsDownChunksAtTheLimit fills the quota of s2 to the byte, the
+// chunks of the next file must not get there at all.
+func TestQuotaTurnsDownChunksAtTheLimit(t *testing.T) {
+	s1 := newTestServer(t, ":7321")
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServerWith(t, ":7322", FileServerOpts{
+		BootstrapNodes: []string{":7321"},
+		Quotas:         Quotas{Owner: Quota{LogicalBytes: 3000}},
+	})
+	waitForPeers(t, 1, s1, s2)
+
+	opts := WriteOpts{Consistency: ConsistencyAll}
+	first := make([]byte, 3000)
+	rand.Read(first)
+	if err := s1.StoreWith("first", bytes.NewReader(first), opts); err != nil {
+		t.Fatal(err)
+	}
+
+	second := make([]byte, 3000)
+	rand.Read(second)
+	if err := s1.StoreWith("second", bytes.NewReader(second), opts); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("store over the quota of s2 returned %v, want a quota error", err)
+	}
+
+	m, err := s1.store.ReadManifest(s1.ID, hashKey("second"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range m.Chunks {
+		if s2.store.HasChunk(c.Hash) || s2.store.partialChunkSize(c.Hash) > 0 {
+			t.Fatalf("s2 took chunk %s of a file over the quota", c.Hash)
+		}
+	}
+}
+
+func TestLowSpaceNodeTurnsDownWrites(t *testing.T) {
+	const total = 1 << 40
+	var free atomic.Uint64
+	free.Store(total / 20)
+
+	opts := FileServerOpts{ReplicationFactor: 1}
+	s1 := newTestServerWith(t, ":7261", opts)
+	time.Sleep(50 * time.Millisecond)
+	opts.BootstrapNodes = []string{":7261"}
+	opts.DiskSpaceFunc = func(string) (Capacity, error) {
+		return Capacity{Total: total, Free: free.Load()}, nil
+	}
+	s2 := newTestServerWith(t, ":7262", opts)
+	waitForPeers(t, 1, s1, s2)
+
+	// s2 is over its high-water mark, s1 places all files on itself
+	if c := s1.Capacities()[s2.ID]; !c.Full || c.ReadOnly {
+		t.Fatalf("s1 sees the capacity of s2 as %+v, want it full", c)
+	}
+	data := make([]byte, 3000)
+	rand.Read(data)
+	for i := 0; i < 4; i++ {
+		key := fmt.Sprintf("file_%d", i)
+		if replicas := newPlacement(s1, key); replicas[0] != s1.ID {
+			t.Fatalf("%s is placed on the full node", key)
+		}
+		if err := s1.StoreWith(key, bytes.NewReader(data), WriteOpts{Consistency: ConsistencyAll}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// critically full it takes no writes at all
+	free.Store(total / 100)
+	if err := s2.StoreWith("local", bytes.NewReader(data), WriteOpts{}); !errors.Is(err, errLowSpace) {
+		t.Fatalf("read-only node stored a file: %v", err)
+	}
+	// s1 is the only replica, the write goes through without s2
+	if err := s1.StoreWith("more", bytes.NewReader(data), WriteOpts{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s2.store.Has(s1.ID, hashKey("more")) {
+		t.Fatal("read-only node took the manifest")
+	}
+
+	free.Store(total / 2)
+	if err := s2.StoreWith("local", bytes.NewReader(data), WriteOpts{}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFullNodeKeepsItsFiles(t *testing.T) {
+	const total = 1 << 40
+	var free atomic.Uint64
+	free.Store(total / 2)
+
+	opts := FileServerOpts{ReplicationFactor: 1}
+	s1 := newTestServerWith(t, ":7351", opts)
+	time.Sleep(50 * time.Millisecond)
+	opts.BootstrapNodes = []string{":7351"}
+	opts.DiskSpaceFunc = func(string) (Capacity, error) {
+		return Capacity{Total: total, Free: free.Load()}, nil
+	}
+	s2 := newTestServerWith(t, ":7352", opts)
+	waitForPeers(t, 1, s1, s2)
+
+	// files s2 is the replica of
+	data := make([]byte, 3000)
+	rand.Read(data)
+	keys := []string{}
+	for i := 0; len(keys) < 4; i++ {
+		key := fmt.Sprintf("file_%d", i)
+		if newPlacement(s1, key)[0] != s2.ID {
+			continue
+		}
+		if err := s1.StoreWith(key, bytes.NewReader(data), WriteOpts{Consistency: ConsistencyAll}); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, key)
+	}
+
+	// s2 goes over its high-water mark and tells s1, like its space loop
+	free.Store(total / 20)
+	c := s2.measureSpace()
+	if !c.Full {
+		t.Fatalf("s2 measured %+v, want it full", c)
+	}
+	if err := s2.broadcast(&Message{Payload: MessageCapacity{ID: s2.ID, Capacity: c}}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for !s1.Capacities()[s2.ID].Full {
+		if time.Now().After(deadline) {
+			t.Fatal("s1 did not hear that s2 is full")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// new files go to s1, the ones s2 has stay where they are
+	for i := 0; i < 4; i++ {
+		if newPlacement(s1, fmt.Sprintf("new_%d", i))[0] != s1.ID {
+			t.Fatal("a new file is placed on the full node")
+		}
+	}
+	for _, s := range []*FileServer{s1, s2} {
+		if _, dropped := s.rebalance(); dropped > 0 {
+			t.Fatalf("[%s] dropped (%d) chunks once s2 was full", s.Transport.Addr(), dropped)
+		}
+	}
+	for _, key := range keys {
+		m, err := s1.store.ReadManifest(s1.ID, hashKey(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, s := range []*FileServer{s1, s2} {
+			if replicas := s.placement(s1.ID, m); replicas[0] != s2.ID {
+				t.Fatalf("[%s] moved %s off the full node", s.Transport.Addr(), key)
+			}
+		}
+		if missing := s2.store.missingChunks(m.Chunks); len(missing) > 0 {
+			t.Fatalf("s2 lost (%d) chunks of %s", len(missing), key)
+		}
+	}
+}
+
+func TestServersOnOtherBackends(t *testing.T) {
+	s1 := newTestServerWith(t, ":7271", FileServerOpts{Backend: NewMemoryBackend()})
+	time.Sleep(50 * time.Millisecond)
+	logBackend, err := OpenLogBackend(t.TempDir() + "/objects.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2 := newTestServerWith(t, ":7272", FileServerOpts{BootstrapNodes: []string{":7271"}, Backend: logBackend})
+	waitForPeers(t, 1, s1, s2)
+
+	data := make([]byte, 3000)
+	rand.Read(data)
+	if err := s1.StoreWith("file", bytes.NewReader(data), WriteOpts{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := s2.store.ReadManifest(s1.ID, hashKey("file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if missing := s2.store.missingChunks(m.Chunks); len(missing) != 0 {
+		t.Fatalf("s2 misses (%d) chunks in its log", len(missing))
+	}
+
+	r, err := s1.GET("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatal("read back wrong bytes")
+	}
+
+	// a peer fetches the chunks from a node on every kind of backend
+	backends := testBackends(t)
+	kinds := []string{}
+	for kind := range backends {
+		kinds = append(kinds, kind)
+	}
+	slices.Sort(kinds)
+	for i, kind := range kinds {
+		t.Run(kind, func(t *testing.T) {
+			fetchesChunksFrom(t, backends[kind](), fmt.Sprintf(":%d", 7301+2*i), fmt.Sprintf(":%d", 7302+2*i), nil)
+		})
+	}
+}
+
+func TestReadCacheKeepsCopiesWeDontOwn(t *testing.T) {
+	opts := FileServerOpts{ReplicationFactor: 1, CacheBytes: 5000}
+	s1 := newTestServerWith(t, ":7281", opts)
+	time.Sleep(50 * time.Millisecond)
+	opts.BootstrapNodes = []string{":7281"}
+	s2 := newTestServerWith(t, ":7282", opts)
+	waitForPeers(t, 1, s1, s2)
+
+	// files s2 is the replica of, s1 only has their manifests
+	files := map[string][]byte{}
+	keys := []string{}
+	for i := 0; len(keys) < 2; i++ {
+		key := fmt.Sprintf("file_%d", i)
+		if newPlacement(s1, key)[0] != s2.ID {
+			continue
+		}
+		data := make([]byte, 3000)
+		rand.Read(data)
+		if err := s1.StoreWith(key, bytes.NewReader(data), WriteOpts{Consistency: ConsistencyAll}); err != nil {
+			t.Fatal(err)
+		}
+		m, _ := s1.store.ReadManifest(s1.ID, hashKey(key))
+		for _, c := range m.Chunks {
+			s1.store.Delete(chunkNamespace, chunkKey(c.Hash))
+		}
+		files[key] = data
+		keys = append(keys, key)
+	}
+
+	read := func(key string) []byte {
+		r, err := s1.GET(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	// the second read is served from the cache
+	for i := 0; i < 2; i++ {
+		if !bytes.Equal(read(keys[0]), files[keys[0]]) {
+			t.Fatal("read back wrong bytes")
+		}
+	}
+	if stats := s1.CacheStats(); stats.Files != 1 || stats.Hits != 1 || stats.Misses != 1 {
+		t.Fatalf("cache stats are %+v", stats)
+	}
+
+	// reading a file s1 is the replica of does not touch the cache
+	own := ""
+	for i := 0; own == ""; i++ {
+		if key := fmt.Sprintf("own_%d", i); newPlacement(s1, key)[0] == s1.ID {
+			own = key
+		}
+	}
+	if err := s1.Store(own, bytes.NewReader([]byte("ours"))); err != nil {
+		t.Fatal(err)
+	}
+	before := s1.CacheStats()
+	if string(read(own)) != "ours" {
+		t.Fatal("read back wrong bytes")
+	}
+	if stats := s1.CacheStats(); stats != before {
+		t.Fatalf("a local read moved the cache stats from %+v to %+v", before, stats)
+	}
+
+	// both don't fit, the one read the longest ago goes
+	read(keys[1])
+	if stats := s1.CacheStats(); stats.Files != 1 || stats.Evictions != 1 || stats.Bytes > stats.Capacity {
+		t.Fatalf("cache stats after eviction are %+v", stats)
+	}
+	// the rebalancer drops the chunks of the evicted file
+	m, _ := s1.store.ReadManifest(s1.ID, hashKey(keys[0]))
+	deadline := time.Now().Add(5 * time.Second)
+	for len(s1.store.missingChunks(m.Chunks)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("chunks of the evicted file are still there")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if m, _ := s1.store.ReadManifest(s1.ID, hashKey(keys[1])); len(s1.store.missingChunks(m.Chunks)) != 0 {
+		t.Fatal("the rebalancer dropped chunks of a cached file")
+	}
+
+	// a new version replaces the cached one
+	data := make([]byte, 2000)
+	rand.Read(data)
+	if err := s1.Store(keys[1], bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if stats := s1.CacheStats(); stats.Files != 0 || stats.Invalidations != 1 {
+		t.Fatalf("cache stats after a new version are %+v", stats)
+	}
+	if !bytes.Equal(read(keys[1]), data) {
+		t.Fatal("read back the old version")
+	}
+}
+
+// fetchesChunksFrom stores a file on a node on the backend, and has a node
+// on disk that lost its copy read it back, so the chunks come over the
+// network from the backend. settle, if set, runs right before the read.
+func fetchesChunksFrom(t *testing.T, backend Backend, addr string, diskAddr string, settle func()) {
+	t.Helper()
+
+	s1 := newTestServerWith(t, addr, FileServerOpts{Backend: backend})
+	time.Sleep(50 * time.Millisecond)
+	s2 := newTestServerWith(t, diskAddr, FileServerOpts{BootstrapNodes: []string{addr}})
+	waitForPeers(t, 1, s1, s2)
+
+	data := make([]byte, 3000)
+	rand.Read(data)
+	if err := s2.StoreWith("file", bytes.NewReader(data), WriteOpts{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	m, err := s2.store.ReadManifest(s2.ID, hashKey("file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s2.store.DeleteManifest(s2.ID, m.Key); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range m.Chunks {
+		s2.store.Delete(chunkNamespace, chunkKey(c.Hash))
+	}
+
+	if settle != nil {
+		settle()
+	}
+	r, err := s2.GET("file")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Fatal("read back wrong bytes")
+	}
+}
+
+func TestS3NodeServesChunks(t *testing.T) {
+	_, backend := newS3Emulator(t)
+	fetchesChunksFrom(t, backend, ":7291", ":7292", nil)
+}
+
+func TestTieredNodeServesColdChunks(t *testing.T) {
+	for _, recall := range []int{1, 2} {
+		t.Run(fmt.Sprintf("recall after %d reads", recall), func(t *testing.T) {
+			_, cold := newS3Emulator(t)
+			// everything goes cold, the chunks are read from S3 unless
+			// the read recalls them first
+			backend, err := OpenTieredBackend(TieredOpts{
+				Hot:               NewMemoryBackend(),
+				Cold:              cold,
+				Policy:            TierPolicy{HotBytes: 1, RecallReads: recall},
+				MigrationInterval: -1,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			addr, diskAddr := fmt.Sprintf(":%d", 7293+2*recall), fmt.Sprintf(":%d", 7294+2*recall)
+			fetchesChunksFrom(t, backend, addr, diskAddr, func() {
+				if _, err := backend.Migrate(); err != nil {
+					t.Fatal(err)
+				}
+				if stats := backend.Stats(); stats.ColdObjects == 0 {
+					t.Fatalf("nothing went cold: %+v", stats)
+				}
+			})
+		})
+	}
+}
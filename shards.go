@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/pavanmanikanta98/dfs-with-go/p2p"
+)
+
+// storeShards erasure codes the encrypted chunk and sends every shard to its
+// own node, the nodes are ranked per chunk so the shards of a file spread
+// over the whole cluster. The returned reference lists where the shards went.
+// The shard of a node that is down goes to its stand-in, which hands it over
+// once the node is back. The file is size bytes big with the chunk.
+func (s *FileServer) storeShards(coder *erasureCoder, nodes []string, progress map[string]*uploadProgress, hkey string, size int64, ref ChunkRef, encrypted []byte) (ChunkRef, error) {
+	ranked := rankNodes(ref.Hash, nodes)
+
+	ref.Shards, ref.Nodes = nil, nil
+	for i, shard := range coder.Split(encrypted) {
+		var (
+			hash = hashChunk(shard)
+			node = ranked[i]
+		)
+		ref.Shards = append(ref.Shards, hash)
+		ref.Nodes = append(ref.Nodes, node)
+
+		if _, ok := s.nodePeer(node); !ok && node != s.ID {
+			node = s.standIn(node, hkey, s.nodeList())
+		}
+
+		if node == s.ID {
+			if _, err := s.store.WriteChunk(hash, bytes.NewReader(shard)); err != nil {
+				return ref, err
+			}
+			continue
+		}
+
+		peer, ok := s.nodePeer(node)
+		if !ok {
+			return ref, fmt.Errorf("[%s] node %s left before it got its shard of %s", s.Transport.Addr(), node, hkey)
+		}
+		if err := s.replicateChunk([]p2p.Peer{peer}, progress, s.Owner, hkey, size, hash, shard); err != nil {
+			return ref, err
+		}
+	}
+
+	return ref, nil
+}
+
+// reconstructChunks puts the erasure coded chunks back together and stores
+// them, the shards we don't have are fetched from the nodes holding them.
+func (s *FileServer) reconstructChunks(d Durability, chunks []ChunkRef) error {
+	coder, err := newErasureCoder(d.DataShards, d.ParityShards)
+	if err != nil {
+		return err
+	}
+
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		failed int
+		sem    = make(chan struct{}, downloadBatch)
+	)
+
+	for _, c := range chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(c ChunkRef) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			if err := s.reconstructChunk(coder, c); err != nil {
+				log.Printf("[%s] %v", s.Transport.Addr(), err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+			}
+		}(c)
+	}
+
+	wg.Wait()
+
+	if failed > 0 {
+		return fmt.Errorf("[%s] (%d) chunks could not be reconstructed", s.Transport.Addr(), failed)
+	}
+	return nil
+}
+
+func (s *FileServer) reconstructChunk(coder *erasureCoder, ref ChunkRef) error {
+	if len(ref.Shards) != coder.data+coder.parity || len(ref.Nodes) != len(ref.Shards) {
+		return fmt.Errorf("chunk %s lists %d shards, want %d", ref.Hash, len(ref.Shards), coder.data+coder.parity)
+	}
+
+	var (
+		size   = coder.shardSize(int(ref.Size))
+		shards = make([][]byte, len(ref.Shards))
+		have   = 0
+	)
+
+	for i, hash := range ref.Shards {
+		if have == coder.data {
+			break
+		}
+
+		if !s.store.HasChunk(hash) {
+			if err := s.fetchShard(ref.Nodes[i], hash, int64(size)); err != nil {
+				log.Printf("[%s] shard %d of chunk %s: %v", s.Transport.Addr(), i, ref.Hash, err)
+				continue
+			}
+		}
+
+		b, err := s.readShard(hash)
+		if err != nil {
+			log.Printf("[%s] shard %d of chunk %s: %v", s.Transport.Addr(), i, ref.Hash, err)
+			continue
+		}
+		shards[i] = b
+		have++
+	}
+
+	encrypted, err := coder.Join(shards, int(ref.Size))
+	if err != nil {
+		return fmt.Errorf("chunk %s: %v", ref.Hash, err)
+	}
+
+	_, err = s.store.WriteChunk(ref.Hash, bytes.NewReader(encrypted))
+	return err
+}
+
+// fetchShard downloads the shard from the node it was placed on.
+func (s *FileServer) fetchShard(node string, hash string, size int64) error {
+	peer, ok := s.nodePeer(node)
+	if !ok {
+		return fmt.Errorf("node %s is not connected", node)
+	}
+
+	failed, err := s.fetchBatch(peer.RemoteAddr().String(), []ChunkRef{{Hash: hash, Size: size}})
+	if err != nil {
+		return err
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("node %s does not have the shard", node)
+	}
+	return nil
+}
+
+func (s *FileServer) readShard(hash string) ([]byte, error) {
+	_, r, err := s.store.ReadChunk(hash)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// shutdownTimeout is how long Decommission lets the last transfers finish.
+const shutdownTimeout = 10 * time.Second
+
+// errShuttingDown is returned for the work a server turns down once its
+// shutdown began.
+var errShuttingDown = fmt.Errorf("server is shutting down")
+
+// transfers keeps track of the work in flight, stores, reads and streams, so
+// a shutdown can wait for it. Once closed nothing new begins.
+type transfers struct {
+	mu     sync.Mutex
+	closed bool
+	next   uint64
+	active map[uint64]string
+	// idle is closed when the last transfer ends after close.
+	idle chan struct{}
+}
+
+func newTransfers() *transfers {
+	return &transfers{
+		active: make(map[uint64]string),
+		idle:   make(chan struct{}),
+	}
+}
+
+// begin registers the transfer, what describes it for the report. It fails
+// once the transfers are closed.
+func (t *transfers) begin(what string) (uint64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return 0, errShuttingDown
+	}
+	t.next++
+	t.active[t.next] = what
+	return t.next, nil
+}
+
+func (t *transfers) end(id uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.active, id)
+	if t.closed && len(t.active) == 0 {
+		select {
+		case <-t.idle:
+		default:
+			close(t.idle)
+		}
+	}
+}
+
+func (t *transfers) closing() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.closed
+}
+
+// drain closes the transfers and waits for the ones in flight, at most the
+// timeout. It returns the ones that did not finish in time.
+func (t *transfers) drain(timeout time.Duration) []string {
+	t.mu.Lock()
+	t.closed = true
+	if len(t.active) == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	t.mu.Unlock()
+
+	select {
+	case <-t.idle:
+	case <-time.After(timeout):
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	left := []string{}
+	for _, what := range t.active {
+		left = append(left, what)
+	}
+	sort.Strings(left)
+	return left
+}
+
+// beginTransfer registers the transfer with what describes it, the func it
+// returns ends it.
+func (s *FileServer) beginTransfer(what string) (func(), error) {
+	id, err := s.transfers.begin(what)
+	if err != nil {
+		return nil, fmt.Errorf("[%s] turned down %s: %w", s.Transport.Addr(), what, err)
+	}
+	return func() { s.transfers.end(id) }, nil
+}
+
+// ShutdownReport tells what a shutdown had to cut off.
+type ShutdownReport struct {
+	// Aborted are the transfers that were still running at the deadline.
+	Aborted []string
+	// Peers is how many connections were closed.
+	Peers int
+	Took  time.Duration
+}
+
+// Shutdown stops the server gracefully. It stops accepting connections and
+// turns down new requests, then waits for the transfers in flight until the
+// timeout, closes the connections of all peers and closes the store. The
+// report lists what did not make it.
+func (s *FileServer) Shutdown(timeout time.Duration) (ShutdownReport, error) {
+	start := time.Now()
+
+	// no new work, but the answers to the requests in flight still come in
+	s.Transport.Close()
+	aborted := s.transfers.drain(timeout)
+
+	s.Stop()
+	peers := s.peerList()
+	for _, peer := range peers {
+		s.dropPeer(peer)
+	}
+
+	err := s.store.Close()
+
+	report := ShutdownReport{
+		Aborted: aborted,
+		Peers:   len(peers),
+		Took:    time.Since(start),
+	}
+
+	fmt.Printf("[%s] shut down in %s, closed (%d) peers, aborted (%d) transfers\n", s.Transport.Addr(), report.Took, report.Peers, len(report.Aborted))
+	for _, what := range report.Aborted {
+		log.Printf("[%s] aborted %s", s.Transport.Addr(), what)
+	}
+
+	return report, err
+}
+
+// isRequest tells if the payload asks us for work, which a server that shuts
+// down turns down. Answers and membership messages still go through.
+func isRequest(payload any) bool {
+	switch payload.(type) {
+	case MessageGetFile, MessageGetChunks, MessageUploadStatus, MessageStorageFile,
+		MessageStoreChunk, MessageHint, MessageMerkleHashes, MessageMerkleEntries,
+		MessageMetaPropose, MessageMetaLookup:
+		return true
+	}
+	return false
+}
+
+// Close stops the store from taking writes and lets the backend clean up
+// after the writes that were cut off. Partial chunks stay, the sender
+// continues them next time.
+func (s *store) Close() error {
+	s.closed.Store(true)
+
+	return s.backend.Close()
+}
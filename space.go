@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"time"
+)
+
+const (
+	// spaceInterval is how often a node measures its free space and tells
+	// its peers if that changed how much data they should place on it.
+	spaceInterval = 5 * time.Second
+
+	// defaultHighWaterMark is how full the disk may get before the node
+	// takes no more chunks, defaultCriticalMark how full before it takes
+	// no writes at all.
+	defaultHighWaterMark = 0.90
+	defaultCriticalMark  = 0.97
+)
+
+// errLowSpace is returned for a write the disk has no room for.
+var errLowSpace = errors.New("not enough disk space")
+
+// Capacity is how big the disk of a node is and how much of it is free. Full
+// is set once it is over the high-water mark, the node takes no more chunks
+// then, ReadOnly once it is over the critical mark and takes no writes at
+// all. A zero Total means the node does not know.
+type Capacity struct {
+	Total    uint64
+	Free     uint64
+	Full     bool
+	ReadOnly bool
+}
+
+// used is the share of the disk that is used.
+func (c Capacity) used() float64 {
+	if c.Total == 0 {
+		return 0
+	}
+	return 1 - float64(c.Free)/float64(c.Total)
+}
+
+// weight is how much of the new files placement puts on the node, a node
+// with more free space gets more. The free space is bucketed into quarters of
+// the disk so the weights don't change with every file written, and a full
+// node only gets the files no other node can take.
+func (c Capacity) weight() float64 {
+	switch {
+	case c.Full:
+		return 1e-6
+	case c.Total == 0:
+		return 1
+	}
+	return float64(min(1+4*c.Free/c.Total, 4))
+}
+
+// MessageCapacity tells the peers the capacity of the node changed.
+type MessageCapacity struct {
+	ID       string
+	Capacity Capacity
+}
+
+func (s *FileServer) handleMessageCapacity(from string, msg MessageCapacity) error {
+	s.peerLock.Lock()
+	old := s.capacities[msg.ID]
+	s.capacities[msg.ID] = msg.Capacity
+	s.peerLock.Unlock()
+
+	// the files the node has stay, only new ones are placed differently
+	if old.weight() != msg.Capacity.weight() {
+		log.Printf("[%s] node %s has (%d) of (%d) bytes free", s.Transport.Addr(), msg.ID, msg.Capacity.Free, msg.Capacity.Total)
+	}
+	return nil
+}
+
+// capacity returns the capacity we measured last.
+func (s *FileServer) capacity() Capacity {
+	return s.ownCapacity.Load().(Capacity)
+}
+
+// measureSpace measures the free space on the storage root and compares it
+// with the marks. If it can't be measured the node keeps taking writes.
+func (s *FileServer) measureSpace() Capacity {
+	c, err := s.DiskSpaceFunc(s.store.Root)
+	if err != nil {
+		c = Capacity{}
+	}
+	c.Full = c.Total > 0 && c.used() >= s.HighWaterMark
+	c.ReadOnly = c.Total > 0 && c.used() >= s.CriticalMark
+
+	old := s.ownCapacity.Swap(c).(Capacity)
+	if c.ReadOnly != old.ReadOnly {
+		if c.ReadOnly {
+			log.Printf("[%s] disk is %.1f%% full, the node is read-only", s.Transport.Addr(), 100*c.used())
+		} else {
+			log.Printf("[%s] disk is %.1f%% full, the node takes writes again", s.Transport.Addr(), 100*c.used())
+		}
+	}
+	return c
+}
+
+// spaceLoop keeps measuring the free space, the peers hear of it when it
+// changes the weight of the node in the placement.
+func (s *FileServer) spaceLoop() {
+	ticker := time.NewTicker(spaceInterval)
+	defer ticker.Stop()
+
+	advertised := s.capacity()
+	for {
+		select {
+		case <-ticker.C:
+			c := s.measureSpace()
+			if c.weight() == advertised.weight() && c.ReadOnly == advertised.ReadOnly {
+				continue
+			}
+			advertised = c
+			if err := s.broadcast(&Message{Payload: MessageCapacity{ID: s.ID, Capacity: c}}); err != nil {
+				log.Printf("[%s] failed to advertise the capacity: %v", s.Transport.Addr(), err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// checkWritable fails if the node is read-only, the disk is critically full.
+func (s *FileServer) checkWritable() error {
+	c := s.measureSpace()
+	if c.ReadOnly {
+		return fmt.Errorf("[%s] %w, the node is read-only with (%d) of (%d) bytes free", s.Transport.Addr(), errLowSpace, c.Free, c.Total)
+	}
+	return nil
+}
+
+// checkSpace fails if writing size bytes takes the disk over the high-water
+// mark. We check before the bytes arrive, so a full disk does not leave a
+// chunk half written.
+func (s *FileServer) checkSpace(size int64) error {
+	if err := s.checkWritable(); err != nil {
+		return err
+	}
+	c := s.capacity()
+	if c.Total == 0 {
+		return nil
+	}
+	after := c
+	after.Free -= min(uint64(max(size, 0)), c.Free)
+	if c.Full || after.used() >= s.HighWaterMark {
+		return fmt.Errorf("[%s] %w, (%d) bytes would take the disk over its high-water mark", s.Transport.Addr(), errLowSpace, size)
+	}
+	return nil
+}
+
+// spaceWeights returns the weight of every node we know the capacity of, the
+// ones a new file is placed with. They are scaled so the average node weighs
+// one, which is what a node that joins later weighs for the file.
+func (s *FileServer) spaceWeights() map[string]float64 {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	weights := map[string]float64{s.ID: s.capacity().weight()}
+	for id, c := range s.capacities {
+		weights[id] = c.weight()
+	}
+
+	var sum float64
+	for _, w := range weights {
+		sum += w
+	}
+	mean := sum / float64(len(weights))
+	for id := range weights {
+		weights[id] /= mean
+	}
+	return weights
+}
+
+// Capacities returns the capacity of this node and the ones its peers
+// advertised last.
+func (s *FileServer) Capacities() map[string]Capacity {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	capacities := maps.Clone(s.capacities)
+	capacities[s.ID] = s.capacity()
+	return capacities
+}
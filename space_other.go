@@ -0,0 +1,11 @@
+//go:build !unix
+
+package main
+
+import "fmt"
+
+// DiskSpace can't tell the free space here, the node takes writes until the
+// disk fails them.
+func DiskSpace(root string) (Capacity, error) {
+	return Capacity{}, fmt.Errorf("free space of %s is unknown on this platform", root)
+}
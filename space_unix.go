@@ -0,0 +1,19 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// DiskSpace reads the size and the free space of the filesystem the root is
+// on. Like df it leaves out the space only root may use, we can't have it.
+func DiskSpace(root string) (Capacity, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(root, &st); err != nil {
+		return Capacity{}, err
+	}
+	used := uint64(st.Blocks) - uint64(st.Bfree)
+	return Capacity{
+		Total: (used + uint64(st.Bavail)) * uint64(st.Bsize),
+		Free:  uint64(st.Bavail) * uint64(st.Bsize),
+	}, nil
+}
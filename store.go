@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/hex"
 	"errors"
@@ -9,10 +10,16 @@ import (
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const defaultRootFoldername = "glnetwork"
 
+// chunkStripes is how many locks the partial chunks are spread over.
+const chunkStripes = 256
+
 func CASPathTransformFunc(key string) PathKey {
 	//[20]byte => []byte -> [:](convert into slice)
 	hash := sha1.Sum([]byte(key))
@@ -58,6 +65,10 @@ type StoreOpts struct {
 	//Root is the folder name of the root directory, containing the folders/files of the system.
 	Root              string
 	PathTransformFunc PathTransformFunc
+	// Backend keeps the bytes, a DiskBackend in Root by default.
+	Backend Backend
+	// Quotas limit what the owners may store, none by default.
+	Quotas Quotas
 }
 
 var DefaultPathTransformFunc = func(key string) PathKey {
@@ -71,8 +82,31 @@ var DefaultPathTransformFunc = func(key string) PathKey {
 
 type store struct {
 	StoreOpts
+	backend Backend
+	refs    refCounter
+	// usage is what every owner stores, checked against the quotas.
+	usage usageCounter
+	// tree lets peers find out which manifests they don't agree on.
+	tree *merkleTree
+
+	// manifestLock serializes the updates of manifests, so the references
+	// of the old and the new manifest of a key are counted right.
+	manifestLock sync.Mutex
+
+	// chunkLocks keep two peers that send us the same chunk at once from
+	// writing into the same partial chunk.
+	chunkLocks [chunkStripes]sync.Mutex
+
+	// closed is set by Close, writes fail from then on.
+	closed atomic.Bool
+
+	// changed is called with every manifest that is written or deleted, the
+	// server drops its cached copy of the file.
+	changed func(id string, key string)
 }
 
+var errStoreClosed = errors.New("store is closed")
+
 func NewStore(opts StoreOpts) *store {
 
 	if opts.PathTransformFunc == nil {
@@ -81,24 +115,58 @@ func NewStore(opts StoreOpts) *store {
 	if len(opts.Root) == 0 {
 		opts.Root = defaultRootFoldername
 	}
-	return &store{
+	backend := opts.Backend
+	if backend == nil {
+		// a crash leaves temporary files behind, the backend removes them
+		backend = NewDiskBackend(opts.Root)
+	}
+	s := &store{
 		StoreOpts: opts,
+		backend:   backend,
+		tree:      newMerkleTree(),
+	}
+	if err := s.rebuildRefs(); err != nil {
+		log.Printf("failed to count the chunk references in %s: %v", opts.Root, err)
 	}
+	return s
 
 }
 
-func (s *store) Has(id string, key string) bool {
+// manifestChanged tells the server the manifest of the key changed.
+func (s *store) manifestChanged(id string, key string) {
+	if s.changed != nil {
+		s.changed(id, key)
+	}
+}
 
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-	_, err := os.Stat(fullPathWithRoot)
+// name is the name the backend keeps the key under.
+func (s *store) name(key string) string {
+	return s.PathTransformFunc(key).FullPath()
+}
 
-	return !errors.Is(err, os.ErrNotExist)
+func (s *store) Has(id string, key string) bool {
+	return s.backend.Has(id, s.name(key))
 }
 
+// clear throws away everything stored.
 func (s *store) clear() error {
+	if c, ok := s.backend.(clearer); ok {
+		return c.Clear()
+	}
 
-	return os.RemoveAll(s.Root)
+	ids, err := s.namespaces()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		err := s.walk(id, func(info ObjectInfo) error {
+			return s.backend.Delete(id, info.Name)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *store) Delete(id string, key string) error {
@@ -109,9 +177,40 @@ func (s *store) Delete(id string, key string) error {
 		log.Printf("Deleting %s from disk", pathkey.Filename)
 	}()
 
-	firstPAthnameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathkey.FirstPathname())
+	return s.backend.Delete(id, pathkey.FullPath())
+}
+
+// namespaces returns the ids there is data stored for.
+func (s *store) namespaces() ([]string, error) {
+	return s.backend.Namespaces()
+}
+
+// walk calls fn with every object stored under the id.
+func (s *store) walk(id string, fn func(info ObjectInfo) error) error {
+	return s.backend.List(id, fn)
+}
+
+// open returns the object of the id the backend has under the name, which
+// walk found.
+func (s *store) open(id string, name string) (io.ReadCloser, error) {
+	_, r, err := s.backend.Get(id, name)
+	return r, err
+}
+
+// touch moves the time the key was written to now.
+func (s *store) touch(id string, key string) error {
+	if t, ok := s.backend.(toucher); ok {
+		return t.Touch(id, s.name(key))
+	}
 
-	return os.RemoveAll(firstPAthnameWithRoot)
+	// rewriting it does the same
+	_, r, err := s.readStream(id, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = s.Write(id, key, r)
+	return err
 }
 
 func (s *store) Write(id string, key string, data io.Reader) (int64, error) {
@@ -130,36 +229,73 @@ func (s *store) Write(id string, key string, data io.Reader) (int64, error) {
 }
 
 func (s *store) WriteDecrypt(enckey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := copyDecrypt(enckey, r, pw)
+		pw.CloseWithError(err)
+	}()
 
-	if err != nil {
-		return 0, err
+	n, err := s.writeStream(id, key, pr)
+	pr.CloseWithError(err)
+	return n, err
+}
+
+// writeStream replaces the key with what r yields. The backend only lets
+// the new bytes show once they are all there, so a transfer that dies
+// halfway never leaves a truncated key behind.
+func (s *store) writeStream(id string, key string, r io.Reader) (int64, error) {
+	if s.closed.Load() {
+		return 0, errStoreClosed
 	}
 
-	n, err := copyDecrypt(enckey, r, f)
+	return s.backend.Put(id, s.name(key), r)
+}
 
-	return int64(n), err
+// Append adds whatever r yields to the end of the key.
+func (s *store) Append(id string, key string, r io.Reader) (int64, error) {
+	size, _, err := s.stat(id, key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	return s.writeAt(id, key, size, r)
 }
 
-func (s *store) openFileForWriting(id string, key string) (*os.File, error) {
-	pathkey := s.PathTransformFunc(key)
-	pathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathkey.Pathname)
+// writeAt keeps the first offset bytes of the key and writes r after them,
+// what was behind them is gone. The backends that can append keep the bytes
+// they got if r fails.
+func (s *store) writeAt(id string, key string, offset int64, r io.Reader) (int64, error) {
+	if s.closed.Load() {
+		return 0, errStoreClosed
+	}
 
-	if err := os.MkdirAll(pathWithRoot, os.ModePerm); err != nil {
-		return nil, err
+	size, _, err := s.stat(id, key)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
 	}
-	// fullPath := pathkey.FullPath()
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathkey.FullPath())
-	return os.Create(fullPathWithRoot)
+	if a, ok := s.backend.(appender); ok && offset == size {
+		return a.Append(id, s.name(key), r)
+	}
+
+	head := io.Reader(bytes.NewReader(nil))
+	if offset > 0 {
+		rc, err := s.ReadAt(id, key, 0, offset)
+		if err != nil {
+			return 0, err
+		}
+		defer rc.Close()
+		head = rc
+	}
+	n, err := s.backend.Put(id, s.name(key), io.MultiReader(head, r))
+	return max(n-offset, 0), err
 }
-func (s *store) writeStream(id string, key string, r io.Reader) (int64, error) {
 
-	f, err := s.openFileForWriting(id, key)
+// stat returns the size of the key and when it was written.
+func (s *store) stat(id string, key string) (int64, time.Time, error) {
+	info, err := s.backend.Stat(id, s.name(key))
 	if err != nil {
-		return 0, err
+		return 0, time.Time{}, err
 	}
-	return io.Copy(f, r)
-
+	return info.Size, info.ModTime, nil
 }
 
 // FIXME: Done
@@ -169,20 +305,38 @@ func (s *store) Read(id string, key string) (int64, io.Reader, error) {
 
 }
 func (s *store) readStream(id string, key string) (int64, io.ReadCloser, error) {
+	return s.backend.Get(id, s.name(key))
+}
 
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
-
-	file, err := os.Open(fullPathWithRoot)
-
+// ReadAt returns length bytes of the key from offset on, a length of zero or
+// less reads to the end.
+func (s *store) ReadAt(id string, key string, offset int64, length int64) (io.ReadCloser, error) {
+	size, file, err := s.readStream(id, key)
 	if err != nil {
-		return 0, nil, err
+		return nil, err
 	}
 
-	fi, err := file.Stat()
-
+	if offset < 0 || offset > size {
+		file.Close()
+		return nil, fmt.Errorf("offset %d is out of the %d bytes of %s", offset, size, key)
+	}
+	if seeker, ok := file.(io.Seeker); ok {
+		_, err = seeker.Seek(offset, io.SeekStart)
+	} else {
+		_, err = io.CopyN(io.Discard, file, offset)
+	}
 	if err != nil {
-		return 0, nil, err
+		file.Close()
+		return nil, err
+	}
+	if length <= 0 || offset+length > size {
+		length = size - offset
 	}
-	return fi.Size(), file, nil
+
+	return &limitedReadCloser{Reader: io.LimitReader(file, length), Closer: file}, nil
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
 }
@@ -2,10 +2,13 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestPathTransform(t *testing.T) {
@@ -71,6 +74,112 @@ func TestStore(t *testing.T) {
 
 }
 
+func TestChunkRefsAcrossOwners(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	chunk := []byte("the same chunk in two files of two owners")
+	key := convergentKey(chunk)
+	encrypted, err := encryptChunk(key, chunk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := hashChunk(encrypted)
+
+	owners := []string{generateID(), generateID()}
+	for _, id := range owners {
+		if _, err := s.WriteChunk(hash, bytes.NewReader(encrypted)); err != nil {
+			t.Fatal(err)
+		}
+		m := &Manifest{
+			Key:    hashKey("file"),
+			Size:   int64(len(chunk)),
+			Chunks: []ChunkRef{{Hash: hash, Size: int64(len(chunk))}},
+		}
+		if err := s.WriteManifest(id, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := s.refCount(hash); n != 2 {
+		t.Fatalf("want 2 references, have %d", n)
+	}
+
+	// the counts survive a restart of the store
+	if err := s.rebuildRefs(); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.refCount(hash); n != 2 {
+		t.Fatalf("want 2 references after rebuilding, have %d", n)
+	}
+
+	if err := s.DeleteManifest(owners[0], hashKey("file")); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.sweepChunks(0); n != 0 || !s.HasChunk(hash) {
+		t.Fatal("chunk collected while it is still referenced")
+	}
+
+	if err := s.DeleteManifest(owners[1], hashKey("file")); err != nil {
+		t.Fatal(err)
+	}
+	if n, _ := s.sweepChunks(0); n != 1 || s.HasChunk(hash) {
+		t.Fatal("unreferenced chunk was not collected")
+	}
+
+	if _, err := s.WriteChunk(hash, bytes.NewReader(chunk)); err == nil {
+		t.Fatal("expected a chunk that does not match its hash to be rejected")
+	}
+}
+
+func TestWriteChunkAtResumes(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	chunk := bytes.Repeat([]byte("resumable "), 100)
+	hash := hashChunk(chunk)
+	id, key := generateID(), hashKey("file")
+
+	if err := s.recordUpload(id, key, hash); err != nil {
+		t.Fatal(err)
+	}
+
+	// the transfer dies after 300 bytes
+	size := int64(len(chunk))
+	if _, err := s.WriteChunkAt(hash, 0, size, bytes.NewReader(chunk[:300])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("want io.ErrUnexpectedEOF for a short chunk, have %v", err)
+	}
+
+	// a restarted store still knows how far we got
+	s = NewStore(s.StoreOpts)
+	complete, partial, err := s.uploadStatus(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(complete) != 0 || partial[hash] != 300 {
+		t.Fatalf("want 300 bytes of the partial chunk, have %v %v", complete, partial)
+	}
+
+	if _, err := s.WriteChunkAt(hash, 300, size, bytes.NewReader(chunk[300:])); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasChunk(hash) || s.partialChunkSize(hash) != 0 {
+		t.Fatal("completed chunk was not moved into the pool")
+	}
+
+	complete, _, err = s.uploadStatus(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(complete) != 1 || complete[0] != hash {
+		t.Fatalf("want the chunk to be complete, have %v", complete)
+	}
+}
+
 func newStore() *store {
 	return NewStore(StoreOpts{
 		PathTransformFunc: CASPathTransformFunc,
@@ -152,3 +261,143 @@ func readData(r io.Reader) ([]byte, error) {
 // 		os.RemoveAll(pathKey.Pathname)
 // 	}()
 // }
+
+func TestHistoryPrune(t *testing.T) {
+	now := time.Now()
+	h := &history{Retention: Retention{MaxVersions: 2, MaxAge: time.Hour}}
+	for i, age := range []time.Duration{3 * time.Hour, 30 * time.Minute, 20 * time.Minute, 10 * time.Minute} {
+		h.Versions = append(h.Versions, pastVersion{
+			Manifest: &Manifest{Version: int64(i)},
+			Replaced: now.Add(-age),
+		})
+	}
+
+	pruned := h.prune(now)
+	if len(pruned) != 2 || len(h.Versions) != 2 {
+		t.Fatalf("pruned %d and kept %d versions, want 2 and 2", len(pruned), len(h.Versions))
+	}
+	if h.Versions[0].Manifest.Version != 2 {
+		t.Fatalf("kept version %d first, want 2", h.Versions[0].Manifest.Version)
+	}
+
+	// only the age limits once the count is fine
+	h.Retention.MaxVersions = 0
+	if pruned := h.prune(now.Add(45 * time.Minute)); len(pruned) != 1 {
+		t.Fatalf("pruned %d versions by age, want 1", len(pruned))
+	}
+}
+
+func TestConcurrentWritesKeepSiblings(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+	})
+
+	var (
+		id   = generateID()
+		hkey = hashKey("file")
+	)
+	write := func(version int64, clock VersionVector, hash string) *Manifest {
+		m := &Manifest{
+			Key:     hkey,
+			Version: version,
+			Clock:   clock,
+			Chunks:  []ChunkRef{{Hash: hash}},
+		}
+		if err := s.WriteManifest(id, m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+
+	a := write(1, VersionVector{"n1": 1}, "a")
+	b := write(2, VersionVector{"n2": 1}, "b")
+
+	m, err := s.ReadManifest(id, hkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	siblings, err := s.readSiblings(id, hkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != b.Version || len(siblings) != 1 || siblings[0].Version != a.Version {
+		t.Fatalf("current is version %d with %d siblings, want the newest with the other as its sibling", m.Version, len(siblings))
+	}
+
+	// the sibling keeps its chunks, across a restart too
+	if err := s.rebuildRefs(); err != nil {
+		t.Fatal(err)
+	}
+	if s.refCount("a") != 1 || s.refCount("b") != 1 {
+		t.Fatal("both concurrent versions should reference their chunks")
+	}
+
+	// a write that saw both replaces both
+	write(3, a.Clock.merge(b.Clock).next("n1"), "c")
+	if siblings, _ := s.readSiblings(id, hkey); len(siblings) != 0 {
+		t.Fatalf("have %d siblings after a write that saw them all", len(siblings))
+	}
+	if s.refCount("a") != 0 || s.refCount("b") != 0 || s.refCount("c") != 1 {
+		t.Fatal("the replaced versions should have dropped their chunks")
+	}
+
+	// and one that it saw already changes nothing
+	write(4, b.Clock, "d")
+	if m, _ := s.ReadManifest(id, hkey); m.Version != 3 {
+		t.Fatalf("stale write replaced the current version, have %d", m.Version)
+	}
+}
+
+func TestQuotasLimitOwners(t *testing.T) {
+	s := NewStore(StoreOpts{
+		Root:              t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Quotas: Quotas{
+			Owner:  Quota{LogicalBytes: 100},
+			Owners: map[string]Quota{"big": {LogicalBytes: 1000}},
+			Node:   Quota{Objects: 3},
+		},
+	})
+
+	write := func(id string, key string, version int64, size int64) error {
+		return s.WriteManifest(id, &Manifest{Key: hashKey(key), Version: version, Size: size})
+	}
+
+	if err := write("small", "a", 1, 60); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("small", "b", 1, 60); !errors.Is(err, errQuotaExceeded) {
+		t.Fatalf("wrote over the quota of the owner: %v", err)
+	}
+	// replacing a file only counts the difference
+	if err := write("small", "a", 2, 90); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("big", "a", 1, 500); err != nil {
+		t.Fatal(err)
+	}
+	if err := write("big", "b", 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	var quota *QuotaError
+	if err := write("big", "c", 1, 10); !errors.As(err, &quota) || quota.Owner != "" {
+		t.Fatalf("wrote over the quota of the node: %v", err)
+	}
+
+	if err := s.DeleteManifest("big", hashKey("b")); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Usage{"small": {LogicalBytes: 90, Objects: 1}, "big": {LogicalBytes: 500, Objects: 1}}
+	if !maps.Equal(s.usage.owners, want) || s.usage.total != (Usage{LogicalBytes: 590, Objects: 2}) {
+		t.Fatalf("usage is %v in total %v, want %v", s.usage.owners, s.usage.total, want)
+	}
+
+	// a restart counts it all again
+	if err := s.rebuildRefs(); err != nil {
+		t.Fatal(err)
+	}
+	if !maps.Equal(s.usage.owners, want) {
+		t.Fatalf("usage after a restart is %v, want %v", s.usage.owners, want)
+	}
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// versionNamespace holds the old versions of the versioned files, one
+// history per file of an owner.
+const versionNamespace = "versions"
+
+// Retention says which old versions of a versioned file are kept, a zero
+// field does not limit them.
+type Retention struct {
+	// MaxVersions is how many old versions are kept, the newest ones.
+	MaxVersions int
+	// MaxAge is how long a version is kept once a newer one replaced it.
+	MaxAge time.Duration
+}
+
+// VersionInfo describes a version of a file.
+type VersionInfo struct {
+	ID      string
+	Created time.Time
+	Size    int64
+	// Current is set for the version GET reads by default.
+	Current bool
+}
+
+// versionID is how the version of a manifest is called in the API, it sorts
+// the same way the versions do.
+func versionID(version int64) string {
+	return fmt.Sprintf("%016x", version)
+}
+
+func (m *Manifest) versionInfo(current bool) VersionInfo {
+	created := m.Created
+	if created.IsZero() {
+		created = time.Unix(0, m.Version)
+	}
+	return VersionInfo{
+		ID:      versionID(m.Version),
+		Created: created,
+		Size:    m.Size,
+		Current: current,
+	}
+}
+
+// pastVersion is a manifest that was replaced by a newer version of its file.
+type pastVersion struct {
+	Manifest *Manifest
+	Replaced time.Time
+}
+
+// history are the old versions of the file of an owner, oldest first. The
+// chunks of every version stay referenced until it is pruned.
+type history struct {
+	ID        string
+	Key       string
+	Retention Retention
+	Versions  []pastVersion
+}
+
+func historyKey(id string, hkey string) string {
+	return id + "/" + hkey
+}
+
+// prune drops the versions the retention does not keep any longer and
+// returns them.
+func (h *history) prune(now time.Time) []pastVersion {
+	var kept, pruned []pastVersion
+	for i, v := range h.Versions {
+		tooMany := h.Retention.MaxVersions > 0 && len(h.Versions)-i > h.Retention.MaxVersions
+		tooOld := h.Retention.MaxAge > 0 && now.Sub(v.Replaced) > h.Retention.MaxAge
+		if tooMany || tooOld {
+			pruned = append(pruned, v)
+			continue
+		}
+		kept = append(kept, v)
+	}
+	h.Versions = kept
+	return pruned
+}
+
+func decodeHistory(r io.Reader) (*history, error) {
+	h := new(history)
+	if err := gob.NewDecoder(r).Decode(h); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// readHistory returns the history of the file, an empty one if it has none.
+func (s *store) readHistory(id string, hkey string) (*history, error) {
+	_, r, err := s.readStream(versionNamespace, historyKey(id, hkey))
+	if errors.Is(err, os.ErrNotExist) {
+		return &history{ID: id, Key: hkey}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return decodeHistory(r)
+}
+
+// writeHistory stores the history, one without versions is deleted.
+func (s *store) writeHistory(h *history) error {
+	if len(h.Versions) == 0 {
+		err := s.Delete(versionNamespace, historyKey(h.ID, h.Key))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(h); err != nil {
+		return err
+	}
+	_, err := s.Write(versionNamespace, historyKey(h.ID, h.Key), buf)
+	return err
+}
+
+// archiveVersion adds the manifest m replaced to the history of the file and
+// prunes it with the retention of m. It keeps the references of old, the
+// ones of the versions it prunes are dropped. Callers hold the manifestLock.
+func (s *store) archiveVersion(id string, old *Manifest, m *Manifest) error {
+	h, err := s.readHistory(id, m.Key)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	h.Retention = m.Retention
+	h.Versions = append(h.Versions, pastVersion{Manifest: old, Replaced: now})
+	pruned := h.prune(now)
+
+	if err := s.writeHistory(h); err != nil {
+		return err
+	}
+
+	for _, v := range pruned {
+		s.releaseChunks(v.Manifest)
+	}
+	return nil
+}
+
+// deleteHistory drops all old versions of the file. Callers hold the
+// manifestLock.
+func (s *store) deleteHistory(id string, hkey string) error {
+	h, err := s.readHistory(id, hkey)
+	if err != nil {
+		return err
+	}
+
+	versions := h.Versions
+	h.Versions = nil
+	if err := s.writeHistory(h); err != nil {
+		return err
+	}
+
+	for _, v := range versions {
+		s.releaseChunks(v.Manifest)
+	}
+	return nil
+}
+
+// readVersion returns the manifest of the version of the file, current, a
+// sibling of it or old.
+func (s *store) readVersion(id string, hkey string, version string) (*Manifest, error) {
+	if m, err := s.ReadManifest(id, hkey); err == nil && versionID(m.Version) == version {
+		return m, nil
+	}
+	siblings, _ := s.readSiblings(id, hkey)
+	for _, m := range siblings {
+		if versionID(m.Version) == version {
+			return m, nil
+		}
+	}
+
+	h, err := s.readHistory(id, hkey)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range h.Versions {
+		if versionID(v.Manifest.Version) == version {
+			return v.Manifest, nil
+		}
+	}
+	return nil, fmt.Errorf("version %s of %s not found", version, hkey)
+}
+
+// versions lists the versions of the file, oldest first.
+func (s *store) versions(id string, hkey string) ([]VersionInfo, error) {
+	h, err := s.readHistory(id, hkey)
+	if err != nil {
+		return nil, err
+	}
+
+	infos := []VersionInfo{}
+	for _, v := range h.Versions {
+		infos = append(infos, v.Manifest.versionInfo(false))
+	}
+	if m, err := s.ReadManifest(id, hkey); err == nil {
+		infos = append(infos, m.versionInfo(true))
+	}
+	return infos, nil
+}
+
+// pruneVersions applies the retention of every history, versions that are
+// too old go even when no new version comes along.
+func (s *store) pruneVersions() (int, error) {
+	s.manifestLock.Lock()
+	defer s.manifestLock.Unlock()
+
+	// the histories are rewritten after the walk, not under its feet
+	histories := []*history{}
+	err := s.walk(versionNamespace, func(info ObjectInfo) error {
+		f, err := s.open(versionNamespace, info.Name)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		h, err := decodeHistory(f)
+		if err != nil {
+			log.Printf("skipping %s, not a history: %v", info.Name, err)
+			return nil
+		}
+		histories = append(histories, h)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var (
+		now    = time.Now()
+		pruned = 0
+	)
+	for _, h := range histories {
+		gone := h.prune(now)
+		if len(gone) == 0 {
+			continue
+		}
+		if err := s.writeHistory(h); err != nil {
+			return pruned, err
+		}
+		for _, v := range gone {
+			s.releaseChunks(v.Manifest)
+		}
+		pruned += len(gone)
+	}
+	return pruned, nil
+}
+
+// ListVersions returns the versions of the file we know of, oldest first.
+// Only files written with versioning have old versions.
+func (s *FileServer) ListVersions(key string) ([]VersionInfo, error) {
+	infos, err := s.store.versions(s.Owner, hashKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if len(infos) == 0 {
+		return nil, fmt.Errorf("[%s] file (%s) not found", s.Transport.Addr(), key)
+	}
+	return infos, nil
+}
+
+// fetchVersion returns the manifest of the version of the file, from the
+// peers if we don't have it, and the peers that have it.
+func (s *FileServer) fetchVersion(hkey string, version string) (*Manifest, []string, error) {
+	if m, err := s.store.readVersion(s.Owner, hkey, version); err == nil {
+		return m, nil, nil
+	}
+
+	answers, err := s.fetchManifests(hkey, version, 1)
+	if err != nil {
+		return nil, nil, err
+	}
+	m, holders := newestManifest(answers)
+	if m == nil {
+		return nil, nil, fmt.Errorf("[%s] version %s of (%s) not found in the network", s.Transport.Addr(), version, hkey)
+	}
+	return m, holders, nil
+}
+
+// Restore makes the version of the file the current one again. The bytes
+// of that version are written as a new version, with the durability they
+// had, so the versions in between stay in the history. The chunks are the
+// same, so nothing but the manifest goes over the network.
+func (s *FileServer) Restore(key string, version string) error {
+	hkey := hashKey(key)
+	m, _, err := s.fetchVersion(hkey, version)
+	if err != nil {
+		return err
+	}
+
+	r, err := s.GETWith(key, ReadOpts{Version: version})
+	if err != nil {
+		return err
+	}
+
+	// the retention is the one the file has now
+	opts := WriteOpts{
+		Durability: m.Durability,
+		Versioned:  true,
+		Retention:  m.Retention,
+	}
+	if cur, err := s.store.ReadManifest(s.Owner, hkey); err == nil {
+		opts.Retention = cur.Retention
+	}
+	if err := s.StoreWith(key, r, opts); err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] restored (%s) to version %s\n", s.Transport.Addr(), key, version)
+	return nil
+}